@@ -1,6 +1,6 @@
 module forum
 
-go 1.23
+go 1.23.0
 
 toolchain go1.23.5
 
@@ -9,3 +9,5 @@ require golang.org/x/crypto v0.32.0
 require github.com/mattn/go-sqlite3 v1.14.24
 
 require github.com/google/uuid v1.6.0
+
+require golang.org/x/image v0.25.0
@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// avatarSizes are the square sizes avatars are generated in, smallest
+// first. The largest is stored as the avatar image itself and the others
+// as its variants.
+var avatarSizes = []int{32, 64, 128, 256}
+
+// avatarCacheControl is sent with avatars. Their URL stays the same when a
+// user changes their avatar, so browsers check back after a few minutes.
+const avatarCacheControl = "public, max-age=300"
+
+// errAvatarType is returned for uploads that cannot be cropped, such as
+// video clips without a poster frame. Its message is the key of its
+// ErrorMessages entry.
+var errAvatarType = errors.New("avatar_invalid_type")
+
+// avatarURL returns the address of a user's avatar in the given size
+func avatarURL(userID string, size int) string {
+	return fmt.Sprintf("/avatar/%s/%d", userID, size)
+}
+
+// AvatarURL returns the address of the author's avatar
+func (p Post) AvatarURL() string {
+	return avatarURL(p.UserID, 64)
+}
+
+// AvatarURL returns the address of the author's avatar
+func (c Comment) AvatarURL() string {
+	return avatarURL(c.UserID, 64)
+}
+
+// centerCrop returns the largest square in the middle of an image
+func centerCrop(src image.Image) image.Image {
+	rgba := toRGBA(src)
+	w, h := rgba.Rect.Dx(), rgba.Rect.Dy()
+	side := min(w, h)
+	x0, y0 := (w-side)/2, (h-side)/2
+	return rgba.SubImage(image.Rect(x0, y0, x0+side, y0+side))
+}
+
+// SetAvatar crops an uploaded picture to a square, stores it in every
+// avatar size and makes it the user's avatar. The previous avatar is left
+// for the garbage collector.
+func SetAvatar(userID, filename string, data []byte) (Image, error) {
+	if err := CheckUploadQuota(userID, int64(len(data))); err != nil {
+		return Image{}, err
+	}
+	if err := ScanUpload(userID, filename, data); err != nil {
+		return Image{}, err
+	}
+	info, err := ValidateImage(data, filename)
+	if err != nil {
+		return Image{}, err
+	}
+	if needsTranscoding(info.MimeType) {
+		if _, info, err = TranscodeImage(data, info); err != nil {
+			return Image{}, err
+		}
+	}
+	if info.Decoded == nil || isVideoType(info.MimeType) {
+		return Image{}, errAvatarType
+	}
+	// Crop the picture as it is shown, not as the camera stored it
+	info = orientImage(data, info)
+
+	// Photos stay JPEG, everything else becomes PNG to keep transparency
+	mimeType := "image/png"
+	if info.MimeType == "image/jpeg" {
+		mimeType = info.MimeType
+	}
+	largest := avatarSizes[len(avatarSizes)-1]
+	square := resizeImage(centerCrop(info.Decoded), largest, largest)
+	encoded, err := encodeImage(square, mimeType)
+	if err != nil {
+		return Image{}, fmt.Errorf("encoding avatar: %w", err)
+	}
+
+	// Refuse banned pictures as avatars too
+	phash := perceptualHash(square)
+	if err := CheckBannedImage(phash); err != nil {
+		return Image{}, err
+	}
+
+	img, err := StoreImage(userID, filename, ImageInfo{
+		MimeType: mimeType,
+		Width:    largest,
+		Height:   largest,
+		Frames:   1,
+		PHash:    phash,
+	}, encoded)
+	if err != nil {
+		return Image{}, err
+	}
+	format, _ := formatByMimeType(mimeType)
+	for _, size := range avatarSizes[:len(avatarSizes)-1] {
+		if err := storeVariant(&img, square, size, size, format.Extensions[0]); err != nil {
+			return Image{}, err
+		}
+	}
+
+	if _, err := db.Exec("UPDATE users SET avatar_image_id = ? WHERE id = ?", img.ID, userID); err != nil {
+		return Image{}, fmt.Errorf("setting avatar: %w", err)
+	}
+	return img, nil
+}
+
+// RemoveAvatar makes a user fall back to their identicon
+func RemoveAvatar(userID string) error {
+	_, err := db.Exec("UPDATE users SET avatar_image_id = NULL WHERE id = ?", userID)
+	return err
+}
+
+// identicon draws a symmetric 5x5 pattern derived from the user ID, so
+// every user without an avatar still looks different and always the same
+func identicon(userID string, size int) *image.RGBA {
+	sum := sha256.Sum256([]byte(userID))
+	fg := color.RGBA{R: 48 + sum[0]%160, G: 48 + sum[1]%160, B: 48 + sum[2]%160, A: 255}
+	bg := color.RGBA{R: 240, G: 240, B: 240, A: 255}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	cell := size / 6
+	margin := (size - 5*cell) / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetRGBA(x, y, bg)
+		}
+	}
+	for row := 0; row < 5; row++ {
+		// The left three columns are chosen by the hash and mirrored
+		for col := 0; col < 3; col++ {
+			bit := row*3 + col
+			if sum[3+bit/8]&(1<<(bit%8)) == 0 {
+				continue
+			}
+			for _, c := range []int{col, 4 - col} {
+				for y := margin + row*cell; y < margin+(row+1)*cell; y++ {
+					for x := margin + c*cell; x < margin+(c+1)*cell; x++ {
+						img.SetRGBA(x, y, fg)
+					}
+				}
+			}
+		}
+	}
+	return img
+}
+
+// AvatarHandler serves avatars under /avatar/{userID}/{size}, where size
+// is one of avatarSizes. Users without an avatar get their identicon.
+func AvatarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		RenderError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/avatar/"), "/")
+	if len(parts) != 2 {
+		RenderError(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+	userID := parts[0]
+	size, err := strconv.Atoi(parts[1])
+	if err != nil || !slices.Contains(avatarSizes, size) {
+		RenderError(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+
+	var avatarID sql.NullInt64
+	err = db.QueryRow("SELECT avatar_image_id FROM users WHERE id = ?", userID).Scan(&avatarID)
+	if err == sql.ErrNoRows {
+		RenderError(w, r, "Page not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching avatar of user %s: %v", userID, err)
+		RenderError(w, r, "server_error", http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Cache-Control", avatarCacheControl)
+	header.Set("X-Content-Type-Options", "nosniff")
+
+	if avatarID.Valid {
+		img, err := GetImage(avatarID.Int64)
+		if err != nil {
+			log.Printf("Error fetching avatar image %d: %v", avatarID.Int64, err)
+			RenderError(w, r, "server_error", http.StatusInternalServerError)
+			return
+		}
+		key := img.Path
+		for _, v := range img.Variants {
+			if v.Width == size {
+				key = v.Path
+			}
+		}
+		data, err := readBlob(key)
+		if err != nil {
+			log.Printf("Error reading avatar %s: %v", key, err)
+			RenderError(w, r, "server_error", http.StatusInternalServerError)
+			return
+		}
+		header.Set("Content-Type", img.MimeType)
+		header.Set("ETag", fmt.Sprintf(`"%s-%d"`, img.Hash, size))
+		http.ServeContent(w, r, "", img.CreatedAt, bytes.NewReader(data))
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, identicon(userID, size)); err != nil {
+		log.Printf("Error encoding identicon: %v", err)
+		RenderError(w, r, "server_error", http.StatusInternalServerError)
+		return
+	}
+	header.Set("Content-Type", "image/png")
+	header.Set("ETag", fmt.Sprintf(`"identicon-%d"`, size))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+// updateAvatarFromForm sets or removes the avatar as the settings form asks
+func updateAvatarFromForm(r *http.Request, userID string) error {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		return err
+	}
+	if r.FormValue("action") == "remove" {
+		return RemoveAvatar(userID)
+	}
+	file, header, err := r.FormFile("avatar")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxImageSize+1))
+	if err != nil {
+		return err
+	}
+	_, err = SetAvatar(userID, header.Filename, data)
+	return err
+}
+
+// ProfileSettingsHandler lets users upload or remove their avatar
+func ProfileSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserIdFromSession(w, r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var formError *ErrorData
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+1<<20)
+		err := updateAvatarFromForm(r, userID)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case err == nil:
+			http.Redirect(w, r, "/profile/settings", http.StatusSeeOther)
+			return
+		case errors.As(err, &maxBytesErr):
+			err = errImageTooLarge
+		case errors.Is(err, http.ErrMissingFile):
+			err = errImageEmpty
+		}
+		data, ok := errorMessage(err.Error(), userID)
+		if !ok {
+			log.Printf("Error setting avatar: %v", err)
+			data = ErrorMessages["server_error"]
+		}
+		formError = &data
+	default:
+		RenderError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var username string
+	var avatarID sql.NullInt64
+	if err := db.QueryRow("SELECT username, avatar_image_id FROM users WHERE id = ?", userID).Scan(&username, &avatarID); err != nil {
+		log.Printf("Error fetching user info: %v", err)
+		RenderError(w, r, "Error fetching user information", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/profile_settings.html")
+	if err != nil {
+		log.Printf("Error parsing profile settings template: %v", err)
+		RenderError(w, r, "Error loading page", http.StatusInternalServerError)
+		return
+	}
+	if formError != nil {
+		w.WriteHeader(formError.StatusCode)
+	}
+	data := map[string]interface{}{
+		"Username":  username,
+		"AvatarURL": avatarURL(userID, 128),
+		"HasAvatar": avatarID.Valid,
+		"Error":     formError,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error executing profile settings template: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotFound is returned when a key does not exist in the store
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored file
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStore stores uploaded files under slash-separated keys such as
+// "ab/cd/abcd...jpg". Implementations must be safe for concurrent use.
+type BlobStore interface {
+	Put(key string, r io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	Stat(key string) (BlobInfo, error)
+	Walk(fn func(BlobInfo) error) error // Calls fn for every stored file
+}
+
+// blobStore is the store used for uploads, selected by InitStorage
+var blobStore BlobStore = NewLocalStore("uploads")
+
+// InitStorage selects the blob store configured in AppConfig
+func InitStorage() {
+	switch AppConfig.StorageBackend {
+	case "", "local":
+		blobStore = NewLocalStore(AppConfig.UploadsDir)
+	case "s3":
+		blobStore = NewS3Store(S3Config{
+			Endpoint:  AppConfig.S3Endpoint,
+			Bucket:    AppConfig.S3Bucket,
+			Region:    AppConfig.S3Region,
+			AccessKey: AppConfig.S3AccessKey,
+			SecretKey: AppConfig.S3SecretKey,
+		})
+	default:
+		log.Fatalf("Unknown storage backend %q", AppConfig.StorageBackend)
+	}
+}
+
+// readBlob returns the whole content of a stored file
+func readBlob(key string) ([]byte, error) {
+	content, err := blobStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	return io.ReadAll(content)
+}
+
+// validBlobKey rejects keys that could escape the store's root
+func validBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
+
+// LocalStore keeps files in a directory on the local filesystem
+type LocalStore struct {
+	Root string // Directory the keys are relative to
+}
+
+// NewLocalStore returns a store rooted at dir
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{Root: dir}
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+// Put writes the file through a temporary file so a failed upload never
+// leaves a truncated file under the final name.
+func (s *LocalStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return fmt.Errorf("creating upload directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), fullPath); err != nil {
+		return fmt.Errorf("moving file into place: %w", err)
+	}
+	return nil
+}
+
+// Get opens the file. The returned value is an *os.File, so it can seek.
+func (s *LocalStore) Get(key string) (io.ReadCloser, error) {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fullPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *LocalStore) Delete(key string) error {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fullPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *LocalStore) Stat(key string) (BlobInfo, error) {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	fi, err := os.Stat(fullPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return BlobInfo{}, ErrBlobNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{
+		Key:         key,
+		Size:        fi.Size(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+		ModTime:     fi.ModTime(),
+	}, nil
+}
+
+func (s *LocalStore) Walk(fn func(BlobInfo) error) error {
+	err := filepath.WalkDir(s.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		return fn(BlobInfo{
+			Key:         key,
+			Size:        fi.Size(),
+			ContentType: mime.TypeByExtension(path.Ext(key)),
+			ModTime:     fi.ModTime(),
+		})
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // Nothing has been uploaded yet
+	}
+	return err
+}
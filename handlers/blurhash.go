@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"image"
+	"log"
+	"math"
+	"strings"
+)
+
+// blurHashSize is the width or height, whichever is larger, images are
+// shrunk to before computing their BlurHash. The hash only keeps a few
+// cosine components, so more pixels would not change it noticeably.
+const blurHashSize = 32
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// encodeBase83 writes value as length base 83 digits
+func encodeBase83(sb *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := value / int(math.Pow(83, float64(i))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow raises the magnitude of v to exp and keeps its sign
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// blurHash returns the BlurHash of an image (https://blurha.sh): a short
+// string describing a blurred version of it, which browsers decode into a
+// placeholder while the image loads. It returns "" without pixels.
+func blurHash(src image.Image) string {
+	if src == nil || src.Bounds().Empty() {
+		return ""
+	}
+
+	// Four components along the long side and three along the short one
+	b := src.Bounds()
+	width, height := blurHashSize, blurHashSize*b.Dy()/b.Dx()
+	compX, compY := 4, 3
+	if b.Dy() > b.Dx() {
+		width, height = blurHashSize*b.Dx()/b.Dy(), blurHashSize
+		compX, compY = 3, 4
+	}
+	pixels := resizeImage(src, max(width, 1), max(height, 1))
+	width, height = pixels.Rect.Dx(), pixels.Rect.Dy()
+
+	// Weight of each cosine component in linear RGB
+	factors := make([][3]float64, 0, compX*compY)
+	for j := 0; j < compY; j++ {
+		for i := 0; i < compX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i*x)/float64(width)) *
+						math.Cos(math.Pi*float64(j*y)/float64(height))
+					o := y*pixels.Stride + x*4
+					f[0] += basis * srgbToLinear(pixels.Pix[o])
+					f[1] += basis * srgbToLinear(pixels.Pix[o+1])
+					f[2] += basis * srgbToLinear(pixels.Pix[o+2])
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	encodeBase83(&sb, (compX-1)+(compY-1)*9, 1)
+
+	// The AC components are scaled by the largest of them
+	var actualMax float64
+	for _, f := range factors[1:] {
+		actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+	}
+	quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+	maxValue := float64(quantisedMax+1) / 166
+	encodeBase83(&sb, quantisedMax, 1)
+
+	dc := factors[0]
+	encodeBase83(&sb, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, f := range factors[1:] {
+		var q [3]int
+		for c := range q {
+			q[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(f[c]/maxValue, 0.5)*9+9.5))))
+		}
+		encodeBase83(&sb, q[0]*19*19+q[1]*19+q[2], 2)
+	}
+	return sb.String()
+}
+
+// BackfillPlaceholders records the dimensions and BlurHash of images
+// stored before they were computed on upload. Returns how many images got
+// a BlurHash; images that cannot be decoded are marked with an empty one.
+func BackfillPlaceholders() (int, error) {
+	rows, err := db.Query("SELECT id, path, COALESCE(mime_type, '') FROM images WHERE blurhash IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id            int64
+		key, mimeType string
+	}
+	var images []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.key, &p.mimeType); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		images = append(images, p)
+	}
+	rows.Close()
+
+	updated := 0
+	for _, p := range images {
+		hash := ""
+		format, ok := formatByMimeType(p.mimeType)
+		if ok && format.Decode != nil {
+			if data, err := readBlob(p.key); err != nil {
+				log.Printf("Error reading image %d: %v", p.id, err)
+			} else if decoded, err := format.Decode(data); err != nil {
+				log.Printf("Error decoding image %d: %v", p.id, err)
+			} else {
+				hash = blurHash(decoded)
+				b := decoded.Bounds()
+				if _, err := db.Exec("UPDATE images SET width = ?, height = ? WHERE id = ? AND COALESCE(width, 0) = 0",
+					b.Dx(), b.Dy(), p.id); err != nil {
+					return updated, err
+				}
+			}
+		}
+		if _, err := db.Exec("UPDATE images SET blurhash = ? WHERE id = ?", hash, p.id); err != nil {
+			return updated, err
+		}
+		if hash != "" {
+			updated++
+		}
+	}
+	return updated, nil
+}
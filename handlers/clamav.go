@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Malware scanning errors. Each message is the key of its ErrorMessages entry.
+var (
+	errUploadInfected   = errors.New("upload_infected")
+	errScanUnavailable  = errors.New("upload_scan_unavailable")
+	errScannerResponded = errors.New("clamd reported an error")
+)
+
+// clamdChunkSize is the most bytes sent in one INSTREAM chunk
+const clamdChunkSize = 64 << 10
+
+// Fail modes for AppConfig.ClamAVFailMode
+const (
+	ScanFailClosed = "closed" // Refuse uploads while the scanner cannot be used
+	ScanFailOpen   = "open"   // Store uploads unscanned while the scanner cannot be used
+)
+
+// clamdAddress returns the network and address to dial for a configured
+// scanner address: a path is a unix socket, anything else host:port
+func clamdAddress(address string) (string, string) {
+	if strings.HasPrefix(address, "/") {
+		return "unix", address
+	}
+	return "tcp", strings.TrimPrefix(address, "tcp://")
+}
+
+// scanWithClamd streams data to clamd with the INSTREAM command and returns
+// the name of the signature it matched, or "" if it is clean. The stream is
+// sent in chunks, each prefixed with its length, and ends with an empty one.
+func scanWithClamd(address string, data []byte) (string, error) {
+	network, addr := clamdAddress(address)
+	conn, err := net.DialTimeout(network, addr, AppConfig.ClamAVTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(AppConfig.ClamAVTimeout)); err != nil {
+		return "", err
+	}
+
+	// The z prefix makes clamd expect and send null-terminated lines
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	var size [4]byte
+	for len(data) > 0 {
+		chunk := data[:min(len(data), clamdChunkSize)]
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		if _, err := conn.Write(append(size[:], chunk...)); err != nil {
+			return "", err
+		}
+		data = data[len(chunk):]
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := io.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil {
+		return "", err
+	}
+	// The reply is "stream: OK", "stream: <signature> FOUND" or
+	// "<reason> ERROR", such as when the stream exceeds StreamMaxLength
+	result := strings.TrimSpace(string(bytes.TrimRight(reply, "\x00")))
+	result = strings.TrimPrefix(result, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("%w: %q", errScannerResponded, result)
+}
+
+// ScanUpload has clamd at AppConfig.ClamAVAddress scan an uploaded file
+// before it is stored, and refuses files it flags. Without an address
+// nothing is scanned. When the scanner cannot be reached or fails, uploads
+// are refused or let through as AppConfig.ClamAVFailMode says.
+func ScanUpload(userID, filename string, data []byte) error {
+	if AppConfig.ClamAVAddress == "" {
+		return nil
+	}
+	signature, err := scanWithClamd(AppConfig.ClamAVAddress, data)
+	if err != nil {
+		if AppConfig.ClamAVFailMode == ScanFailOpen {
+			log.Printf("Storing %q of user %s unscanned, malware scanner failed: %v", filename, userID, err)
+			return nil
+		}
+		log.Printf("Refused %q of user %s, malware scanner failed: %v", filename, userID, err)
+		return errScanUnavailable
+	}
+	if signature != "" {
+		log.Printf("Refused %q of user %s, malware scanner found %s", filename, userID, signature)
+		return errUploadInfected
+	}
+	return nil
+}
@@ -2,6 +2,9 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -44,25 +47,30 @@ func CommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Start a transaction
-	tx, err := db.Begin()
-	if err != nil {
+	if deleted, err := postDeleted(postIDInt); err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
+	} else if deleted {
+		http.Error(w, "This post was deleted", http.StatusGone)
+		return
 	}
-	defer tx.Rollback()
 
+	var parentIDInt int
 	if parentID != "" {
 		// Convert parentID to int
-		parentIDInt, err := strconv.Atoi(parentID)
+		parentIDInt, err = strconv.Atoi(parentID)
 		if err != nil {
 			http.Error(w, "Invalid parent comment ID format", http.StatusBadRequest)
 			return
 		}
 
-		// Verify that the parent comment exists
+		// Verify that the parent comment exists and was not deleted before
+		// storing an image or using up an upload token
 		var parentPostID int
-		err = db.QueryRow("SELECT post_id FROM comments WHERE id = ?", parentIDInt).Scan(&parentPostID)
+		err = db.QueryRow("SELECT post_id FROM comments WHERE id = ? AND deleted_at IS NULL", parentIDInt).Scan(&parentPostID)
 		if err == sql.ErrNoRows {
 			http.Error(w, "Parent comment not found", http.StatusNotFound)
 			return
@@ -70,11 +78,65 @@ func CommentHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
+	}
+
+	// Handle the optional image attachment, either uploaded with the form
+	// or sent ahead to /upload and referred to by its token
+	var imageID sql.NullInt64
+	var img Image
+	if token := r.FormValue("image_token"); token != "" {
+		img, err = lookupUploadToken(token, userID)
+	} else if file, header, ferr := r.FormFile("image"); ferr == nil {
+		opts := UploadOptions{KeepOriginal: keepsOriginalImage(postCategories(postIDInt))}
+		img, err = ProcessImageUpload(userID, header.Filename, file, opts)
+		file.Close()
+	}
+	if err != nil {
+		if data, ok := errorMessage(err.Error(), userID); ok {
+			http.Error(w, data.ErrorMessage, data.StatusCode)
+		} else {
+			http.Error(w, "Failed to save image", http.StatusInternalServerError)
+		}
+		return
+	}
+	if img.ID != 0 {
+		imageID = sql.NullInt64{Int64: img.ID, Valid: true}
+	}
+
+	// Start a transaction
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Use up the upload token along with saving the comment
+	if token := r.FormValue("image_token"); token != "" {
+		if err := claimUploadToken(tx, token, userID); err != nil {
+			if errors.Is(err, errUploadToken) {
+				data := ErrorMessages[err.Error()]
+				http.Error(w, data.ErrorMessage, data.StatusCode)
+			} else {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	if img.ID != 0 {
+		if _, err := quarantineImage(tx, img.ID, userID, postCategories(postIDInt)); err != nil {
+			log.Printf("Error quarantining image %d: %v", img.ID, err)
+			http.Error(w, "Failed to save image", http.StatusInternalServerError)
+			return
+		}
+	}
 
-		// Proceed with inserting the reply since the parent comment exists
-		_, err = tx.Exec(
-			"INSERT INTO comments (post_id, user_id, content, parent_id, created_at) VALUES (?, ?, ?, ?, ?)",
-			postIDInt, userID, content, parentIDInt, time.Now(),
+	var result sql.Result
+	if parentID != "" {
+		// Insert the reply, its parent comment was checked above
+		result, err = tx.Exec(
+			"INSERT INTO comments (post_id, user_id, content, parent_id, image_id, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			postIDInt, userID, content, parentIDInt, imageID, time.Now(),
 		)
 		if err != nil {
 			tx.Rollback()
@@ -83,9 +145,9 @@ func CommentHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		// This is a top-level comment
-		_, err = tx.Exec(
-			"INSERT INTO comments (post_id, user_id, content, created_at) VALUES (?, ?, ?, ?)",
-			postIDInt, userID, content, time.Now(),
+		result, err = tx.Exec(
+			"INSERT INTO comments (post_id, user_id, content, image_id, created_at) VALUES (?, ?, ?, ?, ?)",
+			postIDInt, userID, content, imageID, time.Now(),
 		)
 		if err != nil {
 			tx.Rollback()
@@ -94,14 +156,16 @@ func CommentHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	commentID, _ := result.LastInsertId()
+
 	// Commit the transaction
 	if err = tx.Commit(); err != nil {
 		http.Error(w, "Error committing transaction", http.StatusInternalServerError)
 		return
 	}
 
-	// Redirect back to the post
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	// Redirect back to the post, scrolled to the new comment
+	http.Redirect(w, r, fmt.Sprintf("%s#comment-%d", postURL(postIDInt), commentID), http.StatusSeeOther)
 }
 
 // Fetch comments for a specific post
@@ -116,7 +180,9 @@ var GetCommentsForPost = func(postID int) ([]Comment, error) {
 			c.created_at,
 			u.username,
 			c.parent_id,
-			(SELECT COUNT(*) FROM comments r WHERE r.parent_id = c.id) as reply_count,
+			c.image_id,
+			c.deleted_at IS NOT NULL,
+			(SELECT COUNT(*) FROM comments r WHERE r.parent_id = c.id AND r.deleted_at IS NULL) as reply_count,
 			(SELECT COUNT(*) FROM comment_likes cl WHERE cl.comment_id = c.id AND cl.is_like = 1) as like_count,
 			(SELECT COUNT(*) FROM comment_likes cl WHERE cl.comment_id = c.id AND cl.is_like = 0) as dislike_count
 		FROM comments c
@@ -133,6 +199,7 @@ var GetCommentsForPost = func(postID int) ([]Comment, error) {
 	for rows.Next() {
 		var comment Comment
 		var createdAt time.Time
+		var imageID sql.NullInt64
 		err := rows.Scan(
 			&comment.ID,
 			&comment.PostID,
@@ -141,6 +208,8 @@ var GetCommentsForPost = func(postID int) ([]Comment, error) {
 			&createdAt,
 			&comment.Username,
 			&comment.ParentID,
+			&imageID,
+			&comment.Deleted,
 			&comment.ReplyCount,
 			&comment.LikeCount,
 			&comment.DislikeCount,
@@ -153,6 +222,11 @@ var GetCommentsForPost = func(postID int) ([]Comment, error) {
 		comment.CreatedAt = createdAt
 		comment.CreatedAtHuman = TimeAgo(createdAt)
 
+		// Attach the comment's image, if any
+		if err := loadCommentImage(&comment, imageID); err != nil {
+			return nil, err
+		}
+
 		// Get replies for this comment
 		replies, err := GetCommentReplies(comment.ID)
 		if err != nil {
@@ -160,6 +234,14 @@ var GetCommentsForPost = func(postID int) ([]Comment, error) {
 		}
 		comment.Replies = replies
 
+		// Deleted comments only stay, emptied, to hold their replies
+		if comment.Deleted {
+			if len(replies) == 0 {
+				continue
+			}
+			tombstone(&comment)
+		}
+
 		comments = append(comments, comment)
 	}
 
@@ -177,12 +259,13 @@ var GetCommentReplies = func(commentID int) ([]Comment, error) {
 			c.created_at,
 			u.username,
 			c.parent_id,
+			c.image_id,
 			0 as reply_count,
 			(SELECT COUNT(*) FROM comment_likes cl WHERE cl.comment_id = c.id AND cl.is_like = 1) as like_count,
 			(SELECT COUNT(*) FROM comment_likes cl WHERE cl.comment_id = c.id AND cl.is_like = 0) as dislike_count
 		FROM comments c
 		JOIN users u ON c.user_id = u.id
-		WHERE c.parent_id = ?
+		WHERE c.parent_id = ? AND c.deleted_at IS NULL
 		ORDER BY c.created_at ASC
 	`, commentID)
 	if err != nil {
@@ -194,6 +277,7 @@ var GetCommentReplies = func(commentID int) ([]Comment, error) {
 	for rows.Next() {
 		var reply Comment
 		var createdAt time.Time
+		var imageID sql.NullInt64
 		err := rows.Scan(
 			&reply.ID,
 			&reply.PostID,
@@ -202,6 +286,7 @@ var GetCommentReplies = func(commentID int) ([]Comment, error) {
 			&createdAt,
 			&reply.Username,
 			&reply.ParentID,
+			&imageID,
 			&reply.ReplyCount,
 			&reply.LikeCount,
 			&reply.DislikeCount,
@@ -214,12 +299,48 @@ var GetCommentReplies = func(commentID int) ([]Comment, error) {
 		reply.CreatedAt = createdAt
 		reply.CreatedAtHuman = TimeAgo(createdAt)
 
+		// Attach the reply's image, if any
+		if err := loadCommentImage(&reply, imageID); err != nil {
+			return nil, err
+		}
+
 		replies = append(replies, reply)
 	}
 
 	return replies, nil
 }
 
+// loadCommentImage attaches the image with the given ID to a comment
+func loadCommentImage(comment *Comment, imageID sql.NullInt64) error {
+	if !imageID.Valid {
+		return nil
+	}
+	img, err := GetImage(imageID.Int64)
+	if err != nil {
+		return err
+	}
+	comment.Image = &img
+	return nil
+}
+
+// postCategories returns the categories a post is filed under
+func postCategories(postID int) []string {
+	rows, err := db.Query("SELECT category FROM post_categories WHERE post_id = ?", postID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var categories []string
+	for rows.Next() {
+		var category string
+		if rows.Scan(&category) == nil {
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
 // Get user ID from session
 var GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string {
 	sessionCookie, err := r.Cookie("session_id")
@@ -248,9 +369,49 @@ var GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string {
 	return userID
 }
 
-// Fetch a single post by ID
+// Fetch a single post by ID along with its author, categories, reactions,
+// images and comments. Returns sql.ErrNoRows if there is no such post;
+// deleted posts are returned with DeletedAt set.
 func GetPostByID(id string) (Post, error) {
 	var post Post
-	err := db.QueryRow("SELECT id, title, content FROM posts WHERE id = ?", id).Scan(&post.ID, &post.Title, &post.Content)
-	return post, err
+	var createdAt time.Time
+	var editedAt, deletedAt sql.NullTime
+	var categories sql.NullString
+	err := db.QueryRow(`
+		SELECT p.id, p.title, p.content, COALESCE(p.image_path, ''),
+		(SELECT GROUP_CONCAT(pc.category) FROM post_categories pc WHERE pc.post_id = p.id),
+		p.user_id, u.username, p.created_at, p.edited_at, p.deleted_at,
+		(SELECT COUNT(*) FROM likes l WHERE l.post_id = p.id AND l.is_like = 1),
+		(SELECT COUNT(*) FROM likes l WHERE l.post_id = p.id AND l.is_like = 0)
+		FROM posts p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.id = ?`, id).Scan(
+		&post.ID,
+		&post.Title,
+		&post.Content,
+		&post.ImagePath,
+		&categories,
+		&post.UserID,
+		&post.Username,
+		&createdAt,
+		&editedAt,
+		&deletedAt,
+		&post.LikeCount,
+		&post.DislikeCount,
+	)
+	if err != nil {
+		return Post{}, err
+	}
+	post.Categories = categories.String
+	post.CreatedAt = createdAt
+	post.CreatedAtHuman = TimeAgo(createdAt)
+	setEditedAt(&post, editedAt)
+	post.DeletedAt = deletedAt.Time
+	loadPostImages(&post)
+
+	post.Comments, err = GetCommentsForPost(post.ID)
+	if err != nil {
+		return Post{}, err
+	}
+	return post, nil
 }
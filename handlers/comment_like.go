@@ -3,6 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -24,6 +25,10 @@ func CommentLikeHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get user ID from session
 	userID := GetUserIdFromSession(w, r)
+	if userID == "" && wantsHTML(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 	if userID == "" {
 		http.Error(w, "Please log in to like or dislike comments", http.StatusUnauthorized)
 		return
@@ -44,18 +49,18 @@ func CommentLikeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify comment exists
-	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM comments WHERE id = ?)", commentIDInt).Scan(&exists)
-	if err != nil {
+	// Verify comment exists and find the post it belongs to. Deleted
+	// comments cannot be reacted to.
+	var postID int
+	err = db.QueryRow("SELECT post_id FROM comments WHERE id = ? AND deleted_at IS NULL", commentIDInt).Scan(&postID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		log.Printf("Error checking comment existence: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	if !exists {
-		http.Error(w, "Comment not found", http.StatusNotFound)
-		return
-	}
 
 	isLikeBool := isLike == "true"
 
@@ -136,6 +141,12 @@ func CommentLikeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Forms submitted without JavaScript go back to the comment
+	if wantsHTML(r) {
+		http.Redirect(w, r, fmt.Sprintf("%s#comment-%d", postURL(postID), commentIDInt), http.StatusSeeOther)
+		return
+	}
+
 	// Return response as JSON
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds settings that can be changed without rebuilding the forum.
+// Every field has a default and can be overridden through the environment.
+type Config struct {
+	MaxImageWidth  int // FORUM_MAX_IMAGE_WIDTH: widest image accepted, in pixels
+	MaxImageHeight int // FORUM_MAX_IMAGE_HEIGHT: tallest image accepted, in pixels
+	MaxImagePixels int // FORUM_MAX_IMAGE_PIXELS: largest width*height accepted
+
+	MaxImagesPerPost int // FORUM_MAX_IMAGES_PER_POST: size of a post's gallery
+
+	// FORUM_IMAGE_FORMATS: comma-separated MIME types accepted for upload,
+	// out of those in imageFormats. Empty accepts them all.
+	ImageFormats []string
+
+	// FORUM_HEIC_CONVERT_COMMAND: command converting HEIC on standard input
+	// to PNG on standard output, e.g. "magick heic:- png:-"
+	HEICConvertCommand string
+
+	// FORUM_KEEP_METADATA_CATEGORIES: comma-separated categories whose
+	// images are stored exactly as uploaded, EXIF data included
+	KeepMetadataCategories []string
+
+	// FORUM_QUARANTINE_CATEGORIES: comma-separated categories whose images
+	// are hidden until a moderator approves them, or "*" for all categories
+	QuarantineCategories []string
+
+	// FORUM_CLAMAV_ADDRESS: clamd to scan uploads with, as host:port or the
+	// path of its unix socket. Empty disables scanning.
+	ClamAVAddress  string
+	ClamAVFailMode string        // FORUM_CLAMAV_FAIL_MODE: "closed" refuses uploads while clamd cannot scan them, "open" stores them unscanned
+	ClamAVTimeout  time.Duration // FORUM_CLAMAV_TIMEOUT: longest a scan may take
+
+	StorageBackend string // FORUM_STORAGE: "local" or "s3"
+	UploadsDir     string // FORUM_UPLOADS_DIR: directory used by the local backend
+	S3Endpoint     string // FORUM_S3_ENDPOINT: e.g. http://localhost:9000
+	S3Bucket       string // FORUM_S3_BUCKET
+	S3Region       string // FORUM_S3_REGION
+	S3AccessKey    string // FORUM_S3_ACCESS_KEY
+	S3SecretKey    string // FORUM_S3_SECRET_KEY
+
+	MaxGIFFrames   int           // FORUM_MAX_GIF_FRAMES: most frames an animated GIF may have
+	MaxGIFPixels   int           // FORUM_MAX_GIF_PIXELS: most pixels decoded for one loop, over all frames
+	MaxGIFDuration time.Duration // FORUM_MAX_GIF_DURATION: longest loop of an animated GIF
+
+	MaxVideoSize     int           // FORUM_MAX_VIDEO_SIZE: largest clip accepted, in bytes; uploads never exceed 20 MB
+	MaxVideoDuration time.Duration // FORUM_MAX_VIDEO_DURATION: longest clip accepted
+
+	// FORUM_VIDEO_POSTER_COMMAND: command writing the first frame of the
+	// clip whose path replaces "{}" as PNG or JPEG to standard output, e.g.
+	// "ffmpeg -v error -i {} -frames:v 1 -f image2pipe -c:v png -"
+	VideoPosterCommand string
+
+	// Upload limits per role; see UploadQuota. Each can be overridden with
+	// FORUM_QUOTA_<ROLE>_TOTAL_BYTES, _PER_DAY and _MAX_FILE_SIZE.
+	UploadQuotas map[string]UploadQuota
+
+	UploadTokenTTL time.Duration // FORUM_UPLOAD_TOKEN_TTL: how long an image uploaded ahead of its form can be attached
+
+	PartialUploadsDir  string        // FORUM_PARTIAL_UPLOADS_DIR: where chunks of resumable uploads are kept until complete
+	ResumableUploadTTL time.Duration // FORUM_RESUMABLE_UPLOAD_TTL: how long an unfinished resumable upload is kept after its last chunk
+
+	// Most bits in which the perceptual hashes of two images may differ for
+	// them to count as the same picture
+	BannedHashDistance    int // FORUM_BANNED_HASH_DISTANCE: for uploads matching a banned image
+	DuplicateHashDistance int // FORUM_DUPLICATE_HASH_DISTANCE: for linking reposts to the earlier post
+	DuplicateScanLimit    int // FORUM_DUPLICATE_SCAN_LIMIT: most recent images compared when looking for near copies
+
+	GCInterval    time.Duration // FORUM_GC_INTERVAL: how often orphaned uploads are swept, 0 to disable
+	GCGracePeriod time.Duration // FORUM_GC_GRACE_PERIOD: minimum age of an upload before it can be removed
+}
+
+// DefaultConfig returns the settings used when nothing is overridden
+func DefaultConfig() Config {
+	return Config{
+		MaxImageWidth:         8000,
+		MaxImageHeight:        8000,
+		MaxImagePixels:        40_000_000,
+		MaxImagesPerPost:      4,
+		ClamAVFailMode:        ScanFailClosed,
+		ClamAVTimeout:         30 * time.Second,
+		StorageBackend:        "local",
+		UploadsDir:            "uploads",
+		S3Region:              "us-east-1",
+		MaxGIFFrames:          500,
+		MaxGIFPixels:          200_000_000,
+		MaxGIFDuration:        time.Minute,
+		MaxVideoSize:          20 << 20,
+		MaxVideoDuration:      time.Minute,
+		UploadTokenTTL:        time.Hour,
+		PartialUploadsDir:     "partial_uploads",
+		ResumableUploadTTL:    24 * time.Hour,
+		BannedHashDistance:    10,
+		DuplicateHashDistance: 5,
+		DuplicateScanLimit:    10000,
+		GCInterval:            6 * time.Hour,
+		GCGracePeriod:         24 * time.Hour,
+		UploadQuotas: map[string]UploadQuota{
+			RoleUser:      {TotalBytes: 500 << 20, PerDay: 50, MaxFileSize: 10 << 20},
+			RoleModerator: {TotalBytes: 2 << 30, PerDay: 200, MaxFileSize: 20 << 20},
+			RoleAdmin:     {},
+		},
+	}
+}
+
+// AppConfig is the configuration in use by the handlers
+var AppConfig = DefaultConfig()
+
+// LoadConfig reads overrides for the default configuration from the environment
+func LoadConfig() {
+	AppConfig = DefaultConfig()
+	envInt("FORUM_MAX_IMAGE_WIDTH", &AppConfig.MaxImageWidth)
+	envInt("FORUM_MAX_IMAGE_HEIGHT", &AppConfig.MaxImageHeight)
+	envInt("FORUM_MAX_IMAGE_PIXELS", &AppConfig.MaxImagePixels)
+	envInt("FORUM_MAX_IMAGES_PER_POST", &AppConfig.MaxImagesPerPost)
+	envList("FORUM_IMAGE_FORMATS", &AppConfig.ImageFormats)
+	envString("FORUM_HEIC_CONVERT_COMMAND", &AppConfig.HEICConvertCommand)
+	envList("FORUM_KEEP_METADATA_CATEGORIES", &AppConfig.KeepMetadataCategories)
+	envList("FORUM_QUARANTINE_CATEGORIES", &AppConfig.QuarantineCategories)
+	envString("FORUM_CLAMAV_ADDRESS", &AppConfig.ClamAVAddress)
+	envString("FORUM_CLAMAV_FAIL_MODE", &AppConfig.ClamAVFailMode)
+	envDuration("FORUM_CLAMAV_TIMEOUT", &AppConfig.ClamAVTimeout)
+	envString("FORUM_STORAGE", &AppConfig.StorageBackend)
+	envString("FORUM_UPLOADS_DIR", &AppConfig.UploadsDir)
+	envString("FORUM_S3_ENDPOINT", &AppConfig.S3Endpoint)
+	envString("FORUM_S3_BUCKET", &AppConfig.S3Bucket)
+	envString("FORUM_S3_REGION", &AppConfig.S3Region)
+	envString("FORUM_S3_ACCESS_KEY", &AppConfig.S3AccessKey)
+	envString("FORUM_S3_SECRET_KEY", &AppConfig.S3SecretKey)
+	envInt("FORUM_MAX_GIF_FRAMES", &AppConfig.MaxGIFFrames)
+	envInt("FORUM_MAX_GIF_PIXELS", &AppConfig.MaxGIFPixels)
+	envDuration("FORUM_MAX_GIF_DURATION", &AppConfig.MaxGIFDuration)
+	envInt("FORUM_MAX_VIDEO_SIZE", &AppConfig.MaxVideoSize)
+	envDuration("FORUM_MAX_VIDEO_DURATION", &AppConfig.MaxVideoDuration)
+	envString("FORUM_VIDEO_POSTER_COMMAND", &AppConfig.VideoPosterCommand)
+	for role, quota := range AppConfig.UploadQuotas {
+		prefix := "FORUM_QUOTA_" + strings.ToUpper(role)
+		envInt(prefix+"_TOTAL_BYTES", &quota.TotalBytes)
+		envInt(prefix+"_PER_DAY", &quota.PerDay)
+		envInt(prefix+"_MAX_FILE_SIZE", &quota.MaxFileSize)
+		AppConfig.UploadQuotas[role] = quota
+	}
+	envDuration("FORUM_UPLOAD_TOKEN_TTL", &AppConfig.UploadTokenTTL)
+	envString("FORUM_PARTIAL_UPLOADS_DIR", &AppConfig.PartialUploadsDir)
+	envDuration("FORUM_RESUMABLE_UPLOAD_TTL", &AppConfig.ResumableUploadTTL)
+	envInt("FORUM_BANNED_HASH_DISTANCE", &AppConfig.BannedHashDistance)
+	envInt("FORUM_DUPLICATE_HASH_DISTANCE", &AppConfig.DuplicateHashDistance)
+	envInt("FORUM_DUPLICATE_SCAN_LIMIT", &AppConfig.DuplicateScanLimit)
+	envDuration("FORUM_GC_INTERVAL", &AppConfig.GCInterval)
+	envDuration("FORUM_GC_GRACE_PERIOD", &AppConfig.GCGracePeriod)
+}
+
+// envString overwrites target with the value of an environment variable, if set
+func envString(name string, target *string) {
+	if value := os.Getenv(name); value != "" {
+		*target = value
+	}
+}
+
+// envInt overwrites target with the integer value of an environment variable, if set
+func envInt(name string, target *int) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Ignoring invalid value %q for %s: %v", value, name, err)
+		return
+	}
+	*target = n
+}
+
+// envDuration overwrites target with a duration such as "90m" or "24h", if set
+func envDuration(name string, target *time.Duration) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Ignoring invalid value %q for %s: %v", value, name, err)
+		return
+	}
+	*target = d
+}
+
+// envList overwrites target with the comma-separated values of an environment variable, if set
+func envList(name string, target *[]string) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*target = items
+}
@@ -15,7 +15,14 @@ func InitDB() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := migrateDB(); err != nil {
+		log.Fatal(err)
+	}
+}
 
+// migrateDB creates the tables and adds any columns and rows missing from
+// an older database
+func migrateDB() error {
 	// Create tables
 	createTable := `
     CREATE TABLE IF NOT EXISTS users (
@@ -78,9 +85,182 @@ func InitDB() {
         FOREIGN KEY (comment_id) REFERENCES comments(id) ON DELETE CASCADE,
         UNIQUE(user_id, comment_id)
     );
+
+    CREATE TABLE IF NOT EXISTS images (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT,
+        hash TEXT NOT NULL, -- SHA-256 of the file content
+        path TEXT NOT NULL, -- Content-addressed path relative to the uploads directory
+        original_name TEXT,
+        mime_type TEXT,
+        size INTEGER,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_images_hash ON images(hash);
+    CREATE INDEX IF NOT EXISTS idx_images_user ON images(user_id, created_at);
+
+    CREATE TABLE IF NOT EXISTS image_variants (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        image_id INTEGER NOT NULL,
+        width INTEGER,
+        height INTEGER,
+        path TEXT NOT NULL, -- Path relative to the uploads directory
+        FOREIGN KEY(image_id) REFERENCES images(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS post_images (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        post_id INTEGER NOT NULL,
+        image_id INTEGER NOT NULL,
+        position INTEGER NOT NULL DEFAULT 0, -- Order within the gallery
+        caption TEXT,
+        FOREIGN KEY(post_id) REFERENCES posts(id),
+        FOREIGN KEY(image_id) REFERENCES images(id),
+        UNIQUE(post_id, position)
+    );
+
+    CREATE TABLE IF NOT EXISTS post_revisions (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        post_id INTEGER NOT NULL,
+        title TEXT NOT NULL,
+        content TEXT NOT NULL,
+        categories TEXT NOT NULL, -- Comma separated, as shown on the post
+        edited_by TEXT NOT NULL, -- User whose edit replaced this version
+        created_at DATETIME NOT NULL, -- Time this version was replaced
+        FOREIGN KEY(post_id) REFERENCES posts(id),
+        FOREIGN KEY(edited_by) REFERENCES users(id)
+    );
+
+    CREATE TABLE IF NOT EXISTS post_revision_images (
+        revision_id INTEGER NOT NULL,
+        image_id INTEGER NOT NULL,
+        position INTEGER NOT NULL,
+        caption TEXT,
+        alt_text TEXT,
+        FOREIGN KEY(revision_id) REFERENCES post_revisions(id),
+        FOREIGN KEY(image_id) REFERENCES images(id),
+        PRIMARY KEY(revision_id, position)
+    );
+
+    CREATE TABLE IF NOT EXISTS upload_tokens (
+        token TEXT PRIMARY KEY, -- Handed to the browser by /upload
+        image_id INTEGER NOT NULL,
+        user_id TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        expires_at DATETIME NOT NULL,
+        FOREIGN KEY(image_id) REFERENCES images(id),
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );
+
+    CREATE TABLE IF NOT EXISTS resumable_uploads (
+        id TEXT PRIMARY KEY, -- Names the partial file in PartialUploadsDir
+        user_id TEXT NOT NULL,
+        filename TEXT NOT NULL,
+        size INTEGER NOT NULL, -- Total length announced when the upload started
+        created_at DATETIME NOT NULL,
+        updated_at DATETIME NOT NULL, -- Time of the last chunk
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );
+
+    CREATE TABLE IF NOT EXISTS banned_image_hashes (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        phash TEXT NOT NULL, -- Perceptual hash as 16 hex digits
+        reason TEXT,
+        banned_by TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        FOREIGN KEY(banned_by) REFERENCES users(id)
+    );
+
+    CREATE TABLE IF NOT EXISTS notifications (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT NOT NULL,
+        message TEXT NOT NULL,
+        link TEXT, -- Page the notification is about
+        created_at DATETIME NOT NULL,
+        read_at DATETIME,
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );
     `
-	_, err = db.Exec(createTable)
+	if _, err := db.Exec(createTable); err != nil {
+		return err
+	}
+
+	// Add columns introduced after the original schema
+	for _, m := range columnMigrations {
+		if err := ensureColumn(m.table, m.column, m.definition); err != nil {
+			return err
+		}
+	}
+
+	// Index columns that older databases only have after the migrations
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_images_phash ON images(phash)"); err != nil {
+		return err
+	}
+
+	// Move single post images into the gallery table
+	return migratePostImages()
+}
+
+// columnMigrations lists columns added to existing tables. CREATE TABLE IF
+// NOT EXISTS leaves older databases untouched, so they are added here.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"posts", "image_id", "INTEGER REFERENCES images(id)"},
+	{"images", "width", "INTEGER"},
+	{"images", "height", "INTEGER"},
+	{"comments", "image_id", "INTEGER REFERENCES images(id)"},
+	{"users", "role", "TEXT NOT NULL DEFAULT 'user'"},
+	{"images", "frames", "INTEGER NOT NULL DEFAULT 1"},
+	{"images", "poster_path", "TEXT"},
+	{"post_images", "alt_text", "TEXT"},
+	{"images", "phash", "TEXT"},
+	{"post_images", "duplicate_of", "INTEGER REFERENCES posts(id)"},
+	{"images", "moderation", "TEXT NOT NULL DEFAULT 'approved'"},
+	{"images", "reviewed_by", "TEXT REFERENCES users(id)"},
+	{"images", "reviewed_at", "DATETIME"},
+	{"users", "avatar_image_id", "INTEGER REFERENCES images(id)"},
+	{"images", "blurhash", "TEXT"},
+	{"posts", "edited_at", "DATETIME"},
+	{"posts", "deleted_at", "DATETIME"},
+	{"posts", "deleted_by", "TEXT REFERENCES users(id)"},
+	{"comments", "deleted_at", "DATETIME"},
+	{"comments", "deleted_by", "TEXT REFERENCES users(id)"},
+}
+
+// ensureColumn adds a column to a table unless it already exists
+func ensureColumn(table, column, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
 }
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeletedPost is a soft-deleted post listed for moderators
+type DeletedPost struct {
+	ID        int
+	Title     string
+	Username  string // Author
+	DeletedBy string // Username of whoever deleted it
+	DeletedAt time.Time
+}
+
+// DeletedComment is a soft-deleted comment listed for moderators
+type DeletedComment struct {
+	ID        int
+	PostID    int
+	Content   string
+	Username  string // Author
+	DeletedBy string // Username of whoever deleted it
+	DeletedAt time.Time
+}
+
+// Deleted reports whether the post was deleted
+func (p Post) Deleted() bool {
+	return !p.DeletedAt.IsZero()
+}
+
+// tombstone empties a deleted comment that stays in the thread because
+// it has replies
+func tombstone(comment *Comment) {
+	comment.Content = "[deleted]"
+	comment.Username = "[deleted]"
+	comment.UserID = ""
+	comment.Image = nil
+	comment.LikeCount = 0
+	comment.DislikeCount = 0
+}
+
+// postDeleted reports whether a post was deleted, or returns sql.ErrNoRows
+// if there is no such post
+func postDeleted(postID int) (bool, error) {
+	var deleted bool
+	err := db.QueryRow("SELECT deleted_at IS NOT NULL FROM posts WHERE id = ?", postID).Scan(&deleted)
+	return deleted, err
+}
+
+// DeletePostHandler soft-deletes a post under /posts/{id}/delete. Authors
+// can delete their own posts and moderators any post. The post leaves the
+// feeds and its page answers 410 Gone until a moderator restores it.
+func DeletePostHandler(w http.ResponseWriter, r *http.Request, post Post) {
+	userID := GetUserIdFromSession(w, r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if userID != post.UserID && !isModerator(userID) {
+		RenderError(w, r, "not_owner", http.StatusForbidden)
+		return
+	}
+
+	_, err := db.Exec("UPDATE posts SET deleted_at = ?, deleted_by = ? WHERE id = ? AND deleted_at IS NULL", time.Now(), userID, post.ID)
+	if err != nil {
+		log.Printf("Error deleting post %d: %v", post.ID, err)
+		RenderError(w, r, "database_error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Post %d deleted by user %s", post.ID, userID)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// CommentDeleteHandler soft-deletes the comment named by the comment_id
+// form field. Authors can delete their own comments and moderators any
+// comment. A deleted comment with replies is shown as a tombstone. Rows are
+// only marked, never removed: comments.parent_id cascades on delete, so
+// removing a comment would take its whole reply tree with it.
+func CommentDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := GetUserIdFromSession(w, r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	commentID, err := strconv.Atoi(r.FormValue("comment_id"))
+	if err != nil {
+		RenderError(w, r, "invalid_input", http.StatusBadRequest)
+		return
+	}
+
+	var authorID string
+	var postID int
+	err = db.QueryRow("SELECT user_id, post_id FROM comments WHERE id = ? AND deleted_at IS NULL", commentID).Scan(&authorID, &postID)
+	if err == sql.ErrNoRows {
+		RenderError(w, r, "comment_not_found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching comment %d: %v", commentID, err)
+		RenderError(w, r, "database_error", http.StatusInternalServerError)
+		return
+	}
+	if userID != authorID && !isModerator(userID) {
+		RenderError(w, r, "not_owner", http.StatusForbidden)
+		return
+	}
+
+	_, err = db.Exec("UPDATE comments SET deleted_at = ?, deleted_by = ? WHERE id = ?", time.Now(), userID, commentID)
+	if err != nil {
+		log.Printf("Error deleting comment %d: %v", commentID, err)
+		RenderError(w, r, "database_error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Comment %d deleted by user %s", commentID, userID)
+	http.Redirect(w, r, fmt.Sprintf("%s#comments-%d", postURL(postID), postID), http.StatusSeeOther)
+}
+
+// GetDeletedPosts returns the deleted posts, most recently deleted first
+func GetDeletedPosts() ([]DeletedPost, error) {
+	rows, err := db.Query(`
+		SELECT p.id, p.title, u.username, COALESCE(d.username, ''), p.deleted_at
+		FROM posts p
+		JOIN users u ON u.id = p.user_id
+		LEFT JOIN users d ON d.id = p.deleted_by
+		WHERE p.deleted_at IS NOT NULL
+		ORDER BY p.deleted_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []DeletedPost
+	for rows.Next() {
+		var p DeletedPost
+		if err := rows.Scan(&p.ID, &p.Title, &p.Username, &p.DeletedBy, &p.DeletedAt); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// GetDeletedComments returns the deleted comments, most recently deleted
+// first
+func GetDeletedComments() ([]DeletedComment, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.post_id, c.content, u.username, COALESCE(d.username, ''), c.deleted_at
+		FROM comments c
+		JOIN users u ON u.id = c.user_id
+		LEFT JOIN users d ON d.id = c.deleted_by
+		WHERE c.deleted_at IS NOT NULL
+		ORDER BY c.deleted_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []DeletedComment
+	for rows.Next() {
+		var c DeletedComment
+		if err := rows.Scan(&c.ID, &c.PostID, &c.Content, &c.Username, &c.DeletedBy, &c.DeletedAt); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// DeletedContentHandler lists deleted posts and comments to moderators
+// and lets them restore them
+func DeletedContentHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requireModerator(w, r)
+	if userID == "" {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			RenderError(w, r, "invalid_input", http.StatusBadRequest)
+			return
+		}
+		var query string
+		switch r.FormValue("action") {
+		case "restore_post":
+			query = "UPDATE posts SET deleted_at = NULL, deleted_by = NULL WHERE id = ?"
+		case "restore_comment":
+			query = "UPDATE comments SET deleted_at = NULL, deleted_by = NULL WHERE id = ?"
+		default:
+			RenderError(w, r, "invalid_input", http.StatusBadRequest)
+			return
+		}
+		if _, err := db.Exec(query, id); err != nil {
+			log.Printf("Error restoring %d: %v", id, err)
+			RenderError(w, r, "server_error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Moderator %s used %s on %d", userID, r.FormValue("action"), id)
+		// Restoring from the post page returns there
+		if r.FormValue("action") == "restore_post" && r.FormValue("next") == "post" {
+			http.Redirect(w, r, postURL(id), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/moderation/deleted", http.StatusSeeOther)
+		return
+	default:
+		RenderError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	posts, err := GetDeletedPosts()
+	if err != nil {
+		log.Printf("Error fetching deleted posts: %v", err)
+		RenderError(w, r, "server_error", http.StatusInternalServerError)
+		return
+	}
+	comments, err := GetDeletedComments()
+	if err != nil {
+		log.Printf("Error fetching deleted comments: %v", err)
+		RenderError(w, r, "server_error", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/moderation_deleted.html")
+	if err != nil {
+		log.Printf("Error parsing deleted content template: %v", err)
+		RenderError(w, r, "Error loading page", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{
+		"Posts":    posts,
+		"Comments": comments,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error executing deleted content template: %v", err)
+	}
+}
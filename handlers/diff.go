@@ -0,0 +1,91 @@
+package handlers
+
+import "unicode"
+
+// maxDiffCells bounds the work of a word diff. Texts with more word pairs
+// than this are shown as entirely replaced.
+const maxDiffCells = 4_000_000
+
+// diffPart is a run of text in a diff between two versions
+type diffPart struct {
+	Text    string
+	Added   bool // Only in the newer version
+	Removed bool // Only in the older version
+}
+
+// splitWords cuts text into words and the whitespace between them, so that
+// joining the pieces gives back the text
+func splitWords(text string) []string {
+	var words []string
+	start, inSpace := 0, false
+	for i, r := range text {
+		space := unicode.IsSpace(r)
+		if i > start && space != inSpace {
+			words = append(words, text[start:i])
+			start = i
+		}
+		inSpace = space
+	}
+	if start < len(text) {
+		words = append(words, text[start:])
+	}
+	return words
+}
+
+// diffWords compares two versions of a text word by word, keeping the
+// longest common sequence of words and marking the rest as removed from
+// the older or added in the newer version
+func diffWords(older, newer string) []diffPart {
+	a, b := splitWords(older), splitWords(newer)
+	if len(a)*len(b) > maxDiffCells {
+		var parts []diffPart
+		if older != "" {
+			parts = append(parts, diffPart{Text: older, Removed: true})
+		}
+		if newer != "" {
+			parts = append(parts, diffPart{Text: newer, Added: true})
+		}
+		return parts
+	}
+
+	// common[i][j] is the length of the longest common sequence of a[i:]
+	// and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	var parts []diffPart
+	add := func(text string, added, removed bool) {
+		if n := len(parts); n > 0 && parts[n-1].Added == added && parts[n-1].Removed == removed {
+			parts[n-1].Text += text
+			return
+		}
+		parts = append(parts, diffPart{Text: text, Added: added, Removed: removed})
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			add(a[i], false, false)
+			i++
+			j++
+		case j == len(b) || (i < len(a) && common[i+1][j] >= common[i][j+1]):
+			add(a[i], false, true)
+			i++
+		default:
+			add(b[j], true, false)
+			j++
+		}
+	}
+	return parts
+}
@@ -76,7 +76,7 @@ func FilterHandler(w http.ResponseWriter, r *http.Request) {
 	// Query to fetch posts based on the selected category
 	query := `
 		SELECT p.id, p.title, p.content, p.image_path, GROUP_CONCAT(pc.category) as categories, 
-		u.username, p.created_at, 
+		p.user_id, u.username, p.created_at, p.edited_at,
 		COALESCE(l.like_count, 0) AS like_count,
 		COALESCE(l.dislike_count, 0) AS dislike_count
 		FROM posts p
@@ -90,8 +90,9 @@ func FilterHandler(w http.ResponseWriter, r *http.Request) {
 			GROUP BY post_id
 		) l ON p.id = l.post_id
 	`
+	query += " WHERE p.deleted_at IS NULL"
 	if category != "all" && category != "" {
-		query += " WHERE pc.category = ?"
+		query += " AND pc.category = ?"
 	}
 	query += " GROUP BY p.id, p.title, p.content, u.username, p.created_at ORDER BY p.created_at DESC"
 
@@ -114,6 +115,7 @@ func FilterHandler(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var post Post
 		var createdAt time.Time
+		var editedAt sql.NullTime
 		var categories sql.NullString
 		err := rows.Scan(
 			&post.ID,
@@ -121,8 +123,10 @@ func FilterHandler(w http.ResponseWriter, r *http.Request) {
 			&post.Content,
 			&post.ImagePath,
 			&categories,
+			&post.UserID,
 			&post.Username,
 			&createdAt,
+			&editedAt,
 			&post.LikeCount,
 			&post.DislikeCount,
 		)
@@ -140,47 +144,17 @@ func FilterHandler(w http.ResponseWriter, r *http.Request) {
 		// Set the CreatedAt field and the human-readable time
 		post.CreatedAt = createdAt
 		post.CreatedAtHuman = TimeAgo(createdAt)
+		setEditedAt(&post, editedAt)
+		loadPostImages(&post)
 
-		commentQuery := `
-			SELECT c.id, c.content, u.username, c.created_at, 
-       COALESCE(clike.like_count, 0) AS like_count,
-       COALESCE(cdislike.dislike_count, 0) AS dislike_count
-FROM comments c
-JOIN users u ON c.user_id = u.id
-LEFT JOIN (
-    SELECT comment_id, COUNT(CASE WHEN is_like = 1 THEN 1 END) AS like_count
-    FROM comment_likes
-    GROUP BY comment_id
-) clike ON c.id = clike.comment_id
-LEFT JOIN (
-    SELECT comment_id, COUNT(CASE WHEN is_like = 0 THEN 1 END) AS dislike_count
-    FROM comment_likes
-    GROUP BY comment_id
-) cdislike ON c.id = cdislike.comment_id
-WHERE c.post_id = ?
-ORDER BY c.created_at DESC
-
-		`
-		commentRows, err := db.Query(commentQuery, post.ID)
+		// Fetch comments the same way as the home page, so deleted
+		// comments stay as tombstones holding their replies
+		comments, err := GetCommentsForPost(post.ID)
 		if err != nil {
 			log.Printf("Error fetching comments: %v", err)
 			RenderError(w, r, "Error fetching comments", http.StatusInternalServerError)
 			return
 		}
-		defer commentRows.Close()
-
-		var comments []Comment
-		for commentRows.Next() {
-			var comment Comment
-			err := commentRows.Scan(&comment.ID, &comment.Content, &comment.Username, &comment.CreatedAt, &comment.LikeCount, &comment.DislikeCount)
-			if err != nil {
-				log.Printf("Error scanning comment: %v", err)
-				RenderError(w, r, "Error scanning comments", http.StatusInternalServerError)
-				return
-			}
-			comments = append(comments, comment)
-		}
-
 		post.Comments = comments
 		posts = append(posts, post)
 	}
@@ -194,9 +168,13 @@ ORDER BY c.created_at DESC
 	}
 
 	err = tmpl.Execute(w, map[string]interface{}{
-		"Posts":            posts,
-		"IsLoggedIn":       isLoggedIn,
-		"SelectedCategory": category,
+		"Posts":               posts,
+		"IsLoggedIn":          isLoggedIn,
+		"IsModerator":         isModerator(userID),
+		"UnreadNotifications": UnreadNotificationCount(userID),
+		"SelectedCategory":    category,
+		"ImageSlots":          imageSlots(),
+		"ImageAccept":         imageAccept(),
 	})
 	if err != nil {
 		log.Printf("Error executing template: %v", err)
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+)
+
+// imageFormat describes an image format accepted for upload
+type imageFormat struct {
+	MimeType   string
+	Extensions []string          // Accepted file extensions, the first is used for storage
+	Magic      func([]byte) bool // Reports whether the content is in this format
+
+	// DecodeConfig reads the dimensions without decoding the pixels
+	DecodeConfig func([]byte) (image.Config, error)
+
+	// Decode returns the pixels. Formats without a decoder are checked
+	// structurally and stored as uploaded, without resized variants.
+	Decode func([]byte) (image.Image, error)
+
+	// StoreAs is the MIME type the format is transcoded to before storage,
+	// for formats browsers cannot display. Empty for formats served as is.
+	StoreAs string
+
+	// Probe reads the container of a video format; nil for images
+	Probe func([]byte) (videoInfo, error)
+}
+
+// imageFormats is the table of formats accepted for upload, short video
+// clips included. Which of them are enabled is configured through
+// AppConfig.ImageFormats.
+var imageFormats = []imageFormat{
+	{
+		MimeType:     "image/jpeg",
+		Extensions:   []string{".jpg", ".jpeg"},
+		Magic:        hasMagic("\xFF\xD8\xFF"),
+		DecodeConfig: stdDecodeConfig("jpeg"),
+		Decode:       stdDecode,
+	},
+	{
+		MimeType:     "image/png",
+		Extensions:   []string{".png"},
+		Magic:        hasMagic("\x89PNG\r\n\x1a\n"),
+		DecodeConfig: stdDecodeConfig("png"),
+		Decode:       stdDecode,
+	},
+	{
+		MimeType:     "image/gif",
+		Extensions:   []string{".gif"},
+		Magic:        hasMagic("GIF87a", "GIF89a"),
+		DecodeConfig: stdDecodeConfig("gif"),
+		Decode:       stdDecode,
+	},
+	{
+		MimeType:     "image/webp",
+		Extensions:   []string{".webp"},
+		Magic:        isWebP,
+		DecodeConfig: webpConfig,
+		Decode:       decodeWebP,
+	},
+	{
+		MimeType:     "image/heic",
+		Extensions:   []string{".heic", ".heif"},
+		Magic:        isHEIC,
+		DecodeConfig: heicConfig,
+		Decode:       decodeHEIC,
+		StoreAs:      "image/jpeg",
+	},
+	{
+		MimeType:     "video/mp4",
+		Extensions:   []string{".mp4", ".m4v"},
+		Magic:        isMP4,
+		DecodeConfig: videoConfig(probeMP4),
+		Probe:        probeMP4,
+	},
+	{
+		MimeType:     "video/webm",
+		Extensions:   []string{".webm"},
+		Magic:        isWebM,
+		DecodeConfig: videoConfig(probeWebM),
+		Probe:        probeWebM,
+	},
+}
+
+// hasMagic returns a Magic function matching any of the given prefixes
+func hasMagic(prefixes ...string) func([]byte) bool {
+	return func(data []byte) bool {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix(data, []byte(prefix)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// stdDecodeConfig reads dimensions with the decoders registered in the
+// image package, failing if the content is not in the named format
+func stdDecodeConfig(name string) func([]byte) (image.Config, error) {
+	return func(data []byte) (image.Config, error) {
+		config, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || format != name {
+			return image.Config{}, errImageCorrupt
+		}
+		return config, nil
+	}
+}
+
+// stdDecode decodes with the decoders registered in the image package.
+// For GIFs only the first frame is decoded.
+func stdDecode(data []byte) (image.Image, error) {
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	return decoded, err
+}
+
+// enabledFormats returns the formats accepted under the current configuration
+func enabledFormats() []imageFormat {
+	if len(AppConfig.ImageFormats) == 0 {
+		return imageFormats
+	}
+	var formats []imageFormat
+	for _, format := range imageFormats {
+		for _, mimeType := range AppConfig.ImageFormats {
+			if format.MimeType == mimeType {
+				formats = append(formats, format)
+			}
+		}
+	}
+	return formats
+}
+
+// formatByExtension returns the enabled format a file name claims to be in
+func formatByExtension(ext string) (imageFormat, bool) {
+	ext = strings.ToLower(ext)
+	for _, format := range enabledFormats() {
+		for _, e := range format.Extensions {
+			if e == ext {
+				return format, true
+			}
+		}
+	}
+	return imageFormat{}, false
+}
+
+// sniffImageFormat returns the enabled format matching the content
+func sniffImageFormat(data []byte) (imageFormat, bool) {
+	for _, format := range enabledFormats() {
+		if format.Magic(data) {
+			return format, true
+		}
+	}
+	return imageFormat{}, false
+}
+
+// formatByMimeType returns the format with the given MIME type, enabled or not
+func formatByMimeType(mimeType string) (imageFormat, bool) {
+	for _, format := range imageFormats {
+		if format.MimeType == mimeType {
+			return format, true
+		}
+	}
+	return imageFormat{}, false
+}
+
+// imageAccept returns the accept attribute for image file inputs
+func imageAccept() string {
+	var types []string
+	for _, format := range enabledFormats() {
+		types = append(types, format.MimeType)
+		types = append(types, format.Extensions...)
+	}
+	return strings.Join(types, ", ")
+}
+
+// needsTranscoding reports whether images of this type are converted before storage
+func needsTranscoding(mimeType string) bool {
+	format, ok := formatByMimeType(mimeType)
+	return ok && format.StoreAs != "" && format.StoreAs != mimeType
+}
+
+// TranscodeImage converts a decoded image to the format its upload format
+// is stored as. The result is freshly encoded and carries no metadata.
+func TranscodeImage(data []byte, info ImageInfo) ([]byte, ImageInfo, error) {
+	format, ok := formatByMimeType(info.MimeType)
+	if !ok || format.StoreAs == "" || info.Decoded == nil {
+		return data, info, nil
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch format.StoreAs {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, info.Decoded, &jpeg.Options{Quality: strippedJPEGQuality})
+	default:
+		err = png.Encode(&buf, info.Decoded)
+	}
+	if err != nil {
+		return nil, ImageInfo{}, err
+	}
+	info.MimeType = format.StoreAs
+	return buf.Bytes(), info, nil
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"path"
+	"strings"
+	"time"
+)
+
+// Gallery errors. Each message is the key of its ErrorMessages entry.
+var (
+	errImageTextTooLong = errors.New("image_text_too_long")
+	errTooManyImages    = errors.New("post_too_many_images")
+)
+
+// PostImage is an image in a post's gallery
+type PostImage struct {
+	Image
+	Position int    // Order of the image within the gallery, starting at 0
+	Caption  string // Optional text shown below the image
+	AltText  string // Description read by screen readers in place of the image
+
+	// DuplicateOf is the earliest post that already had this picture, or 0
+	DuplicateOf int
+
+	token string // Upload token the image was sent ahead under, if any
+}
+
+// maxAltTextLength is the longest alt text or caption accepted, in characters
+const maxAltTextLength = 1000
+
+// Alt returns the text for the image's alt attribute. Images posted
+// without alt text fall back to their caption.
+func (pi PostImage) Alt() string {
+	if pi.AltText != "" {
+		return pi.AltText
+	}
+	if pi.Caption != "" {
+		return pi.Caption
+	}
+	return fmt.Sprintf("Image %d, no description provided", pi.Position+1)
+}
+
+// imageSlots returns one index per image field on the post form
+func imageSlots() []int {
+	slots := make([]int, AppConfig.MaxImagesPerPost)
+	for i := range slots {
+		slots[i] = i
+	}
+	return slots
+}
+
+// GetPostImages returns the gallery of a post in display order
+func GetPostImages(postID int) ([]PostImage, error) {
+	rows, err := db.Query(`
+		SELECT `+imageColumns+`, pi.position, COALESCE(pi.caption, ''), COALESCE(pi.alt_text, ''),
+			COALESCE(pi.duplicate_of, 0)
+		FROM post_images pi
+		JOIN images i ON pi.image_id = i.id
+		WHERE pi.post_id = ?
+		ORDER BY pi.position`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []PostImage
+	for rows.Next() {
+		var pi PostImage
+		if err := rows.Scan(append(imageFields(&pi.Image), &pi.Position, &pi.Caption, &pi.AltText, &pi.DuplicateOf)...); err != nil {
+			return nil, err
+		}
+		images = append(images, pi)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range images {
+		images[i].Variants, err = GetImageVariants(images[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// loadPostImages fills in the gallery of a post
+func loadPostImages(post *Post) {
+	images, err := GetPostImages(post.ID)
+	if err != nil {
+		log.Printf("Error fetching post images: %v", err)
+		return
+	}
+	post.Images = images
+}
+
+// migratePostImages moves the single image of older posts into post_images.
+// Posts whose image was recorded in the images table are linked directly;
+// posts that only have an image_path get an images row for that file. It
+// runs in one transaction so a failure leaves no post half migrated.
+func migratePostImages() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO post_images (post_id, image_id, position)
+		SELECT p.id, p.image_id, 0 FROM posts p
+		WHERE p.image_id IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM post_images pi WHERE pi.post_id = p.id)`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT p.id, p.user_id, p.image_path, p.created_at FROM posts p
+		WHERE p.image_id IS NULL AND COALESCE(p.image_path, '') != ''
+		AND NOT EXISTS (SELECT 1 FROM post_images pi WHERE pi.post_id = p.id)`)
+	if err != nil {
+		return err
+	}
+
+	type legacyPost struct {
+		id        int
+		userID    sql.NullString
+		imagePath string
+		createdAt sql.NullTime
+	}
+	var legacy []legacyPost
+	for rows.Next() {
+		var p legacyPost
+		if err := rows.Scan(&p.id, &p.userID, &p.imagePath, &p.createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, p)
+	}
+	rows.Close()
+
+	for _, p := range legacy {
+		// Older posts stored paths like "uploads/photo.jpg" relative to the site root
+		key := strings.TrimPrefix(strings.TrimPrefix(p.imagePath, "/"), "uploads/")
+		mimeType := mime.TypeByExtension(strings.ToLower(path.Ext(key)))
+		createdAt := p.createdAt.Time
+		if !p.createdAt.Valid {
+			createdAt = time.Now()
+		}
+
+		result, err := tx.Exec(
+			"INSERT INTO images (user_id, hash, path, original_name, mime_type, size, created_at) VALUES (?, '', ?, ?, ?, 0, ?)",
+			p.userID, key, path.Base(key), mimeType, createdAt,
+		)
+		if err != nil {
+			return err
+		}
+		imageID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE posts SET image_id = ? WHERE id = ?", imageID, p.id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO post_images (post_id, image_id, position) VALUES (?, ?, 0)", p.id, imageID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
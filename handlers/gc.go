@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// referencedImagesQuery selects the IDs of images something still uses,
+// counting earlier versions of edited posts and uploads that may still
+// be attached through their token
+const referencedImagesQuery = `
+	SELECT image_id FROM post_images
+	UNION SELECT image_id FROM post_revision_images
+	UNION SELECT image_id FROM comments WHERE image_id IS NOT NULL
+	UNION SELECT avatar_image_id FROM users WHERE avatar_image_id IS NOT NULL
+	UNION SELECT image_id FROM upload_tokens WHERE expires_at > ?`
+
+// GCOptions control a garbage collection run
+type GCOptions struct {
+	DryRun      bool          // Report what would be removed without removing it
+	GracePeriod time.Duration // Files and rows younger than this are never removed
+}
+
+// MissingFile is a database row whose file is no longer in the blob store
+type MissingFile struct {
+	Table string // "images" or "image_variants"
+	ID    int64
+	Key   string
+}
+
+// GCReport lists what a garbage collection run found
+type GCReport struct {
+	OrphanedFiles  []BlobInfo    // Stored files no post or comment references
+	OrphanedRows   []int64       // IDs of images rows no post or comment references
+	ExpiredTokens  int64         // Upload tokens past their expiry
+	ExpiredUploads int64         // Unfinished resumable uploads past their expiry
+	MissingFiles   []MissingFile // Rows pointing at files that do not exist
+	FreedBytes     int64
+	DryRun         bool
+}
+
+// String summarises the report in one line for logs
+func (r GCReport) String() string {
+	verb := "removed"
+	if r.DryRun {
+		verb = "would remove"
+	}
+	return fmt.Sprintf("%s %d orphaned files (%d bytes), %d orphaned image rows, %d expired upload tokens and %d abandoned partial uploads; %d rows point at missing files",
+		verb, len(r.OrphanedFiles), r.FreedBytes, len(r.OrphanedRows), r.ExpiredTokens, r.ExpiredUploads, len(r.MissingFiles))
+}
+
+// CollectGarbage finds uploaded files that no post or comment references
+// and rows whose file has disappeared. Unless DryRun is set, orphaned files
+// and image rows older than the grace period are deleted. Rows pointing at
+// missing files are only reported, since removing them loses information.
+func CollectGarbage(opts GCOptions) (GCReport, error) {
+	report := GCReport{DryRun: opts.DryRun}
+	cutoff := time.Now().Add(-opts.GracePeriod)
+
+	// Everything currently in the store
+	stored := map[string]BlobInfo{}
+	err := blobStore.Walk(func(info BlobInfo) error {
+		stored[info.Key] = info
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("listing stored files: %w", err)
+	}
+
+	referenced := map[int64]bool{}
+	rows, err := db.Query(referencedImagesQuery, time.Now())
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return report, err
+		}
+		referenced[id] = true
+	}
+	rows.Close()
+
+	// Keys in use: those of referenced images, and of images still within
+	// the grace period since they may be attached shortly.
+	protected := map[string]bool{}
+	imageKeys := map[int64][]string{}
+
+	rows, err = db.Query("SELECT id, path, COALESCE(poster_path, ''), created_at FROM images")
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var id int64
+		var key, poster string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &key, &poster, &createdAt); err != nil {
+			rows.Close()
+			return report, err
+		}
+		imageKeys[id] = append(imageKeys[id], key)
+		if poster != "" {
+			imageKeys[id] = append(imageKeys[id], poster)
+		}
+		if _, ok := stored[key]; !ok {
+			report.MissingFiles = append(report.MissingFiles, MissingFile{Table: "images", ID: id, Key: key})
+		}
+		if !referenced[id] && createdAt.Before(cutoff) {
+			report.OrphanedRows = append(report.OrphanedRows, id)
+		}
+		if referenced[id] || !createdAt.Before(cutoff) {
+			protected[key] = true
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT id, image_id, path FROM image_variants")
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var id, imageID int64
+		var key string
+		if err := rows.Scan(&id, &imageID, &key); err != nil {
+			rows.Close()
+			return report, err
+		}
+		imageKeys[imageID] = append(imageKeys[imageID], key)
+		if _, ok := stored[key]; !ok {
+			report.MissingFiles = append(report.MissingFiles, MissingFile{Table: "image_variants", ID: id, Key: key})
+		}
+	}
+	rows.Close()
+
+	// Variants and posters share the fate of their image
+	for id, keys := range imageKeys {
+		for _, key := range keys[1:] {
+			if protected[keys[0]] || referenced[id] {
+				protected[key] = true
+			}
+		}
+	}
+
+	for key, info := range stored {
+		if !protected[key] && info.ModTime.Before(cutoff) {
+			report.OrphanedFiles = append(report.OrphanedFiles, info)
+			report.FreedBytes += info.Size
+		}
+	}
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM upload_tokens WHERE expires_at <= ?", time.Now()).Scan(&report.ExpiredTokens); err != nil {
+		return report, err
+	}
+
+	report.ExpiredUploads, err = expireResumableUploads(opts.DryRun)
+	if err != nil {
+		return report, err
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	if _, err := db.Exec("DELETE FROM upload_tokens WHERE expires_at <= ?", time.Now()); err != nil {
+		return report, err
+	}
+
+	for _, id := range report.OrphanedRows {
+		if _, err := db.Exec("DELETE FROM image_variants WHERE image_id = ?", id); err != nil {
+			return report, err
+		}
+		if _, err := db.Exec("DELETE FROM images WHERE id = ?", id); err != nil {
+			return report, err
+		}
+	}
+	for _, info := range report.OrphanedFiles {
+		if err := blobStore.Delete(info.Key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+			return report, fmt.Errorf("deleting %s: %w", info.Key, err)
+		}
+	}
+	return report, nil
+}
+
+// StartUploadSweeper runs CollectGarbage in the background at the
+// configured interval. An interval of zero disables the sweeper.
+func StartUploadSweeper() {
+	if AppConfig.GCInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(AppConfig.GCInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report, err := CollectGarbage(GCOptions{GracePeriod: AppConfig.GCGracePeriod})
+			if err != nil {
+				log.Printf("Upload sweeper failed: %v", err)
+				continue
+			}
+			log.Printf("Upload sweeper: %s", report)
+		}
+	}()
+}
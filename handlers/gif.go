@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"time"
+)
+
+// GIF errors. Each message is the key of its ErrorMessages entry.
+var (
+	errGIFFrames   = errors.New("gif_too_many_frames")
+	errGIFPixels   = errors.New("gif_too_many_pixels")
+	errGIFDuration = errors.New("gif_too_long")
+)
+
+// gifStats summarises a GIF without decoding any of its frames
+type gifStats struct {
+	Frames   int
+	Pixels   int           // Sum of the frame areas, i.e. pixels decoded per loop
+	Duration time.Duration // Length of one loop of the animation
+}
+
+// gifMinDelay is the delay browsers use for frames asking for 0 or 10ms
+const gifMinDelay = 100 * time.Millisecond
+
+// scanGIF walks the blocks of a GIF file, counting frames and adding up
+// their areas and delays. Only the block structure is read, so a GIF with
+// thousands of frames costs no more than reading the file once.
+func scanGIF(data []byte) (gifStats, error) {
+	var stats gifStats
+	if len(data) < 13 {
+		return stats, errImageCorrupt
+	}
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << ((flags & 0x07) + 1) // Global color table
+	}
+
+	delay := time.Duration(0)
+	for {
+		if pos >= len(data) {
+			return stats, errImageCorrupt
+		}
+		switch data[pos] {
+		case 0x21: // Extension
+			if pos+2 >= len(data) {
+				return stats, errImageCorrupt
+			}
+			label := data[pos+1]
+			pos += 2
+			if label == 0xF9 && pos+4 < len(data) && data[pos] == 4 {
+				// Graphic control extension: delay in hundredths of a second
+				delay = time.Duration(binary.LittleEndian.Uint16(data[pos+2:pos+4])) * 10 * time.Millisecond
+			}
+			if pos = skipGIFSubBlocks(data, pos); pos < 0 {
+				return stats, errImageCorrupt
+			}
+
+		case 0x2C: // Image descriptor
+			if pos+10 > len(data) {
+				return stats, errImageCorrupt
+			}
+			width := int(binary.LittleEndian.Uint16(data[pos+5 : pos+7]))
+			height := int(binary.LittleEndian.Uint16(data[pos+7 : pos+9]))
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << ((flags & 0x07) + 1) // Local color table
+			}
+			pos++ // LZW minimum code size
+			if pos = skipGIFSubBlocks(data, pos); pos < 0 {
+				return stats, errImageCorrupt
+			}
+
+			stats.Frames++
+			stats.Pixels += width * height
+			if delay < gifMinDelay {
+				delay = gifMinDelay
+			}
+			stats.Duration += delay
+			delay = 0
+
+		case 0x3B: // Trailer
+			return stats, nil
+
+		default:
+			return stats, errImageCorrupt
+		}
+	}
+}
+
+// skipGIFSubBlocks returns the position after a chain of data sub-blocks,
+// or -1 if the chain runs past the end of the data
+func skipGIFSubBlocks(data []byte, pos int) int {
+	for {
+		if pos >= len(data) {
+			return -1
+		}
+		n := int(data[pos])
+		pos++
+		if n == 0 {
+			return pos
+		}
+		pos += n
+	}
+}
+
+// validateGIF checks an animated GIF against the configured frame, pixel
+// and duration limits and returns its number of frames
+func validateGIF(data []byte) (int, error) {
+	stats, err := scanGIF(data)
+	if err != nil {
+		return 0, err
+	}
+	if stats.Frames == 0 {
+		return 0, errImageCorrupt
+	}
+	if stats.Frames > AppConfig.MaxGIFFrames {
+		return 0, errGIFFrames
+	}
+	if stats.Pixels > AppConfig.MaxGIFPixels {
+		return 0, errGIFPixels
+	}
+	if stats.Frames > 1 && stats.Duration > AppConfig.MaxGIFDuration {
+		return 0, errGIFDuration
+	}
+	return stats.Frames, nil
+}
+
+// createPoster stores the first frame of an animated GIF or a video clip
+// as a PNG, shown until the reader asks for the animation
+func createPoster(img *Image, decoded image.Image) error {
+	if decoded == nil || (img.Frames < 2 && !img.IsVideo()) {
+		return nil
+	}
+
+	// The first frame of a GIF may cover only part of the canvas
+	canvas := image.NewRGBA(image.Rect(0, 0, img.Width, img.Height))
+	if img.IsVideo() {
+		canvas = image.NewRGBA(image.Rect(0, 0, decoded.Bounds().Dx(), decoded.Bounds().Dy()))
+	}
+	draw.Draw(canvas, decoded.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return fmt.Errorf("encoding poster: %w", err)
+	}
+	key := contentPath(img.Hash, "_poster.png")
+	if err := putContent(key, buf.Bytes(), "image/png"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE images SET poster_path = ? WHERE id = ?", key, img.ID); err != nil {
+		return fmt.Errorf("recording poster: %w", err)
+	}
+	img.PosterPath = key
+	return nil
+}
+
+// Animated reports whether the image is a GIF with more than one frame
+func (img Image) Animated() bool {
+	return img.Frames > 1
+}
+
+// DisplayURL is the address shown in feeds: the static poster of an
+// animated GIF, or the image itself
+func (img Image) DisplayURL() string {
+	if img.PosterPath != "" {
+		return mediaURL(img.ID, "poster")
+	}
+	return img.URL()
+}
@@ -1,22 +1,67 @@
 package handlers
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 var parseTemplate = func(_ ...string) (*template.Template, error) {
 	return template.New("mock").Parse("<html></html>") // Mock template
 }
 
+// setupImageTestDB swaps in a database built by the real migrations and a
+// blob store in a temporary directory, which it returns, and restores both
+// when the test ends. The database is a file so that queries nested in
+// others can open a second connection to it.
+func setupImageTestDB(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+	mockDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "forum.db"))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	originalDB := db
+	originalBlobStore := blobStore
+	uploadsDir := t.TempDir()
+	db = mockDB
+	blobStore = NewLocalStore(uploadsDir)
+	t.Cleanup(func() {
+		db = originalDB
+		blobStore = originalBlobStore
+		mockDB.Close()
+	})
+
+	if err := migrateDB(); err != nil {
+		t.Fatalf("Failed to prepare mock schema: %v", err)
+	}
+	return mockDB, uploadsDir
+}
+
 func TestHomeHandler(t *testing.T) {
 	// Store original functions to restore after test
 	originalGetUserIdFromSession := GetUserIdFromSession
@@ -231,7 +276,8 @@ func TestGetCommentsForPost(t *testing.T) {
 		);
 		CREATE TABLE posts (
 			id INTEGER PRIMARY KEY,
-			title TEXT
+			title TEXT,
+			deleted_at DATETIME
 		);
 		CREATE TABLE comments (
 			id INTEGER PRIMARY KEY,
@@ -240,6 +286,8 @@ func TestGetCommentsForPost(t *testing.T) {
 			content TEXT,
 			created_at DATETIME,
 			parent_id INTEGER,
+			image_id INTEGER,
+			deleted_at DATETIME,
 			FOREIGN KEY(post_id) REFERENCES posts(id),
 			FOREIGN KEY(user_id) REFERENCES users(id),
 			FOREIGN KEY(parent_id) REFERENCES comments(id)
@@ -377,7 +425,8 @@ func TestGetCommentReplies(t *testing.T) {
 		);
 		CREATE TABLE posts (
 			id INTEGER PRIMARY KEY,
-			title TEXT
+			title TEXT,
+			deleted_at DATETIME
 		);
 		CREATE TABLE comments (
 			id INTEGER PRIMARY KEY,
@@ -386,6 +435,8 @@ func TestGetCommentReplies(t *testing.T) {
 			content TEXT,
 			created_at DATETIME,
 			parent_id INTEGER,
+			image_id INTEGER,
+			deleted_at DATETIME,
 			FOREIGN KEY(post_id) REFERENCES posts(id),
 			FOREIGN KEY(user_id) REFERENCES users(id),
 			FOREIGN KEY(parent_id) REFERENCES comments(id)
@@ -485,40 +536,10 @@ func TestGetCommentReplies(t *testing.T) {
 }
 
 func TestCommentHandler(t *testing.T) {
-	// Setup mock database
-	mockDB, err := sql.Open("sqlite3", ":memory:")
-	if err != nil {
-		t.Fatalf("Failed to create mock database: %v", err)
-	}
-	defer mockDB.Close()
-
-	// Replace global db with mock
-	originalDB := db
-	db = mockDB
-	defer func() { db = originalDB }()
-
-	// Prepare mock database schema and data
-	_, err = mockDB.Exec(`
-		CREATE TABLE users (
-			id INTEGER PRIMARY KEY,
-			username TEXT
-		);
-		CREATE TABLE posts (
-			id INTEGER PRIMARY KEY,
-			title TEXT
-		);
-		CREATE TABLE comments (
-			id INTEGER PRIMARY KEY,
-			post_id INTEGER,
-			user_id INTEGER,
-			content TEXT,
-			created_at DATETIME,
-			parent_id INTEGER,
-			FOREIGN KEY(post_id) REFERENCES posts(id),
-			FOREIGN KEY(user_id) REFERENCES users(id),
-			FOREIGN KEY(parent_id) REFERENCES comments(id)
-		);
+	mockDB, _ := setupImageTestDB(t)
 
+	// Prepare mock data
+	_, err := mockDB.Exec(`
 		-- Insert test users
 		INSERT INTO users (id, username) VALUES 
 		(1, 'testuser1'),
@@ -643,6 +664,82 @@ func TestCommentHandler(t *testing.T) {
 			}
 		})
 	}
+
+	// Images can be attached to comments and replies, either uploaded with
+	// the form or sent ahead to /upload and referred to by a token
+	originalGetUserIdFromSession := GetUserIdFromSession
+	GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string { return "1" }
+	defer func() { GetUserIdFromSession = originalGetUserIdFromSession }()
+	comment := func(fields map[string]string, withFile bool) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("post_id", "1")
+		form.WriteField("content", "Look at this")
+		for name, value := range fields {
+			form.WriteField(name, value)
+		}
+		if withFile {
+			part, _ := form.CreateFormFile("image", "boat.png")
+			part.Write(encodeTestPNG(t, 20, 10))
+		}
+		form.Close()
+		req := httptest.NewRequest(http.MethodPost, "/comment", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rr := httptest.NewRecorder()
+		CommentHandler(rr, req)
+		return rr
+	}
+	countImages := func() int {
+		var count int
+		mockDB.QueryRow("SELECT COUNT(*) FROM images").Scan(&count)
+		return count
+	}
+
+	if rr := comment(nil, true); rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a comment with an image to be created, got %d %s", rr.Code, rr.Body.String())
+	}
+	var parentID int
+	var imageID sql.NullInt64
+	mockDB.QueryRow("SELECT id, image_id FROM comments WHERE parent_id IS NULL ORDER BY id DESC LIMIT 1").Scan(&parentID, &imageID)
+	if !imageID.Valid {
+		t.Fatalf("Expected the comment to have an image")
+	}
+
+	uploaded, err := ProcessImageUpload("1", "pier.png", bytes.NewReader(encodeTestPNG(t, 30, 10)), UploadOptions{})
+	if err != nil {
+		t.Fatalf("Failed to upload image: %v", err)
+	}
+	_, err = mockDB.Exec("INSERT INTO upload_tokens (token, image_id, user_id, created_at, expires_at) VALUES ('token1', ?, '1', ?, ?)",
+		uploaded.ID, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to prepare upload token: %v", err)
+	}
+
+	// A reply to a missing comment stores nothing and keeps the token
+	images := countImages()
+	if rr := comment(map[string]string{"parent_id": "999"}, true); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a reply to a missing comment, got %d", rr.Code)
+	}
+	if rr := comment(map[string]string{"parent_id": "999", "image_token": "token1"}, false); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a reply to a missing comment, got %d", rr.Code)
+	}
+	if countImages() != images {
+		t.Errorf("Expected no image to be stored for a rejected reply")
+	}
+
+	if rr := comment(map[string]string{"parent_id": strconv.Itoa(parentID), "image_token": "token1"}, false); rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a reply with an uploaded image to be created, got %d %s", rr.Code, rr.Body.String())
+	}
+	mockDB.QueryRow("SELECT image_id FROM comments WHERE parent_id = ?", parentID).Scan(&imageID)
+	if imageID.Int64 != uploaded.ID {
+		t.Errorf("Expected the reply to have image %d, got %v", uploaded.ID, imageID)
+	}
+	var tokens int
+	mockDB.QueryRow("SELECT COUNT(*) FROM upload_tokens").Scan(&tokens)
+	if tokens != 0 {
+		t.Errorf("Expected the upload token to be used up")
+	}
+
 }
 
 func TestCommentLikeHandler(t *testing.T) {
@@ -666,7 +763,8 @@ func TestCommentLikeHandler(t *testing.T) {
 		);
 		CREATE TABLE posts (
 			id INTEGER PRIMARY KEY,
-			title TEXT
+			title TEXT,
+			deleted_at DATETIME
 		);
 		CREATE TABLE comments (
 			id INTEGER PRIMARY KEY,
@@ -675,6 +773,8 @@ func TestCommentLikeHandler(t *testing.T) {
 			content TEXT,
 			created_at DATETIME,
 			parent_id INTEGER,
+			image_id INTEGER,
+			deleted_at DATETIME,
 			FOREIGN KEY(post_id) REFERENCES posts(id),
 			FOREIGN KEY(user_id) REFERENCES users(id),
 			FOREIGN KEY(parent_id) REFERENCES comments(id)
@@ -882,3 +982,2646 @@ func TestCommentLikeHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestStoreImage(t *testing.T) {
+	mockDB, uploadsDir := setupImageTestDB(t)
+
+	data := []byte("same image content")
+	info := ImageInfo{MimeType: "image/jpeg", Width: 10, Height: 10}
+
+	first, err := StoreImage("user1", "photo.jpg", info, data)
+	if err != nil {
+		t.Fatalf("Unexpected error storing first image: %v", err)
+	}
+	second, err := StoreImage("user2", "../../photo.jpg", info, data)
+	if err != nil {
+		t.Fatalf("Unexpected error storing second image: %v", err)
+	}
+
+	// Identical content must share one file
+	if first.Path != second.Path {
+		t.Errorf("Expected identical uploads to share a path, got %q and %q", first.Path, second.Path)
+	}
+	if !strings.HasPrefix(first.Path, first.Hash[:2]+"/"+first.Hash[2:4]+"/") {
+		t.Errorf("Expected path to be sharded by hash, got %q", first.Path)
+	}
+	if second.OriginalName != "photo.jpg" {
+		t.Errorf("Expected original name to be reduced to its base name, got %q", second.OriginalName)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(uploadsDir, filepath.FromSlash(first.Path)))
+	if err != nil {
+		t.Fatalf("Expected stored file to exist: %v", err)
+	}
+	if string(stored) != string(data) {
+		t.Errorf("Stored content does not match upload")
+	}
+
+	// Each upload keeps its own row with its owner
+	var count int
+	if err := mockDB.QueryRow("SELECT COUNT(*) FROM images WHERE hash = ?", first.Hash).Scan(&count); err != nil {
+		t.Fatalf("Error counting images: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 image rows, got %d", count)
+	}
+
+	if _, err := StoreImage("user1", "notes.txt", ImageInfo{MimeType: "text/plain"}, data); err == nil {
+		t.Errorf("Expected an error for an unsupported MIME type")
+	}
+}
+
+// encodeTestPNG returns a PNG of the given size for upload tests
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, x%height, color.RGBA{R: 200, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode test PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageVariants(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	// The box filter averages each block of source pixels
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	draw.Draw(src, image.Rect(0, 0, 2, 2), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(2, 0, 4, 2), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	resized := resizeImage(src, 2, 1)
+	if resized.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Fatalf("Expected a 2x1 image, got %v", resized.Bounds())
+	}
+	if resized.RGBAAt(0, 0) != (color.RGBA{R: 255, A: 255}) || resized.RGBAAt(1, 0) != (color.RGBA{B: 255, A: 255}) {
+		t.Errorf("Unexpected resized pixels %v and %v", resized.RGBAAt(0, 0), resized.RGBAAt(1, 0))
+	}
+
+	tests := []struct {
+		width, height int
+		want          []ImageVariant // Expected widths and heights
+	}{
+		{1000, 500, []ImageVariant{{Width: 320, Height: 160}, {Width: 800, Height: 400}}},
+		{2000, 333, []ImageVariant{{Width: 320, Height: 53}, {Width: 800, Height: 133}, {Width: 1600, Height: 266}}},
+		{800, 800, []ImageVariant{{Width: 320, Height: 320}}},
+		{320, 100, nil},
+	}
+	for i, tt := range tests {
+		data := encodeTestPNG(t, tt.width, tt.height)
+		decoded, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to decode test PNG: %v", err)
+		}
+		img := &Image{ID: int64(i + 1), Hash: fmt.Sprintf("%064d", i), MimeType: "image/png", Width: tt.width, Height: tt.height}
+		if err := createVariants(img, decoded); err != nil {
+			t.Fatalf("%dx%d: unexpected error: %v", tt.width, tt.height, err)
+		}
+		if len(img.Variants) != len(tt.want) {
+			t.Errorf("%dx%d: expected %d variants, got %d", tt.width, tt.height, len(tt.want), len(img.Variants))
+			continue
+		}
+		for j, v := range img.Variants {
+			if v.Width != tt.want[j].Width || v.Height != tt.want[j].Height {
+				t.Errorf("%dx%d: expected a %dx%d variant, got %dx%d", tt.width, tt.height, tt.want[j].Width, tt.want[j].Height, v.Width, v.Height)
+			}
+			stored, err := readBlob(v.Path)
+			if err != nil {
+				t.Errorf("Expected variant %s to be stored: %v", v.Path, err)
+				continue
+			}
+			cfg, err := png.DecodeConfig(bytes.NewReader(stored))
+			if err != nil || cfg.Width != v.Width || cfg.Height != v.Height {
+				t.Errorf("Expected the stored variant to be %dx%d, got %dx%d (%v)", v.Width, v.Height, cfg.Width, cfg.Height, err)
+			}
+		}
+		var count int
+		mockDB.QueryRow("SELECT COUNT(*) FROM image_variants WHERE image_id = ?", img.ID).Scan(&count)
+		if count != len(tt.want) {
+			t.Errorf("%dx%d: expected %d recorded variants, got %d", tt.width, tt.height, len(tt.want), count)
+		}
+	}
+
+	img := Image{ID: 5, Width: 1000, Variants: []ImageVariant{{ImageID: 5, Width: 320}, {ImageID: 5, Width: 800}}}
+	if got, want := img.SrcSet(), "/media/5/w320 320w, /media/5/w800 800w, /media/5 1000w"; got != want {
+		t.Errorf("Expected srcset %q, got %q", want, got)
+	}
+	img.PosterPath = "poster.png"
+	if got, want := img.SrcSet(), "/media/5/w320 320w, /media/5/w800 800w, /media/5/poster 1000w"; got != want {
+		t.Errorf("Expected srcset %q for an animation, got %q", want, got)
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	originalConfig := AppConfig
+	defer func() { AppConfig = originalConfig }()
+	AppConfig.MaxImageWidth = 100
+	AppConfig.MaxImageHeight = 100
+	AppConfig.MaxImagePixels = 5000
+
+	valid := encodeTestPNG(t, 40, 30)
+
+	testCases := []struct {
+		name        string
+		data        []byte
+		filename    string
+		expectedErr error
+	}{
+		{name: "Valid PNG", data: valid, filename: "picture.PNG"},
+		{name: "Empty File", data: nil, filename: "picture.png", expectedErr: errImageEmpty},
+		{name: "Unknown Extension", data: valid, filename: "picture.svg", expectedErr: errImageType},
+		{name: "Extension Mismatch", data: valid, filename: "picture.jpg", expectedErr: errImageMismatch},
+		{name: "HTML Disguised As Image", data: []byte("<html><script>alert(1)</script></html>"), filename: "picture.gif", expectedErr: errImageType},
+		{name: "Truncated Image", data: valid[:len(valid)/2], filename: "picture.png", expectedErr: errImageCorrupt},
+		{name: "Too Wide", data: encodeTestPNG(t, 101, 10), filename: "picture.png", expectedErr: errImageDimensions},
+		{name: "Too Many Pixels", data: encodeTestPNG(t, 80, 80), filename: "picture.png", expectedErr: errImageDimensions},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := ValidateImage(tc.data, tc.filename)
+			if err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if err != nil {
+				if _, ok := ErrorMessages[err.Error()]; !ok {
+					t.Errorf("Expected an ErrorMessages entry for %q", err.Error())
+				}
+				return
+			}
+			if info.MimeType != "image/png" || info.Width != 40 || info.Height != 30 {
+				t.Errorf("Unexpected image info: %+v", info)
+			}
+		})
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	// Encode a wide JPEG, red on the left and blue on the right, and insert
+	// an Exif segment rotating it 90 degrees
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(src, image.Rect(0, 0, 20, 20), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(20, 0, 40, 20), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, src, nil); err != nil {
+		t.Fatalf("Failed to encode test JPEG: %v", err)
+	}
+	plain := buf.Bytes()
+
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08, // Big-endian header, IFD at offset 8
+		0x00, 0x01, // One entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, // Orientation = 6
+		0x00, 0x00, 0x00, 0x00, // No next IFD
+	}
+	tiff = append(tiff, []byte("GPS 51.5N 0.12W")...)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	withExif := append(append(append([]byte{}, plain[:2]...), append(segment, payload...)...), plain[2:]...)
+
+	if got := exifOrientation(withExif, "image/jpeg"); got != 6 {
+		t.Fatalf("Expected orientation 6, got %d", got)
+	}
+
+	info, err := ValidateImage(withExif, "phone.jpg")
+	if err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+
+	stripped, info, err := StripMetadata(withExif, info)
+	if err != nil {
+		t.Fatalf("Unexpected error stripping metadata: %v", err)
+	}
+	if bytes.Contains(stripped, []byte("Exif")) || bytes.Contains(stripped, []byte("GPS")) {
+		t.Errorf("Expected metadata to be removed")
+	}
+	if info.Width != 20 || info.Height != 40 {
+		t.Errorf("Expected orientation to be applied (20x40), got %dx%d", info.Width, info.Height)
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("Stripped image does not decode: %v", err)
+	}
+	if config.Width != 20 || config.Height != 40 {
+		t.Errorf("Expected stripped image to be 20x40, got %dx%d", config.Width, config.Height)
+	}
+
+	// Originals kept with their metadata still get upright variants
+	mockDB, _ := setupImageTestDB(t)
+	if _, err := mockDB.Exec("INSERT INTO users (id, email) VALUES ('user1', 'u@x.com')"); err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+	originalWidths := variantWidths
+	variantWidths = []int{10}
+	defer func() { variantWidths = originalWidths }()
+	kept, err := ProcessImageUpload("user1", "phone.jpg", bytes.NewReader(withExif), UploadOptions{KeepOriginal: true})
+	if err != nil {
+		t.Fatalf("Unexpected error keeping the original: %v", err)
+	}
+	if stored, _ := readBlob(kept.Path); !bytes.Equal(stored, withExif) {
+		t.Errorf("Expected the original to be stored unchanged")
+	}
+	if kept.Width != 20 || kept.Height != 40 || len(kept.Variants) != 1 {
+		t.Fatalf("Expected a 20x40 image with one variant, got %dx%d with %d", kept.Width, kept.Height, len(kept.Variants))
+	}
+	variantData, err := readBlob(kept.Variants[0].Path)
+	if err != nil {
+		t.Fatalf("Failed to read variant: %v", err)
+	}
+	variant, err := jpeg.Decode(bytes.NewReader(variantData))
+	if err != nil {
+		t.Fatalf("Variant does not decode: %v", err)
+	}
+	top, _, _, _ := variant.At(5, 2).RGBA()
+	bottom, _, _, _ := variant.At(5, 17).RGBA()
+	if variant.Bounds().Dx() != 10 || variant.Bounds().Dy() != 20 || top < 0x8000 || bottom > 0x8000 {
+		t.Errorf("Expected an upright 10x20 variant, red above blue, got %v", variant.Bounds())
+	}
+}
+
+// fakeS3 is an in-memory stand-in for an S3-compatible object store. It
+// checks that requests are signed and that the payload hash matches.
+type fakeS3 struct {
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+		return
+	}
+
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = body
+		f.types[key] = r.Header.Get("Content-Type")
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[key])
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, types: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store := NewS3Store(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "media",
+		AccessKey: "test-key",
+		SecretKey: "test-secret",
+	})
+
+	key := "ab/cd/abcdef.png"
+	data := []byte("png bytes")
+
+	if err := store.Put(key, bytes.NewReader(data), int64(len(data)), "image/png"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, ok := fake.objects["/media/"+key]; !ok {
+		t.Fatalf("Expected object to be stored under /media/%s", key)
+	}
+
+	info, err := store.Stat(key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size != int64(len(data)) || info.ContentType != "image/png" {
+		t.Errorf("Unexpected blob info: %+v", info)
+	}
+
+	rc, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(got) != string(data) {
+		t.Errorf("Expected %q, got %q", data, got)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Stat(key); err != ErrBlobNotFound {
+		t.Errorf("Expected ErrBlobNotFound after delete, got %v", err)
+	}
+	if _, err := store.Get("../escape"); err == nil {
+		t.Errorf("Expected keys escaping the bucket to be rejected")
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	mockDB, uploadsDir := setupImageTestDB(t)
+
+	old := time.Now().Add(-48 * time.Hour)
+	_, err := mockDB.Exec(`
+		INSERT INTO images (id, hash, path, created_at) VALUES (1, 'aa', 'aa/used.jpg', ?), (2, 'bb', 'bb/unused.jpg', ?), (3, 'cc', 'cc/gone.jpg', ?), (4, 'dd', 'dd/fresh.jpg', ?), (5, 'ff', 'ff/avatar.png', ?);
+		INSERT INTO image_variants (image_id, path) VALUES (1, 'aa/used_w320.jpg');
+		INSERT INTO post_images (post_id, image_id) VALUES (1, 1);
+		INSERT INTO comments (id, image_id) VALUES (1, 3);
+		INSERT INTO users (id, avatar_image_id) VALUES ('user1', 5);
+	`, old, old, old, time.Now(), old)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	for _, key := range []string{"aa/used.jpg", "aa/used_w320.jpg", "bb/unused.jpg", "dd/fresh.jpg", "ee/stray.jpg", "ff/avatar.png"} {
+		if err := blobStore.Put(key, strings.NewReader("data"), 4, "image/jpeg"); err != nil {
+			t.Fatalf("Failed to store %s: %v", key, err)
+		}
+		os.Chtimes(filepath.Join(uploadsDir, filepath.FromSlash(key)), old, old)
+	}
+
+	report, err := CollectGarbage(GCOptions{DryRun: true, GracePeriod: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var orphaned []string
+	for _, f := range report.OrphanedFiles {
+		orphaned = append(orphaned, f.Key)
+	}
+	sort.Strings(orphaned)
+	if strings.Join(orphaned, ",") != "bb/unused.jpg,ee/stray.jpg" {
+		t.Errorf("Unexpected orphaned files: %v", orphaned)
+	}
+	if len(report.OrphanedRows) != 1 || report.OrphanedRows[0] != 2 {
+		t.Errorf("Expected image 2 to be an orphaned row, got %v", report.OrphanedRows)
+	}
+	if len(report.MissingFiles) != 1 || report.MissingFiles[0].Key != "cc/gone.jpg" {
+		t.Errorf("Expected cc/gone.jpg to be reported missing, got %v", report.MissingFiles)
+	}
+
+	// A dry run must not remove anything
+	if _, err := blobStore.Stat("ee/stray.jpg"); err != nil {
+		t.Errorf("Dry run removed a file: %v", err)
+	}
+
+	if _, err := CollectGarbage(GCOptions{GracePeriod: 24 * time.Hour}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for key, want := range map[string]bool{"aa/used.jpg": true, "aa/used_w320.jpg": true, "dd/fresh.jpg": true, "ff/avatar.png": true, "bb/unused.jpg": false, "ee/stray.jpg": false} {
+		_, err := blobStore.Stat(key)
+		if exists := err == nil; exists != want {
+			t.Errorf("Expected %s to exist=%v after collection", key, want)
+		}
+	}
+	var count int
+	mockDB.QueryRow("SELECT COUNT(*) FROM images").Scan(&count)
+	if count != 4 {
+		t.Errorf("Expected 4 image rows to remain, got %d", count)
+	}
+}
+
+func TestCheckUploadQuota(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	originalConfig := AppConfig
+	AppConfig = DefaultConfig()
+	AppConfig.UploadQuotas = map[string]UploadQuota{
+		RoleUser:  {TotalBytes: 1000, PerDay: 2, MaxFileSize: 500},
+		RoleAdmin: {},
+	}
+	defer func() {
+		AppConfig = originalConfig
+	}()
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, email) VALUES ('fresh', 'f@x.com'), ('busy', 'b@x.com'), ('full', 'u@x.com'), ('boss', 'a@x.com');
+		INSERT INTO images (user_id, hash, path, size, created_at) VALUES ('busy', 'a', 'a', 10, ?), ('busy', 'b', 'b', 10, ?), ('full', 'c', 'c', 900, ?);
+	`, time.Now(), time.Now(), time.Now().Add(-72*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+	if err := SetUserRole("a@x.com", RoleAdmin); err != nil {
+		t.Fatalf("Failed to set role: %v", err)
+	}
+
+	tests := []struct {
+		user string
+		size int64
+		want error
+	}{
+		{"fresh", 100, nil},
+		{"fresh", 600, errQuotaFileSize},
+		{"busy", 100, errQuotaDaily},
+		{"full", 50, nil},
+		{"full", 200, errQuotaStorage},
+		{"boss", 1 << 30, nil},
+	}
+	for _, tt := range tests {
+		if err := CheckUploadQuota(tt.user, tt.size); err != tt.want {
+			t.Errorf("CheckUploadQuota(%q, %d) = %v, want %v", tt.user, tt.size, err, tt.want)
+		}
+	}
+
+	usage, err := GetUploadUsage("busy")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if usage.TotalBytes != 20 || usage.Today != 2 || usage.Role != RoleUser {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+
+	// Size limit messages name the limit of the user's role
+	for _, key := range []string{"image_too_large", "quota_file_too_large"} {
+		if data, ok := errorMessage(key, "fresh"); !ok || data.ErrorMessage != "Image size exceeds the 500 B limit" {
+			t.Errorf("Unexpected %s message %q", key, data.ErrorMessage)
+		}
+	}
+	if data, _ := errorMessage("image_too_large", "boss"); data.ErrorMessage != "Image size exceeds the 20.0 MB limit" {
+		t.Errorf("Expected the overall limit without a role limit, got %q", data.ErrorMessage)
+	}
+
+	// Posters without an account get the quota of ordinary users
+	if err := CheckUploadQuota("", 100); err != nil {
+		t.Errorf("Expected an anonymous upload within the quota to pass, got %v", err)
+	}
+	if err := CheckUploadQuota("", 600); err != errQuotaFileSize {
+		t.Errorf("Expected the quota of ordinary users for anonymous uploads, got %v", err)
+	}
+
+	// Concurrent uploads cannot all pass the check on the same usage
+	results := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			data := []byte(fmt.Sprintf("image %d", i))
+			_, err := StoreImage("fresh", "photo.jpg", ImageInfo{MimeType: "image/jpeg", Width: 1, Height: 1}, data)
+			results <- err
+		}(i)
+	}
+	stored := 0
+	for i := 0; i < 5; i++ {
+		switch err := <-results; err {
+		case nil:
+			stored++
+		case errQuotaDaily:
+		default:
+			t.Errorf("Unexpected error storing concurrently: %v", err)
+		}
+	}
+	if stored != 2 {
+		t.Errorf("Expected 2 of 5 concurrent uploads to fit the daily quota, got %d", stored)
+	}
+}
+
+// encodeTestGIF returns an animated GIF with the given number of frames,
+// each shown for delay hundredths of a second
+func encodeTestGIF(t *testing.T, width, height, frames, delay int) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		frame.SetColorIndex(i%width, 0, 1)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("Failed to encode test GIF: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestAnimatedGIF(t *testing.T) {
+	originalConfig := AppConfig
+	AppConfig = DefaultConfig()
+	AppConfig.MaxGIFFrames = 10
+	AppConfig.MaxGIFPixels = 10 * 100 * 100
+	AppConfig.MaxGIFDuration = 2 * time.Second
+	defer func() { AppConfig = originalConfig }()
+
+	tests := []struct {
+		name    string
+		data    []byte
+		frames  int
+		wantErr error
+	}{
+		{"static", encodeTestGIF(t, 100, 100, 1, 0), 1, nil},
+		{"animated", encodeTestGIF(t, 100, 100, 5, 20), 5, nil},
+		{"too many frames", encodeTestGIF(t, 10, 10, 11, 10), 0, errGIFFrames},
+		{"too many pixels", encodeTestGIF(t, 200, 200, 3, 10), 0, errGIFPixels},
+		{"too long", encodeTestGIF(t, 10, 10, 3, 100), 0, errGIFDuration},
+		{"zero delays count as 100ms", encodeTestGIF(t, 10, 10, 10, 0), 10, nil},
+	}
+	for _, tt := range tests {
+		info, err := ValidateImage(tt.data, "anim.gif")
+		if err != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+			continue
+		}
+		if err == nil && info.Frames != tt.frames {
+			t.Errorf("%s: expected %d frames, got %d", tt.name, tt.frames, info.Frames)
+		}
+	}
+
+	// A truncated file must not be accepted
+	data := encodeTestGIF(t, 10, 10, 3, 10)
+	if _, err := scanGIF(data[:len(data)-20]); err != errImageCorrupt {
+		t.Errorf("Expected truncated GIF to be corrupt, got %v", err)
+	}
+
+	// Storing an animation creates a still poster shown in its place
+	setupImageTestDB(t)
+
+	info, err := ValidateImage(tests[1].data, "anim.gif")
+	if err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+	img, err := StoreImage("user1", "anim.gif", info, tests[1].data)
+	if err != nil {
+		t.Fatalf("Unexpected error storing GIF: %v", err)
+	}
+	if !img.Animated() || img.PosterPath == "" {
+		t.Fatalf("Expected an animated image with a poster, got %+v", img)
+	}
+	if img.DisplayURL() == img.URL() || strings.Contains(img.SrcSet(), img.URL()+" ") {
+		t.Errorf("Expected the poster to be displayed instead of the animation")
+	}
+	stored, err := GetImage(img.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error loading image: %v", err)
+	}
+	if stored.PosterPath != img.PosterPath || stored.Frames != 5 {
+		t.Errorf("Poster was not recorded: %+v", stored)
+	}
+}
+
+// riffChunk encodes one chunk of a WebP container
+func riffChunk(fourCC string, data []byte) []byte {
+	chunk := append([]byte(fourCC), byte(len(data)), byte(len(data)>>8), byte(len(data)>>16), byte(len(data)>>24))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// encodeTestWebP wraps chunks in a WebP RIFF header
+func encodeTestWebP(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	size := len(body)
+	return append([]byte{'R', 'I', 'F', 'F', byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24)}, body...)
+}
+
+// encodeTestVP8L encodes a lossless WebP bitstream of opaque red pixels.
+// Every prefix code has a single symbol, so the pixels take no bits.
+func encodeTestVP8L(width, height int) []byte {
+	data := []byte{0x2f}
+	n := 0
+	put := func(value, count int) {
+		for i := 0; i < count; i, n = i+1, n+1 {
+			if n%8 == 0 {
+				data = append(data, 0)
+			}
+			data[len(data)-1] |= byte(value>>i&1) << (n % 8)
+		}
+	}
+	put(width-1, 14)
+	put(height-1, 14)
+	put(0, 4)             // No alpha, version 0
+	put(0, 3)             // No transform, colour cache or meta prefix codes
+	put(0b0001, 4)        // Green: one 1-bit symbol, 0
+	put(0b101|255<<3, 11) // Red: one 8-bit symbol, 255
+	put(0b0001, 4)        // Blue: 0
+	put(0b101|255<<3, 11) // Alpha: 255
+	put(0b0001, 4)        // Distance: 0
+	return data
+}
+
+// isoBox encodes an ISO base media box
+func isoBox(boxType string, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+	size := len(body) + 8
+	return append(append([]byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)}, boxType...), body...)
+}
+
+func TestImageFormats(t *testing.T) {
+	originalConfig := AppConfig
+	AppConfig = DefaultConfig()
+	defer func() { AppConfig = originalConfig }()
+
+	// Lossless WebP of 300x200 with an EXIF chunk
+	vp8l := riffChunk("VP8L", encodeTestVP8L(300, 200))
+	vp8x := riffChunk("VP8X", []byte{webpFlagEXIF, 0, 0, 0, 43, 1, 0, 199, 0, 0})
+	webp := encodeTestWebP(vp8x, vp8l, riffChunk("EXIF", []byte("Exif\x00\x00GPS")))
+
+	info, err := ValidateImage(webp, "photo.webp")
+	if err != nil {
+		t.Fatalf("Expected WebP to be accepted, got %v", err)
+	}
+	if info.MimeType != "image/webp" || info.Width != 300 || info.Height != 200 {
+		t.Errorf("Unexpected WebP info: %+v", info)
+	}
+	if info.Decoded == nil || info.Decoded.Bounds().Dx() != 300 || perceptualHash(info.Decoded) == "" {
+		t.Errorf("Expected WebP pixels to be decoded for hashing")
+	} else if r, g, b, _ := info.Decoded.At(5, 5).RGBA(); r>>8 != 255 || g != 0 || b != 0 {
+		t.Errorf("Expected red WebP pixels, got %d %d %d", r>>8, g>>8, b>>8)
+	}
+	stripped, _, err := StripMetadata(webp, info)
+	if err != nil {
+		t.Fatalf("Unexpected error stripping WebP: %v", err)
+	}
+	if bytes.Contains(stripped, []byte("EXIF")) || bytes.Contains(stripped, []byte("GPS")) {
+		t.Errorf("Expected EXIF chunk to be removed")
+	}
+	if _, err := ValidateImage(stripped, "photo.webp"); err != nil {
+		t.Errorf("Stripped WebP no longer validates: %v", err)
+	}
+
+	animated := encodeTestWebP(riffChunk("VP8X", []byte{webpFlagAnimation, 0, 0, 0, 9, 0, 0, 9, 0, 0}), riffChunk("ANIM", make([]byte, 6)))
+	if _, err := ValidateImage(animated, "anim.webp"); err != errWebPAnimated {
+		t.Errorf("Expected animated WebP to be rejected, got %v", err)
+	}
+	if _, err := ValidateImage(webp[:len(webp)-10], "photo.webp"); err != errImageCorrupt {
+		t.Errorf("Expected truncated WebP to be corrupt, got %v", err)
+	}
+
+	// HEIC of 40x30 as described by its ispe property
+	ispe := isoBox("ispe", []byte{0, 0, 0, 0, 0, 0, 0, 40, 0, 0, 0, 30})
+	heic := append(isoBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic")),
+		isoBox("meta", []byte{0, 0, 0, 0}, isoBox("iprp", isoBox("ipco", ispe)))...)
+
+	if _, err := ValidateImage(heic, "IMG_0001.HEIC"); err != errHEICUnsupported {
+		t.Errorf("Expected HEIC without a converter to be refused, got %v", err)
+	}
+
+	// A stand-in converter that ignores its input and prints a PNG
+	dir := t.TempDir()
+	pngPath := filepath.Join(dir, "out.png")
+	if err := ioutil.WriteFile(pngPath, encodeTestPNG(t, 40, 30), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "convert.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\ncat > /dev/null\ncat "+pngPath+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	AppConfig.HEICConvertCommand = script
+
+	info, err = ValidateImage(heic, "IMG_0001.HEIC")
+	if err != nil {
+		t.Fatalf("Expected HEIC to be converted, got %v", err)
+	}
+	if !needsTranscoding(info.MimeType) {
+		t.Fatalf("Expected HEIC to need transcoding")
+	}
+	jpegData, info, err := TranscodeImage(heic, info)
+	if err != nil {
+		t.Fatalf("Unexpected error transcoding: %v", err)
+	}
+	if info.MimeType != "image/jpeg" || !bytes.HasPrefix(jpegData, []byte{0xFF, 0xD8, 0xFF}) {
+		t.Errorf("Expected a JPEG, got %s", info.MimeType)
+	}
+
+	// Formats can be turned off through the configuration
+	AppConfig.ImageFormats = []string{"image/png"}
+	if _, err := ValidateImage(encodeTestGIF(t, 10, 10, 1, 0), "still.gif"); err != errImageType {
+		t.Errorf("Expected disabled format to be rejected, got %v", err)
+	}
+	if imageAccept() != "image/png, .png" {
+		t.Errorf("Unexpected accept list %q", imageAccept())
+	}
+}
+
+func TestPostHandlerAltText(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, username, email) VALUES ('user1', 'user1', 'u@x.com');
+		INSERT INTO sessions VALUES ('session1', 'user1');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	newPost := func(altText string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("title", "Sunset")
+		form.WriteField("content", "Taken last night")
+		form.WriteField("category", "general")
+		form.WriteField("alt_0", altText)
+		form.WriteField("caption_0", "From the pier")
+		part, _ := form.CreateFormFile("image_0", "sunset.png")
+		part.Write(encodeTestPNG(t, 20, 10))
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/post", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: "session1"})
+		req.ParseMultipartForm(32 << 20)
+		rr := httptest.NewRecorder()
+		PostHandler(rr, req)
+		return rr
+	}
+
+	rr := newPost("An orange sun setting over the sea")
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/" {
+		t.Fatalf("Expected redirect to /, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	images, err := GetPostImages(1)
+	if err != nil || len(images) != 1 {
+		t.Fatalf("Expected one image, got %v (%v)", images, err)
+	}
+	if images[0].Alt() != "An orange sun setting over the sea" || images[0].Caption != "From the pier" {
+		t.Errorf("Unexpected alt text or caption: %+v", images[0])
+	}
+
+	// Posting without alt text works but warns the author
+	rr = newPost("  ")
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/?warning=missing_alt_text" {
+		t.Fatalf("Expected redirect with a warning, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if postWarnings["missing_alt_text"] == "" {
+		t.Errorf("Expected a message for the missing_alt_text warning")
+	}
+	images, _ = GetPostImages(2)
+	if len(images) != 1 || images[0].AltText != "" || images[0].Alt() != "From the pier" {
+		t.Errorf("Expected alt to fall back to the caption, got %+v", images)
+	}
+
+	// Held images are reported alongside the missing alt text
+	originalConfig := AppConfig
+	defer func() { AppConfig = originalConfig }()
+	AppConfig.QuarantineCategories = []string{"general"}
+	rr = newPost("")
+	if location := rr.Header().Get("Location"); location != "/?warning=missing_alt_text&warning=images_pending" {
+		t.Fatalf("Expected both warnings, got %d %q", rr.Code, location)
+	}
+	wd, _ := os.Getwd()
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	req := httptest.NewRequest(http.MethodGet, rr.Header().Get("Location"), nil)
+	rr = httptest.NewRecorder()
+	HomeHandler(rr, req)
+	for _, key := range []string{"missing_alt_text", "images_pending"} {
+		if !strings.Contains(rr.Body.String(), template.HTMLEscapeString(postWarnings[key])) {
+			t.Errorf("Expected the %s warning on the home page", key)
+		}
+	}
+}
+
+func TestPostGallery(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	originalConfig := AppConfig
+	originalRenderError := RenderError
+	var renderedMessage string
+	RenderError = func(w http.ResponseWriter, r *http.Request, message string, statusCode int) {
+		renderedMessage = message
+		http.Error(w, message, statusCode)
+	}
+	defer func() {
+		AppConfig = originalConfig
+		RenderError = originalRenderError
+	}()
+	AppConfig.MaxImagesPerPost = 3
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, email) VALUES ('user1', 'u@x.com');
+		INSERT INTO sessions VALUES ('session1', 'user1');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	// slots maps slot numbers to the width of the image sent in them
+	newPost := func(slots map[int]int) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("title", "Harbour")
+		form.WriteField("content", "Boats")
+		form.WriteField("category", "general")
+		for slot, width := range slots {
+			form.WriteField(fmt.Sprintf("caption_%d", slot), fmt.Sprintf("Slot %d", slot))
+			form.WriteField(fmt.Sprintf("alt_%d", slot), fmt.Sprintf("Image %d", slot))
+			part, _ := form.CreateFormFile(fmt.Sprintf("image_%d", slot), "boat.png")
+			part.Write(encodeTestPNG(t, width, 10))
+		}
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/post", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: "session1"})
+		req.ParseMultipartForm(32 << 20)
+		rr := httptest.NewRecorder()
+		PostHandler(rr, req)
+		return rr
+	}
+
+	// Images keep the order of their slots, skipping empty ones, and each
+	// keeps its own caption and alt text
+	if rr := newPost(map[int]int{2: 30, 0: 20}); rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the post to be created, got %d %q", rr.Code, renderedMessage)
+	}
+	images, err := GetPostImages(1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("Expected 2 images, got %d", len(images))
+	}
+	for i, want := range []struct {
+		width   int
+		caption string
+		alt     string
+	}{{20, "Slot 0", "Image 0"}, {30, "Slot 2", "Image 2"}} {
+		img := images[i]
+		if img.Position != i || img.Width != want.width || img.Caption != want.caption || img.AltText != want.alt {
+			t.Errorf("Image %d: expected %dpx %q %q, got position %d %dpx %q %q", i, want.width, want.caption, want.alt, img.Position, img.Width, img.Caption, img.AltText)
+		}
+	}
+
+	// A gallery cannot grow past the limit, counting the images it has
+	AppConfig.MaxImagesPerPost = 2
+	if rr := newPost(map[int]int{0: 20, 1: 30}); rr.Code != http.StatusSeeOther {
+		t.Errorf("Expected a full gallery to be accepted, got %d %q", rr.Code, renderedMessage)
+	}
+	if images, _ := GetPostImages(2); len(images) != 2 {
+		t.Errorf("Expected a full gallery of 2 images, got %d", len(images))
+	}
+	form := url.Values{"image_token_0": {"token"}}
+	req := httptest.NewRequest(http.MethodPost, "/posts/2/edit", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ParseForm()
+	if _, _, err := readGalleryForm(req, "user1", []string{"general"}, 2); err != errTooManyImages {
+		t.Errorf("Expected %v for more images than the gallery holds, got %v", errTooManyImages, err)
+	}
+	if _, ok := ErrorMessages[errTooManyImages.Error()]; !ok {
+		t.Errorf("Expected an ErrorMessages entry for %q", errTooManyImages.Error())
+	}
+
+	// Upload tokens are only used up once the post is saved, and only once
+	AppConfig.MaxImagesPerPost = 3
+	addToken := func() {
+		_, err := mockDB.Exec("INSERT INTO upload_tokens (token, image_id, user_id, created_at, expires_at) VALUES ('tok', ?, 'user1', ?, ?)",
+			images[0].ID, time.Now(), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("Failed to add upload token: %v", err)
+		}
+	}
+	tokenPost := func(extra url.Values) *httptest.ResponseRecorder {
+		form := url.Values{"title": {"Token"}, "content": {"Sent ahead"}, "category": {"general"}, "image_token_0": {"tok"}}
+		for k, v := range extra {
+			form[k] = v
+		}
+		req := httptest.NewRequest(http.MethodPost, "/post", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: "session1"})
+		req.ParseForm()
+		rr := httptest.NewRecorder()
+		PostHandler(rr, req)
+		return rr
+	}
+	countRows := func(table string) int {
+		var n int
+		mockDB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n)
+		return n
+	}
+	addToken()
+	posts := countRows("posts")
+	if rr := tokenPost(url.Values{"image_token_1": {"tok"}, "caption_1": {strings.Repeat("x", maxAltTextLength+1)}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a rejected later slot to fail the post, got %d", rr.Code)
+	}
+	if countRows("upload_tokens") != 1 || countRows("posts") != posts {
+		t.Errorf("Expected a rejected post to keep its token and not be saved")
+	}
+	if rr := tokenPost(nil); rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the post to be created, got %d %q", rr.Code, renderedMessage)
+	}
+	if countRows("upload_tokens") != 0 || countRows("posts") != posts+1 {
+		t.Errorf("Expected the token to be used up by the saved post")
+	}
+	if rr := tokenPost(nil); rr.Code != http.StatusBadRequest || countRows("posts") != posts+1 {
+		t.Errorf("Expected a used token to be refused, got %d", rr.Code)
+	}
+	// Two forms read the token before either is saved; only one may claim it
+	addToken()
+	for i, want := range []error{nil, errUploadToken} {
+		tx, err := mockDB.Begin()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := claimUploadToken(tx, "tok", "user1"); err != want {
+			t.Errorf("Claim %d: expected %v, got %v", i, want, err)
+		}
+		tx.Commit()
+	}
+
+	// A post whose images cannot be attached is not saved at all
+	addToken()
+	categories := countRows("post_categories")
+	mockDB.Exec(`CREATE TRIGGER fail_attach BEFORE INSERT ON post_images
+		BEGIN SELECT RAISE(ABORT, 'disk full'); END`)
+	if rr := tokenPost(nil); rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a failed attachment to fail the post, got %d", rr.Code)
+	}
+	if countRows("upload_tokens") != 1 || countRows("posts") != posts+1 || countRows("post_categories") != categories {
+		t.Errorf("Expected a failed post to be rolled back along with its token")
+	}
+	mockDB.Exec("DROP TRIGGER fail_attach")
+
+	// Posts from before galleries move their single image into one
+	_, err = mockDB.Exec(`
+		INSERT INTO posts (id, user_id, title, content, image_path, created_at) VALUES
+			(10, 'user1', 'Old', 'Old post', 'uploads/old.jpg', '2023-01-01 10:00:00'),
+			(11, 'user1', 'Plain', 'No image', '', '2023-01-01 11:00:00');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare legacy posts: %v", err)
+	}
+	for i := 0; i < 2; i++ { // Migrating twice must not duplicate anything
+		if err := migratePostImages(); err != nil {
+			t.Fatalf("Unexpected migration error: %v", err)
+		}
+	}
+	legacy, err := GetPostImages(10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(legacy) != 1 || legacy[0].Path != "old.jpg" || legacy[0].MimeType != "image/jpeg" || legacy[0].UserID != "user1" || legacy[0].Position != 0 {
+		t.Errorf("Expected the legacy image to be migrated, got %+v", legacy)
+	}
+	var imageID sql.NullInt64
+	mockDB.QueryRow("SELECT image_id FROM posts WHERE id = 10").Scan(&imageID)
+	if len(legacy) == 1 && imageID.Int64 != legacy[0].ID {
+		t.Errorf("Expected posts.image_id to point at the migrated image, got %v", imageID)
+	}
+	if plain, _ := GetPostImages(11); len(plain) != 0 {
+		t.Errorf("Expected no images for a post without one, got %d", len(plain))
+	}
+
+	// A failure partway through leaves every post as it was
+	_, err = mockDB.Exec(`
+		INSERT INTO posts (id, user_id, title, content, image_path, created_at) VALUES
+			(12, 'user1', 'Old', 'First', 'uploads/a.jpg', '2023-01-02 10:00:00'),
+			(13, 'user1', 'Old', 'Second', 'uploads/b.jpg', '2023-01-02 11:00:00');
+		CREATE TRIGGER fail_migration BEFORE INSERT ON post_images WHEN NEW.post_id = 13
+		BEGIN SELECT RAISE(ABORT, 'disk full'); END;
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare legacy posts: %v", err)
+	}
+	var imageCount int
+	mockDB.QueryRow("SELECT COUNT(*) FROM images").Scan(&imageCount)
+	if err := migratePostImages(); err == nil {
+		t.Fatal("Expected the migration to fail")
+	}
+	var after int
+	mockDB.QueryRow("SELECT COUNT(*) FROM images").Scan(&after)
+	if first, _ := GetPostImages(12); len(first) != 0 || after != imageCount {
+		t.Errorf("Expected a failed migration to be rolled back, got %d images for post 12 and %d new images", len(first), after-imageCount)
+	}
+	mockDB.Exec("DROP TRIGGER fail_migration")
+	if err := migratePostImages(); err != nil {
+		t.Fatalf("Unexpected migration error: %v", err)
+	}
+	for _, id := range []int{12, 13} {
+		if images, _ := GetPostImages(id); len(images) != 1 {
+			t.Errorf("Expected post %d to be migrated on the next run, got %d images", id, len(images))
+		}
+	}
+}
+
+func TestMediaHandler(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	// Replace session lookup with test versions
+	originalGetUserIdFromSession := GetUserIdFromSession
+	originalRenderError := RenderError
+	currentUser := ""
+	GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string { return currentUser }
+	RenderError = func(w http.ResponseWriter, r *http.Request, errorKey string, statusCode int) {
+		http.Error(w, errorKey, statusCode)
+	}
+	defer func() {
+		GetUserIdFromSession = originalGetUserIdFromSession
+		RenderError = originalRenderError
+	}()
+
+	_, err := mockDB.Exec(`
+		INSERT INTO posts (id) VALUES (1);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	data := encodeTestPNG(t, 1000, 10)
+	info, err := ValidateImage(data, "wide.png")
+	if err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+	attached, err := StoreImage("owner", "wide.png", info, data)
+	if err != nil {
+		t.Fatalf("Unexpected error storing image: %v", err)
+	}
+	mockDB.Exec("INSERT INTO post_images (post_id, image_id) VALUES (1, ?)", attached.ID)
+	unattached, err := StoreImage("owner", "draft.png", info, data)
+	if err != nil {
+		t.Fatalf("Unexpected error storing image: %v", err)
+	}
+
+	serve := func(method, target string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		MediaHandler(rr, req)
+		return rr
+	}
+
+	rr := serve(http.MethodGet, attached.URL(), nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected the image, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	etag := rr.Header().Get("ETag")
+	if etag != `"`+attached.Hash+`"` {
+		t.Errorf("Expected a strong ETag of the content hash, got %q", etag)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != publicMediaCacheControl {
+		t.Errorf("Unexpected Cache-Control %q", cc)
+	}
+
+	if rr := serve(http.MethodGet, attached.URL(), map[string]string{"If-None-Match": etag}); rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag, got %d", rr.Code)
+	}
+	rr = serve(http.MethodGet, attached.URL(), map[string]string{"Range": "bytes=0-7"})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != string(data[:8]) {
+		t.Errorf("Expected the first 8 bytes, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	if len(attached.Variants) == 0 {
+		t.Fatalf("Expected resized variants")
+	}
+	if rr := serve(http.MethodGet, attached.Variants[0].URL(), nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected variant to be served, got %d", rr.Code)
+	}
+
+	// Images not attached to anything are private to their uploader
+	if rr := serve(http.MethodGet, unattached.URL(), nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected unattached image to be hidden, got %d", rr.Code)
+	}
+	currentUser = "owner"
+	rr = serve(http.MethodGet, unattached.URL(), nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Cache-Control") != privateMediaCacheControl {
+		t.Errorf("Expected uploader to see a privately cached image, got %d %q", rr.Code, rr.Header().Get("Cache-Control"))
+	}
+
+	for _, target := range []string{"/media/", "/media/abc", "/media/999", attached.URL() + "/w7", attached.URL() + "/poster", attached.URL() + "/w320/x"} {
+		if rr := serve(http.MethodGet, target, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", target, rr.Code)
+		}
+	}
+	if rr := serve(http.MethodPost, attached.URL(), nil); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", rr.Code)
+	}
+}
+
+func TestUploadHandler(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	// Replace session lookup with test versions
+	originalGetUserIdFromSession := GetUserIdFromSession
+	originalRenderError := RenderError
+	currentUser := "user1"
+	GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string { return currentUser }
+	RenderError = func(w http.ResponseWriter, r *http.Request, errorKey string, statusCode int) {
+		http.Error(w, errorKey, statusCode)
+	}
+	defer func() {
+		GetUserIdFromSession = originalGetUserIdFromSession
+		RenderError = originalRenderError
+	}()
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, email) VALUES ('user1', 'u@x.com'), ('user2', 'v@x.com');
+		INSERT INTO sessions VALUES ('session-user1', 'user1'), ('session-user2', 'user2');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	upload := func(filename string, content []byte) (*httptest.ResponseRecorder, UploadResponse) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("image", filename)
+		part.Write(content)
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rr := httptest.NewRecorder()
+		UploadHandler(rr, req)
+
+		var response UploadResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("Expected a JSON response: %v", err)
+		}
+		return rr, response
+	}
+
+	post := func(token string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("title", "Sunset")
+		form.WriteField("content", "Taken last night")
+		form.WriteField("category", "general")
+		form.WriteField("alt_0", "An orange sun")
+		form.WriteField("image_token_0", token)
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/post", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: "session-" + currentUser})
+		req.ParseMultipartForm(32 << 20)
+		rr := httptest.NewRecorder()
+		PostHandler(rr, req)
+		return rr
+	}
+
+	rr, response := upload("sunset.png", encodeTestPNG(t, 20, 10))
+	if rr.Code != http.StatusCreated || !response.Success || response.Token == "" {
+		t.Fatalf("Expected a token, got %d %+v", rr.Code, response)
+	}
+	if response.Width != 20 || response.Height != 10 || !strings.HasPrefix(response.URL, "/media/") {
+		t.Errorf("Unexpected preview details: %+v", response)
+	}
+
+	// The token can only be used by its uploader, and only once
+	currentUser = "user2"
+	if rr := post(response.Token); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "upload_token_invalid") {
+		t.Errorf("Expected another user's token to be refused, got %d %q", rr.Code, rr.Body.String())
+	}
+	currentUser = "user1"
+	if rr := post(response.Token); rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected post with token to succeed, got %d %q", rr.Code, rr.Body.String())
+	}
+	images, err := GetPostImages(1)
+	if err != nil || len(images) != 1 || images[0].Width != 20 {
+		t.Fatalf("Expected the uploaded image on the post, got %v (%v)", images, err)
+	}
+	if rr := post(response.Token); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a used token to be refused, got %d", rr.Code)
+	}
+
+	// Expired tokens are refused too
+	_, response = upload("sunset.png", encodeTestPNG(t, 20, 10))
+	mockDB.Exec("UPDATE upload_tokens SET expires_at = ?", time.Now().Add(-time.Minute))
+	if rr := post(response.Token); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an expired token to be refused, got %d", rr.Code)
+	}
+
+	// Validation failures are explained in the response
+	rr, response = upload("notes.png", []byte("not an image"))
+	if rr.Code != http.StatusUnsupportedMediaType || response.Success || response.Error != "image_invalid_type" || response.Message == "" {
+		t.Errorf("Expected invalid type error, got %d %+v", rr.Code, response)
+	}
+
+	currentUser = ""
+	if rr, response := upload("sunset.png", encodeTestPNG(t, 20, 10)); rr.Code != http.StatusUnauthorized || response.Error != "unauthorized" {
+		t.Errorf("Expected 401 when logged out, got %d %+v", rr.Code, response)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	// Replace config and session lookup with test versions
+	originalConfig := AppConfig
+	originalGetUserIdFromSession := GetUserIdFromSession
+	AppConfig.PartialUploadsDir = t.TempDir()
+	currentUser := "user1"
+	GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string { return currentUser }
+	defer func() {
+		AppConfig = originalConfig
+		GetUserIdFromSession = originalGetUserIdFromSession
+	}()
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, email) VALUES ('user1', 'u@x.com'), ('user2', 'v@x.com');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	send := func(method, target string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		ResumableUploadHandler(rr, req)
+		return rr
+	}
+	start := func(filename string, size int) (*httptest.ResponseRecorder, ResumableUploadResponse) {
+		form := url.Values{"filename": {filename}, "size": {strconv.Itoa(size)}}
+		rr := send(http.MethodPost, "/upload/resumable", strings.NewReader(form.Encode()),
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+		var response ResumableUploadResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		return rr, response
+	}
+	patch := func(id string, offset int, chunk []byte) *httptest.ResponseRecorder {
+		return send(http.MethodPatch, "/upload/resumable/"+id, bytes.NewReader(chunk),
+			map[string]string{"Upload-Offset": strconv.Itoa(offset)})
+	}
+
+	data := encodeTestPNG(t, 40, 30)
+	rr, upload := start("big.png", len(data))
+	if rr.Code != http.StatusCreated || upload.ID == "" || upload.Offset != 0 || upload.Size != int64(len(data)) {
+		t.Fatalf("Expected a new upload, got %d %+v", rr.Code, upload)
+	}
+	target := "/upload/resumable/" + upload.ID
+
+	half := len(data) / 2
+	if rr := patch(upload.ID, 0, data[:half]); rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("Expected first chunk to be stored, got %d %q", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	// A repeated chunk is refused and the client is told where to resume
+	rr = patch(upload.ID, 0, data[:half])
+	if rr.Code != http.StatusConflict || rr.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Errorf("Expected offset mismatch, got %d %q", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+	if rr := send(http.MethodHead, target, nil, nil); rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Errorf("Expected HEAD to report the offset, got %d %q", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	// Completing early fails without losing the upload
+	if rr := send(http.MethodPost, target, nil, nil); rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "upload_incomplete") {
+		t.Errorf("Expected incomplete upload error, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// Other users cannot see or continue the upload
+	currentUser = "user2"
+	if rr := patch(upload.ID, half, data[half:]); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected another user's upload to be hidden, got %d", rr.Code)
+	}
+	currentUser = "user1"
+
+	if rr := patch(upload.ID, half, data[half:]); rr.Code != http.StatusOK {
+		t.Fatalf("Expected last chunk to be stored, got %d %q", rr.Code, rr.Body.String())
+	}
+	rr = send(http.MethodPost, target, nil, nil)
+	var completed UploadResponse
+	json.NewDecoder(rr.Body).Decode(&completed)
+	if rr.Code != http.StatusCreated || completed.Token == "" || completed.Width != 40 {
+		t.Fatalf("Expected completion to return a token, got %d %+v", rr.Code, completed)
+	}
+	if _, err := os.Stat(partialUploadPath(upload.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected partial file to be removed, got %v", err)
+	}
+	if rr := send(http.MethodHead, target, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected completed upload to be gone, got %d", rr.Code)
+	}
+
+	// Files that are not images are rejected on completion and discarded
+	_, upload = start("notes.png", 12)
+	patch(upload.ID, 0, []byte("not an image"))
+	if rr := send(http.MethodPost, "/upload/resumable/"+upload.ID, nil, nil); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected invalid type on completion, got %d", rr.Code)
+	}
+	if _, err := os.Stat(partialUploadPath(upload.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected rejected upload to be removed, got %v", err)
+	}
+
+	// Limits are checked before anything is sent
+	if rr, _ := start("huge.png", maxImageSize+1); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected oversized upload to be refused, got %d", rr.Code)
+	}
+	for i := 0; i < maxPendingUploads; i++ {
+		start("pending.png", 100)
+	}
+	if rr, _ := start("pending.png", 100); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected too many pending uploads, got %d", rr.Code)
+	}
+
+	// Abandoned uploads expire
+	mockDB.Exec("UPDATE resumable_uploads SET updated_at = ?", time.Now().Add(-AppConfig.ResumableUploadTTL-time.Minute))
+	expired, err := expireResumableUploads(false)
+	if err != nil || expired != maxPendingUploads {
+		t.Errorf("Expected %d expired uploads, got %d (%v)", maxPendingUploads, expired, err)
+	}
+	if entries, _ := os.ReadDir(AppConfig.PartialUploadsDir); len(entries) != 0 {
+		t.Errorf("Expected partial files to be removed, found %d", len(entries))
+	}
+}
+
+func TestPerceptualHash(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	// Replace config, session lookup and error page with test versions
+	originalConfig := AppConfig
+	originalGetUserIdFromSession := GetUserIdFromSession
+	originalRenderError := RenderError
+	currentUser := "user1"
+	GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string { return currentUser }
+	RenderError = func(w http.ResponseWriter, r *http.Request, errorKey string, statusCode int) {
+		http.Error(w, errorKey, statusCode)
+	}
+	defer func() {
+		AppConfig = originalConfig
+		GetUserIdFromSession = originalGetUserIdFromSession
+		RenderError = originalRenderError
+	}()
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, username, email, role) VALUES ('user1', 'alice', 'u@x.com', 'user'), ('mod1', 'mo', 'm@x.com', 'moderator');
+		INSERT INTO sessions VALUES ('session-user1', 'user1');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	// Two unrelated pictures with some structure for the hash to pick up
+	picture := func(width, height int, shade func(x, y float64) float64) *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				v := uint8(255 * shade(float64(x)/float64(width), float64(y)/float64(height)))
+				img.Set(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+			}
+		}
+		return img
+	}
+	waves := func(x, y float64) float64 { return 0.5 + 0.5*math.Sin(9*x+4*y*y) }
+	rings := func(x, y float64) float64 { return 0.5 + 0.5*math.Cos(30*math.Hypot(x-0.3, y-0.6)) }
+	original := picture(320, 240, waves)
+	encodePNG := func(img image.Image) []byte {
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		return buf.Bytes()
+	}
+	var reencoded bytes.Buffer
+	jpeg.Encode(&reencoded, resizeImage(original, 200, 150), &jpeg.Options{Quality: 60})
+	decoded, _, err := image.Decode(bytes.NewReader(reencoded.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to decode re-encoded image: %v", err)
+	}
+
+	hash := perceptualHash(original)
+	if _, ok := parsePerceptualHash(hash); !ok {
+		t.Fatalf("Expected 16 hex digits, got %q", hash)
+	}
+	if d := hashDistance(hash, perceptualHash(decoded)); d < 0 || d > 4 {
+		t.Errorf("Expected a resized JPEG copy to hash alike, distance %d", d)
+	}
+	if d := hashDistance(hash, perceptualHash(picture(320, 240, rings))); d < 16 {
+		t.Errorf("Expected different pictures to hash apart, distance %d", d)
+	}
+	if perceptualHash(nil) != "" || hashDistance(hash, "xyz") != -1 {
+		t.Errorf("Expected no hash without pixels and no distance to an invalid hash")
+	}
+
+	newPost := func(filename string, data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("title", "Waves")
+		form.WriteField("content", "Look")
+		form.WriteField("category", "general")
+		form.WriteField("alt_0", "Blue and red waves")
+		part, _ := form.CreateFormFile("image_0", filename)
+		part.Write(data)
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/post", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: "session-user1"})
+		req.ParseMultipartForm(32 << 20)
+		rr := httptest.NewRecorder()
+		PostHandler(rr, req)
+		return rr
+	}
+
+	// A repost links to the post the picture first appeared in
+	uploads := map[string][]byte{"waves.png": encodePNG(original), "rings.png": encodePNG(picture(320, 240, rings)), "copy.jpg": reencoded.Bytes()}
+	for _, filename := range []string{"waves.png", "rings.png", "copy.jpg"} {
+		if rr := newPost(filename, uploads[filename]); rr.Code != http.StatusSeeOther {
+			t.Fatalf("Expected post to be created, got %d %q", rr.Code, rr.Body.String())
+		}
+	}
+	first, _ := GetPostImages(1)
+	other, _ := GetPostImages(2)
+	repost, _ := GetPostImages(3)
+	if len(first) != 1 || first[0].PHash != hash || first[0].DuplicateOf != 0 || other[0].DuplicateOf != 0 {
+		t.Errorf("Expected originals to be stored with their hash and no duplicate link, got %+v %+v", first, other)
+	}
+	if len(repost) != 1 || repost[0].DuplicateOf != 1 {
+		t.Errorf("Expected repost to link to post 1, got %+v", repost)
+	}
+
+	// Only moderators reach the banned image list
+	ban := func(fields url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/moderation/banned-images", strings.NewReader(fields.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		BannedImagesHandler(rr, req)
+		return rr
+	}
+	if rr := ban(url.Values{"action": {"ban"}, "image": {"/media/1"}}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected users to be refused, got %d", rr.Code)
+	}
+	currentUser = "mod1"
+	if rr := ban(url.Values{"action": {"ban"}, "image": {"/media/1/w320"}, "reason": {"Abuse"}}); rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected ban to succeed, got %d %q", rr.Code, rr.Body.String())
+	}
+	banned, err := GetBannedHashes()
+	if err != nil || len(banned) != 1 || banned[0].PHash != hash || banned[0].BannedBy != "mo" || banned[0].Reason != "Abuse" {
+		t.Fatalf("Expected the image's hash on the list, got %+v (%v)", banned, err)
+	}
+
+	// Re-encoded and resized copies of a banned picture are refused
+	currentUser = "user1"
+	if rr := newPost("copy.jpg", reencoded.Bytes()); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "image_banned") {
+		t.Errorf("Expected banned image to be refused, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := newPost("rings.png", uploads["rings.png"]); rr.Code != http.StatusSeeOther {
+		t.Errorf("Expected other pictures to be accepted, got %d", rr.Code)
+	}
+	// Uploads without a hash cannot be compared, so a ban list refuses them
+	if err := CheckBannedImage(""); err != errImageUnhashable {
+		t.Errorf("Expected %v for an image without a hash, got %v", errImageUnhashable, err)
+	}
+	if _, ok := ErrorMessages[errImageUnhashable.Error()]; !ok {
+		t.Errorf("Expected an ErrorMessages entry for %q", errImageUnhashable.Error())
+	}
+	AppConfig.BannedHashDistance, AppConfig.DuplicateHashDistance = -1, -1
+	if rr := newPost("copy.jpg", reencoded.Bytes()); rr.Code != http.StatusSeeOther {
+		t.Errorf("Expected no match with a negative distance, got %d", rr.Code)
+	}
+	AppConfig = originalConfig
+
+	for _, fields := range []url.Values{{"phash": {"not-a-hash"}}, {"image": {"/media/99"}}, {"image": {"abc"}}} {
+		req := httptest.NewRequest(http.MethodPost, "/moderation/banned-images", strings.NewReader(fields.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if phash, problem := bannedHashFromForm(req); phash != "" || problem == "" {
+			t.Errorf("Expected %v to be refused with an explanation, got %q", fields, phash)
+		}
+	}
+	currentUser = "mod1"
+	if rr := ban(url.Values{"action": {"unban"}, "id": {strconv.FormatInt(banned[0].ID, 10)}}); rr.Code != http.StatusSeeOther {
+		t.Errorf("Expected unban to succeed, got %d", rr.Code)
+	}
+	if err := CheckBannedImage(hash); err != nil || CheckBannedImage("") != nil {
+		t.Errorf("Expected images to be allowed after unbanning, got %v", err)
+	}
+
+	// Reposts only link to earlier posts that are still shown
+	if earlier, _ := findEarlierPost(hash, 3); earlier != 1 {
+		t.Errorf("Expected post 1 as the earlier post, got %d", earlier)
+	}
+	mockDB.Exec("UPDATE posts SET deleted_at = ? WHERE id = 1", time.Now())
+	mockDB.Exec("UPDATE images SET moderation = ? WHERE id = ?", ImageRejected, repost[0].ID)
+	if earlier, _ := findEarlierPost(hash, 5); earlier != 0 {
+		t.Errorf("Expected deleted posts and rejected images to be skipped, got post %d", earlier)
+	}
+	mockDB.Exec("UPDATE posts SET deleted_at = NULL WHERE id = 1")
+
+	// Exact copies are found through the index, near ones only among the
+	// most recent images
+	value, _ := strconv.ParseUint(hash, 16, 64)
+	near := fmt.Sprintf("%016x", value^1)
+	if earlier, _ := findEarlierPost(near, 3); earlier != 1 {
+		t.Errorf("Expected a near copy to link to post 1, got %d", earlier)
+	}
+	AppConfig.DuplicateScanLimit = 0
+	if earlier, _ := findEarlierPost(hash, 3); earlier != 1 {
+		t.Errorf("Expected an exact copy to link to post 1 without a scan, got %d", earlier)
+	}
+	if earlier, _ := findEarlierPost(near, 3); earlier != 0 {
+		t.Errorf("Expected near copies past the scan limit to be left unlinked, got %d", earlier)
+	}
+	AppConfig = originalConfig
+	var plan string
+	mockDB.QueryRow("EXPLAIN QUERY PLAN SELECT id FROM images WHERE phash = ?", hash).Scan(new(int), new(int), new(int), &plan)
+	if !strings.Contains(plan, "idx_images_phash") {
+		t.Errorf("Expected exact copies to be looked up through the index, got plan %q", plan)
+	}
+
+	// Images stored before hashing was added get their hash afterwards
+	mockDB.Exec("UPDATE images SET phash = NULL WHERE id = 1")
+	if n, err := BackfillPerceptualHashes(); err != nil || n != 1 {
+		t.Errorf("Expected one image to be hashed, got %d (%v)", n, err)
+	}
+	if img, _ := GetImage(1); img.PHash != hash {
+		t.Errorf("Expected backfilled hash %s, got %q", hash, img.PHash)
+	}
+}
+
+func TestImageQuarantine(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	// Replace config, session lookup and error page with test versions
+	originalConfig := AppConfig
+	originalGetUserIdFromSession := GetUserIdFromSession
+	originalRenderError := RenderError
+	AppConfig.QuarantineCategories = []string{"photos"}
+	currentUser := "user1"
+	GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string { return currentUser }
+	RenderError = func(w http.ResponseWriter, r *http.Request, errorKey string, statusCode int) {
+		http.Error(w, errorKey, statusCode)
+	}
+	defer func() {
+		AppConfig = originalConfig
+		GetUserIdFromSession = originalGetUserIdFromSession
+		RenderError = originalRenderError
+	}()
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, username, email, role) VALUES ('user1', 'alice', 'u@x.com', 'user'), ('mod1', 'mo', 'm@x.com', 'moderator');
+		INSERT INTO sessions VALUES ('session-user1', 'user1'), ('session-mod1', 'mod1');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	newPost := func(session, title, category string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("title", title)
+		form.WriteField("content", "Look")
+		form.WriteField("category", category)
+		form.WriteField("alt_0", "A red line")
+		part, _ := form.CreateFormFile("image_0", "line.png")
+		part.Write(encodeTestPNG(t, 64, 64))
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/post", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: session})
+		req.ParseMultipartForm(32 << 20)
+		rr := httptest.NewRecorder()
+		PostHandler(rr, req)
+		return rr
+	}
+	media := func(imageID int64) int {
+		rr := httptest.NewRecorder()
+		MediaHandler(rr, httptest.NewRequest(http.MethodGet, mediaURL(imageID, ""), nil))
+		return rr.Code
+	}
+	review := func(fields url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/moderation/images", strings.NewReader(fields.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		ImageReviewHandler(rr, req)
+		return rr
+	}
+
+	// Images in quarantined categories wait for review, others do not
+	if rr := newPost("session-user1", "Sunset", "photos"); rr.Header().Get("Location") != "/?warning=images_pending" {
+		t.Fatalf("Expected the author to be told the image is pending, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := newPost("session-user1", "Chat", "general"); rr.Header().Get("Location") != "/" {
+		t.Errorf("Expected images outside quarantined categories to be shown, got %q", rr.Header().Get("Location"))
+	}
+	if rr := newPost("session-mod1", "Staff photo", "photos"); rr.Header().Get("Location") != "/" {
+		t.Errorf("Expected moderator images to skip the queue, got %q", rr.Header().Get("Location"))
+	}
+	pending, err := GetPendingImages()
+	if err != nil || len(pending) != 1 || pending[0].ID != 1 || pending[0].Username != "alice" || pending[0].PostTitle != "Sunset" {
+		t.Fatalf("Expected the first image in the queue, got %+v (%v)", pending, err)
+	}
+
+	// Pending images are only served to their uploader and to moderators
+	currentUser = "user2"
+	if code := media(1); code != http.StatusNotFound {
+		t.Errorf("Expected pending image to be hidden, got %d", code)
+	}
+	if code := media(2); code != http.StatusOK {
+		t.Errorf("Expected approved image to be served, got %d", code)
+	}
+	for _, user := range []string{"user1", "mod1"} {
+		currentUser = user
+		if code := media(1); code != http.StatusOK {
+			t.Errorf("Expected %s to see the pending image, got %d", user, code)
+		}
+	}
+
+	// Only moderators review, and the author hears about the decision
+	currentUser = "user1"
+	if rr := review(url.Values{"image_id": {"1"}, "action": {"approve"}}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected users to be refused, got %d", rr.Code)
+	}
+	currentUser = "mod1"
+	if rr := review(url.Values{"image_id": {"1"}, "action": {"approve"}}); rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected approval to succeed, got %d %q", rr.Code, rr.Body.String())
+	}
+	if img, _ := GetImage(1); img.Moderation != ImageApproved {
+		t.Errorf("Expected image to be approved, got %q", img.Moderation)
+	}
+	currentUser = "user2"
+	if code := media(1); code != http.StatusOK {
+		t.Errorf("Expected approved image to be served, got %d", code)
+	}
+	if n := UnreadNotificationCount("user1"); n != 1 {
+		t.Errorf("Expected one notification, got %d", n)
+	}
+
+	mockDB.Exec("UPDATE images SET moderation = ? WHERE id = 1", ImagePending)
+	currentUser = "mod1"
+	if rr := review(url.Values{"image_id": {"1"}, "action": {"reject"}, "reason": {"Not a photo"}}); rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected rejection to succeed, got %d", rr.Code)
+	}
+	if rr := review(url.Values{"image_id": {"1"}, "action": {"frobnicate"}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown action to be refused, got %d", rr.Code)
+	}
+	notifications, err := GetNotifications("user1")
+	if err != nil || len(notifications) != 2 || !strings.Contains(notifications[0].Message, "Not a photo") || notifications[0].Link != "/posts/1" {
+		t.Fatalf("Expected a rejection notice with its reason, got %+v (%v)", notifications, err)
+	}
+	if img, _ := GetImage(1); !img.Rejected() {
+		t.Errorf("Expected image to be rejected, got %q", img.Moderation)
+	}
+	currentUser = "user2"
+	if code := media(1); code != http.StatusNotFound {
+		t.Errorf("Expected rejected image to be hidden, got %d", code)
+	}
+	if err := MarkNotificationsRead("user1"); err != nil || UnreadNotificationCount("user1") != 0 {
+		t.Errorf("Expected notifications to be read, got %v", err)
+	}
+}
+
+func TestAvatar(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	// Replace session lookup and error page with test versions
+	originalGetUserIdFromSession := GetUserIdFromSession
+	originalRenderError := RenderError
+	GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string { return "user1" }
+	RenderError = func(w http.ResponseWriter, r *http.Request, errorKey string, statusCode int) {
+		http.Error(w, errorKey, statusCode)
+	}
+	defer func() {
+		GetUserIdFromSession = originalGetUserIdFromSession
+		RenderError = originalRenderError
+	}()
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, username) VALUES ('user1', 'alice'), ('user2', 'bob'), ('user3', 'carol');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	fetch := func(path string) (*httptest.ResponseRecorder, image.Image) {
+		rr := httptest.NewRecorder()
+		AvatarHandler(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		img, _, _ := image.Decode(bytes.NewReader(rr.Body.Bytes()))
+		return rr, img
+	}
+
+	// Users without an avatar get the same identicon every time, unlike anyone else's
+	rr, first := fetch("/avatar/user2/64")
+	if rr.Code != http.StatusOK || first == nil || first.Bounds().Dx() != 64 || first.Bounds().Dy() != 64 {
+		t.Fatalf("Expected a 64px identicon, got %d", rr.Code)
+	}
+	again, _ := fetch("/avatar/user2/64")
+	other, _ := fetch("/avatar/user3/64")
+	if !bytes.Equal(rr.Body.Bytes(), again.Body.Bytes()) || bytes.Equal(rr.Body.Bytes(), other.Body.Bytes()) {
+		t.Errorf("Expected identicons to be deterministic and to differ between users")
+	}
+	for _, path := range []string{"/avatar/user2/50", "/avatar/nobody/64", "/avatar/user2"} {
+		if rr, _ := fetch(path); rr.Code != http.StatusNotFound {
+			t.Errorf("Expected %s to be missing, got %d", path, rr.Code)
+		}
+	}
+
+	// A wide picture with a blue middle third is cropped to that middle
+	wide := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 100 && x < 200 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			wide.Set(x, y, c)
+		}
+	}
+	var upload bytes.Buffer
+	png.Encode(&upload, wide)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("avatar", "me.png")
+	part.Write(upload.Bytes())
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/profile/settings", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rr = httptest.NewRecorder()
+	ProfileSettingsHandler(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected avatar upload to succeed, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	for _, size := range avatarSizes {
+		rr, img := fetch(avatarURL("user1", size))
+		if rr.Code != http.StatusOK || img == nil || img.Bounds().Dx() != size || img.Bounds().Dy() != size {
+			t.Fatalf("Expected a %dpx square avatar, got %d", size, rr.Code)
+		}
+		for _, p := range []image.Point{{0, 0}, {size - 1, size - 1}, {size / 2, size / 2}} {
+			if r, _, b, _ := img.At(p.X, p.Y).RGBA(); r > 0x1000 || b < 0xf000 {
+				t.Errorf("Expected the %dpx avatar to show only the blue middle, got %v at %v", size, img.At(p.X, p.Y), p)
+			}
+		}
+	}
+
+	// Photos are cropped upright: a wide JPEG, red on the left and blue on
+	// the right, turned 90 degrees by its EXIF orientation shows red on top
+	photo := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(photo, image.Rect(0, 0, 100, 100), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(photo, image.Rect(100, 0, 200, 100), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, photo, nil)
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08, 0x00, 0x01,
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, // Orientation = 6
+		0x00, 0x00, 0x00, 0x00,
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := append([]byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+	rotated := append(append(append([]byte{}, plain.Bytes()[:2]...), segment...), plain.Bytes()[2:]...)
+	if _, err := SetAvatar("user1", "phone.jpg", rotated); err != nil {
+		t.Fatalf("Expected the photo to be accepted, got %v", err)
+	}
+	rr, avatar := fetch(avatarURL("user1", 64))
+	if rr.Code != http.StatusOK || avatar == nil {
+		t.Fatalf("Expected the rotated avatar, got %d", rr.Code)
+	}
+	if r, _, b, _ := avatar.At(60, 4).RGBA(); r < 0xc000 || b > 0x4000 {
+		t.Errorf("Expected red at the top right of an upright crop, got %v", avatar.At(60, 4))
+	}
+	if r, _, b, _ := avatar.At(4, 60).RGBA(); b < 0xc000 || r > 0x4000 {
+		t.Errorf("Expected blue at the bottom left of an upright crop, got %v", avatar.At(4, 60))
+	}
+
+	// Avatars count against the upload quota
+	originalConfig := AppConfig
+	defer func() { AppConfig = originalConfig }()
+	AppConfig.UploadQuotas = map[string]UploadQuota{RoleUser: {TotalBytes: 1 << 20, PerDay: 2, MaxFileSize: 1 << 20}}
+	if _, err := SetAvatar("user1", "me.png", upload.Bytes()); err != errQuotaDaily {
+		t.Errorf("Expected %v once the day's uploads are used, got %v", errQuotaDaily, err)
+	}
+
+	// Removing the avatar brings the identicon back
+	if err := RemoveAvatar("user1"); err != nil {
+		t.Fatalf("Failed to remove avatar: %v", err)
+	}
+	if rr, _ := fetch("/avatar/user1/64"); rr.Header().Get("ETag") != `"identicon-64"` {
+		t.Errorf("Expected the identicon after removing the avatar, got %q", rr.Header().Get("ETag"))
+	}
+}
+
+func TestBlurHash(t *testing.T) {
+	solid := func(width, height int, c color.RGBA) *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+		return img
+	}
+	decode83 := func(s string) int {
+		v := 0
+		for _, c := range s {
+			v = v*83 + strings.IndexRune(base83Chars, c)
+		}
+		return v
+	}
+
+	// A flat picture is all average color and no detail
+	hash := blurHash(solid(64, 48, color.RGBA{R: 200, G: 100, B: 50, A: 255}))
+	if len(hash) != 4+2*12 || hash[0] != base83Chars[3+2*9] {
+		t.Fatalf("Expected 4x3 components for a landscape image, got %q", hash)
+	}
+	if dc := decode83(hash[2:6]); dc != 200<<16|100<<8|50 {
+		t.Errorf("Expected the average color to be #c86432, got #%06x", dc)
+	}
+	halves := solid(64, 48, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+	draw.Draw(halves, image.Rect(32, 0, 64, 48), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	if detailed := blurHash(halves); decode83(detailed[1:2]) <= 4*decode83(hash[1:2]) {
+		t.Errorf("Expected a two-tone image to carry more detail than a flat one, got %q and %q", detailed, hash)
+	}
+	if portrait := blurHash(solid(30, 90, color.RGBA{A: 255})); portrait[0] != base83Chars[2+3*9] {
+		t.Errorf("Expected 3x4 components for a portrait image, got %q", portrait)
+	}
+	if blurHash(nil) != "" {
+		t.Errorf("Expected no BlurHash without pixels")
+	}
+
+	// Images stored before placeholders existed get them from the backfill
+	mockDB, _ := setupImageTestDB(t)
+
+	data := encodeTestPNG(t, 120, 80)
+	info, err := ValidateImage(data, "line.png")
+	if err != nil {
+		t.Fatalf("Failed to validate image: %v", err)
+	}
+	stored, err := StoreImage("user1", "line.png", info, data)
+	if err != nil {
+		t.Fatalf("Failed to store image: %v", err)
+	}
+	img, err := GetImage(stored.ID)
+	if err != nil || img.BlurHash == "" || img.BlurHash != blurHash(info.Decoded) || img.Width != 120 || img.Height != 80 {
+		t.Fatalf("Expected dimensions and BlurHash to be stored, got %+v (%v)", img, err)
+	}
+
+	mockDB.Exec("UPDATE images SET blurhash = NULL, width = NULL, height = NULL")
+	if n, err := BackfillPlaceholders(); err != nil || n != 1 {
+		t.Fatalf("Expected one image to be backfilled, got %d (%v)", n, err)
+	}
+	if backfilled, _ := GetImage(stored.ID); backfilled.BlurHash != img.BlurHash || backfilled.Width != 120 || backfilled.Height != 80 {
+		t.Errorf("Expected backfill to restore %+v, got %+v", img, backfilled)
+	}
+	if n, _ := BackfillPlaceholders(); n != 0 {
+		t.Errorf("Expected nothing left to backfill, got %d", n)
+	}
+}
+
+// encodeTestMP4 builds an MP4 file with one video track of the given codec
+// and size, and a user data box holding a location
+func encodeTestMP4(codec string, width, height int, duration time.Duration) []byte {
+	u32 := func(v int) []byte { return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)} }
+	mvhd := bytes.Join([][]byte{make([]byte, 12), u32(1000), u32(int(duration / time.Millisecond)), make([]byte, 80)}, nil)
+	tkhd := append(make([]byte, 76), append(u32(width<<16), u32(height<<16)...)...)
+	hdlr := append(make([]byte, 8), "vide\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"...)
+	entry := make([]byte, 78)
+	entry[24], entry[25], entry[26], entry[27] = byte(width>>8), byte(width), byte(height>>8), byte(height)
+	stsd := isoBox("stsd", u32(0), u32(1), isoBox(codec, entry))
+	trak := isoBox("trak", isoBox("tkhd", tkhd), isoBox("mdia", isoBox("hdlr", hdlr), isoBox("minf", isoBox("stbl", stsd))))
+	moov := isoBox("moov", isoBox("mvhd", mvhd), trak, isoBox("udta", isoBox("\xA9xyz", []byte("+52.37+004.89/"))))
+	return bytes.Join([][]byte{isoBox("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41")), moov, isoBox("mdat", make([]byte, 64))}, nil)
+}
+
+// ebmlTestElement encodes an EBML element with an eight byte size, or of
+// unknown size if content is nil
+func ebmlTestElement(id uint32, content ...[]byte) []byte {
+	var el []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(el) > 0 {
+			el = append(el, b)
+		}
+	}
+	if content == nil {
+		return append(el, 0xFF)
+	}
+	body := bytes.Join(content, nil)
+	size := len(body)
+	el = append(el, 0x01, 0, 0, 0, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+	return append(el, body...)
+}
+
+// encodeTestWebM builds a WebM file with one video track and clusters at
+// the given millisecond timestamps, each holding a block 40ms in
+func encodeTestWebM(codec string, stated time.Duration, clusters ...int) []byte {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(float64(stated/time.Millisecond)))
+	info := [][]byte{ebmlTestElement(webmTimescaleID, []byte{0x0F, 0x42, 0x40})}
+	if stated > 0 {
+		info = append(info, ebmlTestElement(webmDurationID, duration))
+	}
+	track := ebmlTestElement(webmTrackEntryID,
+		ebmlTestElement(webmTrackTypeID, []byte{1}),
+		ebmlTestElement(webmCodecID, []byte(codec)),
+		ebmlTestElement(webmVideoID, ebmlTestElement(webmPixelWidthID, []byte{0x01, 0x40}), ebmlTestElement(webmPixelHeightID, []byte{0xF0})))
+	segment := [][]byte{ebmlTestElement(webmInfoID, info...), ebmlTestElement(webmTracksID, track)}
+	for _, ms := range clusters {
+		// Streamed clusters are of unknown size
+		segment = append(segment, ebmlTestElement(webmClusterID), ebmlTestElement(webmTimestampID, []byte{byte(ms >> 8), byte(ms)}),
+			ebmlTestElement(webmSimpleBlockID, []byte{0x81, 0, 40, 0x80, 0xAA}))
+	}
+	header := ebmlTestElement(ebmlHeaderID, ebmlTestElement(ebmlDocTypeID, []byte("webm")))
+	return append(header, ebmlTestElement(webmSegmentID, segment...)...)
+}
+
+func TestVideoUpload(t *testing.T) {
+	originalConfig := AppConfig
+	AppConfig = DefaultConfig()
+	AppConfig.MaxVideoDuration = 10 * time.Second
+	defer func() { AppConfig = originalConfig }()
+
+	mp4 := encodeTestMP4("avc1", 640, 360, 4500*time.Millisecond)
+	tests := []struct {
+		name     string
+		data     []byte
+		filename string
+		wantErr  error
+	}{
+		{"mp4", mp4, "clip.mp4", nil},
+		{"webm", encodeTestWebM("V_VP9", 3*time.Second), "clip.webm", nil},
+		{"webm measured from clusters", encodeTestWebM("V_VP8", 0, 0, 2000, 9000), "clip.webm", nil},
+		{"hevc", encodeTestMP4("hev1", 640, 360, time.Second), "clip.mp4", errVideoCodec},
+		{"theora", encodeTestWebM("V_THEORA", time.Second), "clip.webm", errVideoCodec},
+		{"too long", encodeTestMP4("avc1", 640, 360, time.Minute), "clip.mp4", errVideoTooLong},
+		{"too long by clusters", encodeTestWebM("V_VP9", 0, 0, 11000), "clip.webm", errVideoTooLong},
+		{"no duration", encodeTestMP4("avc1", 640, 360, 0), "clip.mp4", errVideoCorrupt},
+		{"quicktime", append(isoBox("ftyp", []byte("qt  \x00\x00\x02\x00qt  ")), mp4[32:]...), "clip.mov", errImageType},
+		{"renamed quicktime", append(isoBox("ftyp", []byte("qt  \x00\x00\x02\x00qt  ")), mp4[32:]...), "clip.mp4", errImageType},
+		{"truncated", mp4[:100], "clip.mp4", errVideoCorrupt},
+	}
+	for _, tt := range tests {
+		info, err := ValidateImage(tt.data, tt.filename)
+		if err != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		} else if err == nil && (!isVideoType(info.MimeType) || info.Width == 0 || info.Decoded != nil) {
+			t.Errorf("%s: unexpected info %+v", tt.name, info)
+		}
+	}
+	if webm, _ := probeWebM(encodeTestWebM("V_VP8", 0, 0, 2000, 9000)); webm.Duration != 9040*time.Millisecond || webm.Width != 320 || webm.Height != 240 {
+		t.Errorf("Unexpected WebM info %+v", webm)
+	}
+	AppConfig.MaxVideoSize = len(mp4) - 1
+	if _, err := ValidateImage(mp4, "clip.mp4"); err != errVideoTooLarge {
+		t.Errorf("Expected oversized clip to be refused, got %v", err)
+	}
+	AppConfig.MaxVideoSize = DefaultConfig().MaxVideoSize
+
+	// Location data is blanked without moving anything in the file
+	info, err := ValidateImage(mp4, "clip.mp4")
+	if err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+	stripped, _, err := StripMetadata(mp4, info)
+	if err != nil || len(stripped) != len(mp4) || bytes.Contains(stripped, []byte("udta")) || bytes.Contains(stripped, []byte("+52.37")) {
+		t.Fatalf("Expected the user data box to be blanked (%v)", err)
+	}
+	if _, err := ValidateImage(stripped, "clip.mp4"); err != nil {
+		t.Errorf("Stripped clip no longer validates: %v", err)
+	}
+
+	// WebM tags become void elements of the same size, including a short
+	// one whose size takes a single byte
+	header := ebmlTestElement(ebmlHeaderID, ebmlTestElement(ebmlDocTypeID, []byte("webm")))
+	plain := encodeTestWebM("V_VP9", 0, 0, 1000)
+	tags := ebmlTestElement(webmTagsID, ebmlTestElement(0x7373, ebmlTestElement(0x67C8,
+		ebmlTestElement(0x45A3, []byte("LOCATION")), ebmlTestElement(0x4487, []byte("+52.37+004.89/")))))
+	tagged := append(bytes.Clone(header), ebmlTestElement(webmSegmentID, plain[len(header)+12:], tags, []byte{0x12, 0x54, 0xC3, 0x67, 0x80})...)
+	webmInfo, err := ValidateImage(tagged, "clip.webm")
+	if err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+	untagged, _, err := StripMetadata(tagged, webmInfo)
+	if err != nil || len(untagged) != len(tagged) || bytes.Contains(untagged, []byte("LOCATION")) || bytes.Contains(untagged, []byte("+52.37")) ||
+		bytes.Contains(untagged, []byte{0x12, 0x54, 0xC3, 0x67}) {
+		t.Fatalf("Expected the tags to be blanked (%v)", err)
+	}
+	if got, err := ValidateImage(untagged, "clip.webm"); err != nil || got.Width != 320 {
+		t.Errorf("Stripped WebM no longer validates: %v", err)
+	}
+
+	// A stand-in poster command that checks it got the clip and prints a PNG
+	dir := t.TempDir()
+	pngPath := filepath.Join(dir, "frame.png")
+	if err := ioutil.WriteFile(pngPath, encodeTestPNG(t, 640, 360), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "poster.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\ntest -s \"$2\" || exit 1\ncat "+pngPath+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	AppConfig.VideoPosterCommand = script + " -i {}"
+
+	setupImageTestDB(t)
+
+	info, err = ValidateImage(stripped, "clip.mp4")
+	if err != nil || info.Decoded == nil {
+		t.Fatalf("Expected a poster frame, got %+v (%v)", info, err)
+	}
+	img, err := StoreImage("user1", "clip.mp4", info, stripped)
+	if err != nil {
+		t.Fatalf("Unexpected error storing clip: %v", err)
+	}
+	if !img.IsVideo() || img.PosterURL() == "" || img.BlurHash == "" || len(img.Variants) != 0 {
+		t.Errorf("Expected a clip with a poster and no variants, got %+v", img)
+	}
+
+	if _, err := SetAvatar("user1", "clip.mp4", stripped); err != errAvatarType {
+		t.Errorf("Expected clips to be refused as avatars, got %v", err)
+	}
+}
+
+// fakeClamd serves the INSTREAM command like clamd, flagging streams that
+// contain the EICAR test string. Received streams are sent to received.
+func fakeClamd(t *testing.T, reply string, received chan<- []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			command := make([]byte, len("zINSTREAM\x00"))
+			if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+				conn.Close()
+				continue
+			}
+			var stream []byte
+			for {
+				var size [4]byte
+				if _, err := io.ReadFull(conn, size[:]); err != nil {
+					break
+				}
+				n := binary.BigEndian.Uint32(size[:])
+				if n == 0 {
+					break
+				}
+				chunk := make([]byte, n)
+				io.ReadFull(conn, chunk)
+				stream = append(stream, chunk...)
+			}
+			if received != nil {
+				received <- stream
+			}
+			switch {
+			case reply != "":
+				conn.Write([]byte(reply + "\x00"))
+			case bytes.Contains(stream, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")):
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			default:
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestScanUpload(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+	originalConfig := AppConfig
+	AppConfig = DefaultConfig()
+	defer func() { AppConfig = originalConfig }()
+	if _, err := mockDB.Exec("INSERT INTO users (id, username) VALUES ('user1', 'alice')"); err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	clean := encodeTestPNG(t, 300, 300)
+	if err := ScanUpload("user1", "clean.png", clean); err != nil {
+		t.Fatalf("Expected no scanning without an address, got %v", err)
+	}
+
+	received := make(chan []byte, 1)
+	AppConfig.ClamAVAddress = fakeClamd(t, "", received)
+	if err := ScanUpload("user1", "clean.png", clean); err != nil {
+		t.Errorf("Expected clean file to pass, got %v", err)
+	}
+	if stream := <-received; !bytes.Equal(stream, clean) {
+		t.Errorf("Expected the whole file to be streamed, got %d of %d bytes", len(stream), len(clean))
+	}
+	large := bytes.Repeat([]byte("forum"), 3*clamdChunkSize/5)
+	if err := ScanUpload("user1", "large.png", large); err != nil {
+		t.Errorf("Expected large file to pass, got %v", err)
+	}
+	if stream := <-received; !bytes.Equal(stream, large) {
+		t.Errorf("Expected a file of several chunks to be streamed whole, got %d of %d bytes", len(stream), len(large))
+	}
+	eicar := append(bytes.Clone(clean), `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`...)
+	if err := ScanUpload("user1", "eicar.png", eicar); err != errUploadInfected {
+		t.Errorf("Expected infected file to be refused, got %v", err)
+	}
+	<-received
+	if _, err := SetAvatar("user1", "eicar.png", eicar); err != errUploadInfected {
+		t.Errorf("Expected infected avatar to be refused, got %v", err)
+	}
+	<-received
+
+	// Scanner errors and an unreachable scanner depend on the fail mode
+	failing := fakeClamd(t, "INSTREAM size limit exceeded. ERROR", nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := listener.Addr().String()
+	listener.Close()
+	for _, address := range []string{failing, unreachable} {
+		AppConfig.ClamAVAddress = address
+		AppConfig.ClamAVFailMode = ScanFailClosed
+		if err := ScanUpload("user1", "clean.png", clean); err != errScanUnavailable {
+			t.Errorf("%s: expected upload to be refused when failing closed, got %v", address, err)
+		}
+		AppConfig.ClamAVFailMode = ScanFailOpen
+		if err := ScanUpload("user1", "clean.png", clean); err != nil {
+			t.Errorf("%s: expected upload to pass when failing open, got %v", address, err)
+		}
+	}
+	// Infected files are refused in either mode
+	AppConfig.ClamAVAddress = fakeClamd(t, "", nil)
+	if err := ScanUpload("user1", "eicar.png", eicar); err != errUploadInfected {
+		t.Errorf("Expected infected file to be refused when failing open, got %v", err)
+	}
+}
+
+func TestPostPage(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	originalGetUserIdFromSession := GetUserIdFromSession
+	originalRenderError := RenderError
+	defer func() {
+		GetUserIdFromSession = originalGetUserIdFromSession
+		RenderError = originalRenderError
+	}()
+	GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string {
+		if c, err := r.Cookie("session_id"); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	var renderedStatus int
+	RenderError = func(w http.ResponseWriter, r *http.Request, message string, statusCode int) {
+		renderedStatus = statusCode
+		http.Error(w, message, statusCode)
+	}
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, username) VALUES ('user1', 'alice'), ('user2', 'bob');
+		INSERT INTO posts (id, user_id, title, content, created_at) VALUES (1, 'user1', 'Harbour at dawn', 'Taken this morning', '2024-05-01 08:00:00');
+		INSERT INTO post_categories VALUES (1, 'general'), (1, 'lifestyle');
+		INSERT INTO likes (post_id, user_id, is_like) VALUES (1, 'user2', 1);
+		INSERT INTO images (id, user_id, hash, path, mime_type, width, height, frames, moderation, created_at)
+			VALUES (7, 'user1', 'abc', 'ab/abc.png', 'image/png', 1600, 900, 1, 'approved', '2024-05-01 08:00:00');
+		INSERT INTO images (id, user_id, hash, path, mime_type, width, height, frames, poster_path, moderation, created_at)
+			VALUES (8, 'user1', 'def', 'de/def.gif', 'image/gif', 400, 300, 12, 'de/def-poster.png', 'approved', '2024-05-01 08:00:00');
+		INSERT INTO image_variants (image_id, width, height, path) VALUES (7, 800, 450, 'ab/abc-w800.png');
+		INSERT INTO post_images (post_id, image_id, position, caption, alt_text) VALUES
+			(1, 7, 0, 'The harbour', 'Boats moored at a harbour at dawn'),
+			(1, 8, 1, 'Waves', 'Waves breaking on the pier');
+		INSERT INTO comments (id, post_id, user_id, content, parent_id, created_at) VALUES
+			(1, 1, 'user2', 'Lovely light', NULL, '2024-05-01 09:00:00'),
+			(2, 1, 'user1', 'Thanks!', 1, '2024-05-01 10:00:00');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	post, err := GetPostByID("1")
+	if err != nil {
+		t.Fatalf("Unexpected error fetching post: %v", err)
+	}
+	if post.Username != "alice" || post.LikeCount != 1 || post.Categories == "" || len(post.Images) != 2 ||
+		len(post.Comments) != 1 || len(post.Comments[0].Replies) != 1 || post.URL() != "/posts/1" {
+		t.Errorf("Post was not fully loaded: %+v", post)
+	}
+	if _, err := GetPostByID("2"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing post, got %v", err)
+	}
+
+	// The page is rendered from the real template
+	wd, _ := os.Getwd()
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	req := httptest.NewRequest(http.MethodGet, "/posts/1", nil)
+	rr := httptest.NewRecorder()
+	PostPageHandler(rr, req)
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the post page, got %d: %s", rr.Code, body)
+	}
+	// Gallery images are responsive like in the feed, and animations start
+	// from their poster
+	for _, want := range []string{"Harbour at dawn", `src="/media/7" srcset="/media/7/w800 800w, /media/7 1600w"`, `loading="lazy"`,
+		`src="/media/8/poster"`, `data-animation="/media/8"`, "Boats moored at a harbour at dawn", "Lovely light", "Thanks!", `id="comment-2"`, "general"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected the page to contain %q", want)
+		}
+	}
+
+	for _, path := range []string{"/posts/2", "/posts/abc", "/posts/1/extra", "/posts/"} {
+		renderedStatus = 0
+		PostPageHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if renderedStatus != http.StatusNotFound {
+			t.Errorf("%s: expected a 404 through RenderError, got %d", path, renderedStatus)
+		}
+	}
+
+	// Comments and reactions lead back to the post
+	form := url.Values{"post_id": {"1"}, "parent_id": {"1"}, "content": {"Where is this?"}}
+	req = httptest.NewRequest(http.MethodPost, "/comment", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "session_id", Value: "user2"})
+	rr = httptest.NewRecorder()
+	CommentHandler(rr, req)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/posts/1#comment-3" {
+		t.Errorf("Expected a redirect to the new comment, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	mockDB.Exec("INSERT INTO sessions VALUES ('session-user1', 'user1')")
+	like := func(path, field, id, accept string) *httptest.ResponseRecorder {
+		form := url.Values{field: {id}, "is_like": {"true"}}
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", accept)
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: "session-user1"})
+		rr := httptest.NewRecorder()
+		if path == "/like" {
+			LikeHandler(rr, req)
+		} else {
+			GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string { return "user1" }
+			CommentLikeHandler(rr, req)
+		}
+		return rr
+	}
+	if rr := like("/like", "post_id", "1", "text/html,application/xhtml+xml"); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/posts/1" {
+		t.Errorf("Expected a form like to redirect to the post, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := like("/like", "post_id", "1", "*/*"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"like_count":1`) {
+		t.Errorf("Expected scripts to get JSON, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := like("/comment/like", "comment_id", "2", "text/html"); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/posts/1#comment-2" {
+		t.Errorf("Expected a form comment like to redirect to the comment, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestEditPost(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	originalGetUserIdFromSession := GetUserIdFromSession
+	originalRenderError := RenderError
+	defer func() {
+		GetUserIdFromSession = originalGetUserIdFromSession
+		RenderError = originalRenderError
+	}()
+	GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string {
+		if c, err := r.Cookie("session_id"); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	var renderedMessage string
+	RenderError = func(w http.ResponseWriter, r *http.Request, message string, statusCode int) {
+		renderedMessage = message
+		http.Error(w, message, statusCode)
+	}
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, username) VALUES ('user1', 'alice'), ('user2', 'bob');
+		INSERT INTO posts (id, user_id, title, content, created_at) VALUES (1, 'user1', 'Harbour at dawn', 'Taken this morning', '2024-05-01 08:00:00');
+		INSERT INTO post_categories VALUES (1, 'general');
+		INSERT INTO images (id, user_id, hash, path, mime_type, frames, moderation, created_at)
+			VALUES (7, 'user1', 'abc', 'ab/abc.png', 'image/png', 1, 'approved', '2024-05-01 08:00:00'),
+			(8, 'user1', 'def', 'de/def.png', 'image/png', 1, 'approved', '2024-05-01 08:00:00');
+		INSERT INTO post_images (post_id, image_id, position, caption, alt_text) VALUES (1, 7, 0, 'The harbour', 'Boats at dawn'), (1, 8, 1, 'The pier', 'A pier');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	edit := func(userID string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/posts/1/edit", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if userID != "" {
+			req.AddCookie(&http.Cookie{Name: "session_id", Value: userID})
+		}
+		rr := httptest.NewRecorder()
+		PostPageHandler(rr, req)
+		return rr
+	}
+	unchanged := url.Values{
+		"title":           {"Harbour at dawn"},
+		"content":         {"Taken this morning"},
+		"category":        {"general"},
+		"alt_image_7":     {"Boats at dawn"},
+		"caption_image_7": {"The harbour"},
+		"alt_image_8":     {"A pier"},
+		"caption_image_8": {"The pier"},
+	}
+	revisions := func() (n int) {
+		mockDB.QueryRow("SELECT COUNT(*) FROM post_revisions").Scan(&n)
+		return n
+	}
+
+	// Only the author may edit
+	if rr := edit("user2", unchanged); rr.Code != http.StatusForbidden || renderedMessage != "not_owner" {
+		t.Errorf("Expected not_owner for another user, got %d %q", rr.Code, renderedMessage)
+	}
+	if rr := edit("", unchanged); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected a redirect to login, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/posts/1/edit", nil)
+	req.AddCookie(&http.Cookie{Name: "session_id", Value: "user1"})
+	rr := httptest.NewRecorder()
+	PostPageHandler(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `value="Harbour at dawn"`) || !strings.Contains(rr.Body.String(), `name="remove_image_8"`) {
+		t.Errorf("Expected the filled in edit form, got %d", rr.Code)
+	}
+
+	// Saving without changes keeps no revision
+	if rr := edit("user1", unchanged); rr.Code != http.StatusSeeOther || revisions() != 0 {
+		t.Errorf("Expected an unchanged edit to store nothing, got %d with %d revisions", rr.Code, revisions())
+	}
+
+	changed := url.Values{
+		"title":           {"Harbour at sunrise"},
+		"content":         {"Taken this morning"},
+		"category":        {"lifestyle", "general"},
+		"alt_image_7":     {"Fishing boats at sunrise"},
+		"caption_image_7": {"The harbour"},
+		"remove_image_8":  {"1"},
+	}
+	if rr := edit("user1", changed); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/posts/1" {
+		t.Fatalf("Expected the edit to redirect to the post, got %d %s", rr.Code, rr.Body.String())
+	}
+	var oldTitle, oldCategories string
+	var oldImages int
+	mockDB.QueryRow("SELECT title, categories FROM post_revisions WHERE post_id = 1").Scan(&oldTitle, &oldCategories)
+	mockDB.QueryRow("SELECT COUNT(*) FROM post_revision_images").Scan(&oldImages)
+	if revisions() != 1 || oldTitle != "Harbour at dawn" || oldCategories != "general" || oldImages != 2 {
+		t.Errorf("Expected the earlier version to be kept, got %d revisions: %q %q with %d images", revisions(), oldTitle, oldCategories, oldImages)
+	}
+
+	post, err := GetPostByID("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.Title != "Harbour at sunrise" || !post.Edited() || len(post.Images) != 1 || post.Images[0].AltText != "Fishing boats at sunrise" ||
+		!reflect.DeepEqual(splitCategories(post.Categories), []string{"general", "lifestyle"}) {
+		t.Errorf("Edit was not applied: %+v", post)
+	}
+
+	// The post links to the history, which shows what changed
+	rr = httptest.NewRecorder()
+	PostPageHandler(rr, httptest.NewRequest(http.MethodGet, "/posts/1", nil))
+	if !strings.Contains(rr.Body.String(), `href="/posts/1/history"`) {
+		t.Error("Expected the post page to carry the edited marker")
+	}
+	rr = httptest.NewRecorder()
+	PostPageHandler(rr, httptest.NewRequest(http.MethodGet, "/posts/1/history", nil))
+	body := rr.Body.String()
+	for _, want := range []string{"<del>dawn</del>", "<ins>sunrise</ins>", "<ins>lifestyle</ins>", "Images removed", `src="/media/8"`, "Fishing boats at sunrise", "by alice"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected the history to contain %q", want)
+		}
+	}
+
+	// An edit whose kept images cannot be quarantined is not saved at all
+	originalConfig := AppConfig
+	defer func() { AppConfig = originalConfig }()
+	AppConfig.QuarantineCategories = []string{"technology"}
+	mockDB.Exec(`CREATE TRIGGER fail_quarantine BEFORE UPDATE OF moderation ON images
+		BEGIN SELECT RAISE(ABORT, 'disk full'); END`)
+	moved := url.Values{
+		"title":           {"Harbour at sunrise"},
+		"content":         {"Taken this morning"},
+		"category":        {"technology"},
+		"alt_image_7":     {"Fishing boats at sunrise"},
+		"caption_image_7": {"The harbour"},
+	}
+	if rr := edit("user1", moved); rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a failed quarantine to fail the edit, got %d", rr.Code)
+	}
+	if post, _ := GetPostByID("1"); revisions() != 1 || !reflect.DeepEqual(splitCategories(post.Categories), []string{"general", "lifestyle"}) {
+		t.Errorf("Expected a failed edit to be rolled back, got %d revisions and categories %q", revisions(), post.Categories)
+	}
+	mockDB.Exec("DROP TRIGGER fail_quarantine")
+	if rr := edit("user1", moved); rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the edit to be saved, got %d %q", rr.Code, renderedMessage)
+	}
+	if img, _ := GetImage(7); img.Moderation != ImagePending {
+		t.Errorf("Expected the kept image to be held for review, got %q", img.Moderation)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	mockDB, _ := setupImageTestDB(t)
+
+	originalGetUserIdFromSession := GetUserIdFromSession
+	originalRenderError := RenderError
+	defer func() {
+		GetUserIdFromSession = originalGetUserIdFromSession
+		RenderError = originalRenderError
+	}()
+	GetUserIdFromSession = func(w http.ResponseWriter, r *http.Request) string {
+		if c, err := r.Cookie("session_id"); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	var renderedMessage string
+	RenderError = func(w http.ResponseWriter, r *http.Request, message string, statusCode int) {
+		renderedMessage = message
+		http.Error(w, message, statusCode)
+	}
+
+	_, err := mockDB.Exec(`
+		INSERT INTO users (id, username, role) VALUES ('user1', 'alice', 'user'), ('user2', 'bob', 'user'), ('mod1', 'carol', 'moderator');
+		INSERT INTO posts (id, user_id, title, content, image_path, created_at) VALUES (1, 'user1', 'Harbour at dawn', 'Taken this morning', '', '2024-05-01 08:00:00');
+		INSERT INTO post_categories VALUES (1, 'general');
+		INSERT INTO comments (id, post_id, user_id, content, parent_id, created_at) VALUES
+			(1, 1, 'user2', 'Lovely light', NULL, '2024-05-01 09:00:00'),
+			(2, 1, 'user1', 'Thanks!', 1, '2024-05-01 10:00:00'),
+			(3, 1, 'user2', 'Nobody answers this one', NULL, '2024-05-01 11:00:00');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to prepare mock data: %v", err)
+	}
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	post := func(userID, path string, form url.Values, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: userID})
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	view := func(userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/posts/1", nil)
+		if userID != "" {
+			req.AddCookie(&http.Cookie{Name: "session_id", Value: userID})
+		}
+		rr := httptest.NewRecorder()
+		PostPageHandler(rr, req)
+		return rr
+	}
+
+	// A comment with replies stays as a tombstone, one without disappears
+	if rr := post("user1", "/comment/delete", url.Values{"comment_id": {"3"}}, CommentDeleteHandler); rr.Code != http.StatusForbidden || renderedMessage != "not_owner" {
+		t.Errorf("Expected not_owner for someone else's comment, got %d %q", rr.Code, renderedMessage)
+	}
+	for _, id := range []string{"1", "3"} {
+		if rr := post("user2", "/comment/delete", url.Values{"comment_id": {id}}, CommentDeleteHandler); rr.Code != http.StatusSeeOther {
+			t.Errorf("Expected comment %s to be deleted, got %d", id, rr.Code)
+		}
+	}
+	loaded, err := GetPostByID("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Comments) != 1 || !loaded.Comments[0].Deleted || loaded.Comments[0].Content != "[deleted]" ||
+		loaded.Comments[0].Username != "[deleted]" || len(loaded.Comments[0].Replies) != 1 {
+		t.Errorf("Expected only a tombstone holding the reply, got %+v", loaded.Comments)
+	}
+	if body := view("").Body.String(); strings.Contains(body, "Lovely light") || !strings.Contains(body, "[deleted]") || !strings.Contains(body, "Thanks!") {
+		t.Error("Expected the page to show the tombstone with its reply")
+	}
+	feed := httptest.NewRecorder()
+	FilterHandler(feed, httptest.NewRequest(http.MethodGet, "/filter?category=general", nil))
+	if body := feed.Body.String(); feed.Code != http.StatusOK || strings.Contains(body, "Lovely light") || !strings.Contains(body, "[deleted]") || !strings.Contains(body, "Thanks!") {
+		t.Errorf("Expected the filtered feed to show the tombstone with its reply, got %d", feed.Code)
+	}
+
+	// Deleted posts leave the feed and answer 410, except to moderators
+	if rr := post("user2", "/posts/1/delete", nil, PostPageHandler); rr.Code != http.StatusForbidden || renderedMessage != "not_owner" {
+		t.Errorf("Expected not_owner for someone else's post, got %d %q", rr.Code, renderedMessage)
+	}
+	if rr := post("user1", "/posts/1/delete", nil, PostPageHandler); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/" {
+		t.Fatalf("Expected the author to delete the post, got %d", rr.Code)
+	}
+	if rr := view("user2"); rr.Code != http.StatusGone || renderedMessage != "post_deleted" {
+		t.Errorf("Expected 410 for a deleted post, got %d %q", rr.Code, renderedMessage)
+	}
+	if rr := post("user1", "/posts/1/edit", url.Values{"title": {"x"}}, PostPageHandler); rr.Code != http.StatusGone {
+		t.Errorf("Expected a deleted post not to be editable, got %d", rr.Code)
+	}
+	if rr := view("mod1"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "restore_post") {
+		t.Errorf("Expected moderators to see the deleted post with a restore action, got %d", rr.Code)
+	}
+	var visible int
+	mockDB.QueryRow("SELECT COUNT(*) FROM posts WHERE deleted_at IS NULL").Scan(&visible)
+	if visible != 0 {
+		t.Error("Expected the post to be soft-deleted")
+	}
+
+	// Moderators list deleted content and restore it
+	req := httptest.NewRequest(http.MethodGet, "/moderation/deleted", nil)
+	req.AddCookie(&http.Cookie{Name: "session_id", Value: "mod1"})
+	rr := httptest.NewRecorder()
+	DeletedContentHandler(rr, req)
+	if body := rr.Body.String(); !strings.Contains(body, "Harbour at dawn") || !strings.Contains(body, "Nobody answers this one") {
+		t.Errorf("Expected the deleted post and comment to be listed, got %d", rr.Code)
+	}
+	if rr := post("user1", "/moderation/deleted", url.Values{"action": {"restore_post"}, "id": {"1"}}, DeletedContentHandler); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected only moderators to restore, got %d", rr.Code)
+	}
+	if rr := post("mod1", "/moderation/deleted", url.Values{"action": {"restore_post"}, "id": {"1"}, "next": {"post"}}, DeletedContentHandler); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/posts/1" {
+		t.Errorf("Expected the post to be restored, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	post("mod1", "/moderation/deleted", url.Values{"action": {"restore_comment"}, "id": {"1"}}, DeletedContentHandler)
+	if rr := view(""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Lovely light") {
+		t.Errorf("Expected the restored post and comment to be shown, got %d", rr.Code)
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string // Substrings of the rendered HTML
+		reject []string // Substrings it must not contain
+	}{
+		{"emphasis", "Some *soft* and **strong** words and snake_case_names",
+			[]string{"<em>soft</em>", "<strong>strong</strong>", "snake_case_names"}, nil},
+		{"lists", "- one\n- two\n  - nested\n\n3. three\n4. four",
+			[]string{"<ul>\n<li>one\n</li>", "<ul>\n<li>nested", `<ol start="3">`, "<li>four"}, []string{"<p>"}},
+		{"fenced code", "```go\nif a < b {\n\treturn \"*x*\"\n}\n```",
+			[]string{`<pre><code class="language-go">if a &lt; b {`, "return &#34;*x*&#34;"}, []string{"<em>"}},
+		{"indented code", "    <b>raw</b>", []string{"<pre><code>&lt;b&gt;raw&lt;/b&gt;"}, nil},
+		{"code span", "Use `<br>` here", []string{"<code>&lt;br&gt;</code>"}, []string{"<br>"}},
+		{"headings", "# Title\n\nSub\n---", []string{"<h3>Title</h3>", "<h4>Sub</h4>"}, []string{"<h1>"}},
+		{"quote", "> quoted\ntext", []string{"<blockquote>\n<p>quoted\ntext</p>"}, nil},
+		{"link", `[docs](https://go.dev/doc "Go docs")`,
+			[]string{`<a href="https://go.dev/doc" title="Go docs" rel="nofollow noopener ugc">docs</a>`}, nil},
+		{"autolink", "See https://example.com/a_(b)). Or www.example.org, or <me@example.com>",
+			[]string{`<a href="https://example.com/a_(b)" rel="nofollow noopener ugc">https://example.com/a_(b)</a>).`,
+				`<a href="http://www.example.org" rel="nofollow noopener ugc">www.example.org</a>,`,
+				`<a href="mailto:me@example.com"`}, nil},
+		{"image as link", "![a cat](/media/1)", []string{`<a href="/media/1" rel="nofollow noopener ugc">a cat</a>`}, []string{"<img"}},
+		{"raw html", `<script>alert(1)</script><img src=x onerror="alert(1)">`,
+			[]string{"&lt;script&gt;", "&lt;img"}, []string{"<script", "<img"}},
+		{"javascript link", "[x](javascript:alert(1)) [y](&#106;avascript:alert(1)) [z](JAVA\tSCRIPT:x) <javascript:alert(1)>",
+			nil, []string{"href", "<a"}},
+	}
+	for _, tt := range tests {
+		got := string(RenderMarkdown(tt.source))
+		for _, want := range tt.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: expected %q in %q", tt.name, want, got)
+			}
+		}
+		for _, reject := range tt.reject {
+			if strings.Contains(got, reject) {
+				t.Errorf("%s: did not expect %q in %q", tt.name, reject, got)
+			}
+		}
+	}
+
+	// The sanitizer keeps only allowed elements and attributes
+	sanitizeTests := []struct {
+		name  string
+		dirty string
+		want  string
+	}{
+		{"mixed",
+			`<p onclick="x">a<a href=" JaVaScRiPt:alert(1)">b</a><a href="/x" target="_blank">c<a href="/y">d</a></a>` +
+				`<code class="language-go x">e</code><style>p{}</style><!-- note --><div>f</div></em></p><ol start="2x"><li>g`,
+			`<p>a<a rel="nofollow noopener ugc">b</a><a href="/x" rel="nofollow noopener ugc">cd</a><code>e</code>f</p><ol><li>g</li></ol>`},
+		{"entity-encoded colon", `<a href="javascript&#58;alert(1)">x</a>`, `<a rel="nofollow noopener ugc">x</a>`},
+		{"named entity colon", `<a href="javascript&colon;alert(1)">x</a>`, `<a rel="nofollow noopener ugc">x</a>`},
+		{"entity-encoded scheme", `<a href="&#106;&#97;vascript:alert(1)">x</a>`, `<a rel="nofollow noopener ugc">x</a>`},
+		{"encoded tab in scheme", `<a href="jav&#x09;ascript:alert(1)">x</a>`, `<a rel="nofollow noopener ugc">x</a>`},
+		{"unclosed script", `a<script>alert(1)`, `a`},
+		{"unterminated script tag", `a<script`, `a`},
+		{"script with lookalike end tag", `a<SCRIPT src=//evil>alert(1)</scriptx><em>c`, `a<em>c</em>`},
+		{"attributes outside the allow-list", `<p style="color:red" onmouseover=alert(1) class="x" id=y>t</p>`, `<p>t</p>`},
+		{"link attributes", `<a href="/x" onclick="alert(1)" title='t' target=_blank>y</a>`, `<a href="/x" title="t" rel="nofollow noopener ugc">y</a>`},
+		{"code attributes", `<code class="language-go" onload="x">c</code>`, `<code class="language-go">c</code>`},
+		{"unclosed comment", `a<!-- <script>alert(1)</script>`, `a`},
+		{"nested link", `<a href="/1">x<a href="/2">y</a>z</a>`, `<a href="/1" rel="nofollow noopener ugc">xy</a>z`},
+		{"link nested deeper", `<a href="/1"><em><a href="/2">y</a></em></a>`, `<a href="/1" rel="nofollow noopener ugc"><em>y</em></a>`},
+	}
+	for _, tt := range sanitizeTests {
+		if got := string(sanitizeHTML(tt.dirty)); got != tt.want {
+			t.Errorf("%s: expected sanitized HTML %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// errHEICUnsupported is returned for HEIC uploads when no converter is
+// configured. Its message is the key of its ErrorMessages entry.
+var errHEICUnsupported = errors.New("image_heic_unsupported")
+
+// heicConvertTimeout bounds how long the external converter may run
+const heicConvertTimeout = 30 * time.Second
+
+// heicBrands are the ftyp brands used by HEIC and HEIF still images
+var heicBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"}
+
+// isHEIC reports whether data starts with the ftyp box of a HEIC file
+func isHEIC(data []byte) bool {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	brand := string(data[8:12])
+	for _, b := range heicBrands {
+		if brand != b {
+			continue
+		}
+		if b != "mif1" && b != "msf1" {
+			return true
+		}
+		// Generic HEIF brands are shared with AVIF, so look for a HEIC
+		// brand among the compatible ones
+		size := int(binary.BigEndian.Uint32(data[0:4]))
+		if size > len(data) {
+			size = len(data)
+		}
+		return bytes.Contains(data[8:size], []byte("heic")) || bytes.Contains(data[8:size], []byte("heix"))
+	}
+	return false
+}
+
+// isoBoxes calls fn with the type and content of each ISO base media box in data
+func isoBoxes(data []byte, fn func(boxType string, content []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return errImageCorrupt
+		}
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0: // Box extends to the end of the file
+			size = uint64(len(data))
+		case 1: // 64-bit size follows the type
+			if len(data) < 16 {
+				return errImageCorrupt
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return errImageCorrupt
+		}
+		if err := fn(boxType, data[header:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// heicConfig reads the dimensions of a HEIC file from the image spatial
+// extents (ispe) properties in its meta box. Files made of tiles carry one
+// per tile plus one for the whole image, so the largest is used.
+func heicConfig(data []byte) (image.Config, error) {
+	var width, height int
+	var walk func(boxType string, content []byte) error
+	walk = func(boxType string, content []byte) error {
+		switch boxType {
+		case "meta":
+			if len(content) < 4 {
+				return errImageCorrupt
+			}
+			return isoBoxes(content[4:], walk) // Skip version and flags
+		case "iprp", "ipco":
+			return isoBoxes(content, walk)
+		case "ispe":
+			if len(content) < 12 {
+				return errImageCorrupt
+			}
+			w := int(binary.BigEndian.Uint32(content[4:8]))
+			h := int(binary.BigEndian.Uint32(content[8:12]))
+			if w*h > width*height {
+				width, height = w, h
+			}
+		}
+		return nil
+	}
+	if err := isoBoxes(data, walk); err != nil {
+		return image.Config{}, err
+	}
+	if width == 0 || height == 0 {
+		return image.Config{}, errImageCorrupt
+	}
+	return image.Config{ColorModel: color.YCbCrModel, Width: width, Height: height}, nil
+}
+
+// decodeHEIC decodes a HEIC file with the converter configured in
+// FORUM_HEIC_CONVERT_COMMAND, which reads the file on standard input and
+// writes a PNG or JPEG to standard output. HEVC is patent-encumbered and
+// not part of the standard library, so without a converter HEIC uploads
+// are turned away with an explanation.
+func decodeHEIC(data []byte) (image.Image, error) {
+	args := strings.Fields(AppConfig.HEICConvertCommand)
+	if len(args) == 0 {
+		return nil, errHEICUnsupported
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), heicConvertTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("converting HEIC: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// The converter's output is checked like any other upload
+	converted := stdout.Bytes()
+	config, format, err := image.DecodeConfig(bytes.NewReader(converted))
+	if err != nil || (format != "png" && format != "jpeg") {
+		return nil, errImageCorrupt
+	}
+	if config.Width > AppConfig.MaxImageWidth || config.Height > AppConfig.MaxImageHeight ||
+		config.Width*config.Height > AppConfig.MaxImagePixels {
+		return nil, errImageDimensions
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(converted))
+	if err != nil {
+		return nil, errImageCorrupt
+	}
+	return decoded, nil
+}
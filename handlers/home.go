@@ -13,7 +13,7 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	// Query to fetch all posts along with user info, categories, like counts, and comments
 	rows, err := db.Query(`
 		SELECT p.id, p.title, p.content, p.image_path, GROUP_CONCAT(pc.category) as categories, 
-		u.username, p.created_at, 
+		p.user_id, u.username, p.created_at, p.edited_at,
 		COALESCE(l.like_count, 0) AS like_count,
 		COALESCE(l.dislike_count, 0) AS dislike_count
 		FROM posts p
@@ -26,6 +26,7 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 			FROM likes
 			GROUP BY post_id
 		) l ON p.id = l.post_id
+		WHERE p.deleted_at IS NULL
 		GROUP BY p.id, p.title, p.content, u.username, p.created_at
 		ORDER BY p.created_at DESC`)
 	if err != nil {
@@ -39,6 +40,7 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var post Post
 		var createdAt time.Time
+		var editedAt sql.NullTime
 		var categories sql.NullString
 		err := rows.Scan(
 			&post.ID,
@@ -46,8 +48,10 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 			&post.Content,
 			&post.ImagePath,
 			&categories,
+			&post.UserID,
 			&post.Username,
 			&createdAt,
+			&editedAt,
 			&post.LikeCount,
 			&post.DislikeCount,
 		)
@@ -64,6 +68,8 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		// Set the CreatedAt field and the human-readable time
 		post.CreatedAt = createdAt
 		post.CreatedAtHuman = TimeAgo(createdAt)
+		setEditedAt(&post, editedAt)
+		loadPostImages(&post)
 
 		// Fetch comments for this post
 		comments, err := GetCommentsForPost(post.ID)
@@ -76,6 +82,14 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		posts = append(posts, post)
 	}
 
+	// Collect the notices left by PostHandler
+	var warnings []string
+	for _, key := range r.URL.Query()["warning"] {
+		if message, ok := postWarnings[key]; ok {
+			warnings = append(warnings, message)
+		}
+	}
+
 	// Render the index page with posts
 	tmpl, err := template.ParseFiles("templates/home.html")
 	if err != nil {
@@ -84,7 +98,12 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tmpl.Execute(w, map[string]interface{}{
-		"Posts":      posts,
-		"IsLoggedIn": userID != "",
+		"Posts":               posts,
+		"IsLoggedIn":          userID != "",
+		"IsModerator":         isModerator(userID),
+		"UnreadNotifications": UnreadNotificationCount(userID),
+		"ImageSlots":          imageSlots(),
+		"ImageAccept":         imageAccept(),
+		"Warnings":            warnings,
 	})
 }
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"image"
+	_ "image/gif" // Register decoders used by image.DecodeConfig and image.Decode
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+// Validation errors. Each message is the key of its ErrorMessages entry.
+var (
+	errImageEmpty      = errors.New("image_empty")
+	errImageTooLarge   = errors.New("image_too_large")
+	errImageType       = errors.New("image_invalid_type")
+	errImageMismatch   = errors.New("image_type_mismatch")
+	errImageCorrupt    = errors.New("image_corrupt")
+	errImageDimensions = errors.New("image_dimensions_too_large")
+)
+
+// ImageInfo describes an upload that passed validation
+type ImageInfo struct {
+	MimeType string
+	Width    int
+	Height   int
+	Frames   int         // Number of frames, more than one for animated GIFs
+	Decoded  image.Image // Decoded pixels, reused for resizing
+	PHash    string      // Perceptual hash of Decoded, once computed
+}
+
+// ValidateImage checks an upload by its content rather than its name. The
+// magic bytes must match an accepted format and the claimed extension, the
+// dimensions must be within the configured limits, and the whole image
+// must decode if the format has a decoder. Dimensions are checked before
+// decoding so oversized images are rejected without allocating their pixels.
+func ValidateImage(data []byte, filename string) (ImageInfo, error) {
+	if len(data) == 0 {
+		return ImageInfo{}, errImageEmpty
+	}
+	if len(data) > maxImageSize {
+		return ImageInfo{}, errImageTooLarge
+	}
+
+	claimed, ok := formatByExtension(filepath.Ext(filename))
+	if !ok {
+		return ImageInfo{}, errImageType
+	}
+	actual, ok := sniffImageFormat(data)
+	if !ok {
+		return ImageInfo{}, errImageType
+	}
+	if actual.MimeType != claimed.MimeType {
+		return ImageInfo{}, errImageMismatch
+	}
+
+	config, err := actual.DecodeConfig(data)
+	if err != nil {
+		return ImageInfo{}, uploadError(err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return ImageInfo{}, errImageCorrupt
+	}
+	if config.Width > AppConfig.MaxImageWidth || config.Height > AppConfig.MaxImageHeight ||
+		config.Width*config.Height > AppConfig.MaxImagePixels {
+		return ImageInfo{}, errImageDimensions
+	}
+
+	// Animations are checked frame by frame without decoding them
+	frames := 1
+	if actual.MimeType == "image/gif" {
+		if frames, err = validateGIF(data); err != nil {
+			return ImageInfo{}, err
+		}
+	}
+
+	// Clips are checked through their container; their only pixels are the
+	// poster frame, if one can be extracted
+	if actual.Probe != nil {
+		if err := validateVideo(data, actual); err != nil {
+			return ImageInfo{}, uploadError(err)
+		}
+		return ImageInfo{MimeType: actual.MimeType, Width: config.Width, Height: config.Height, Frames: 1, Decoded: videoPoster(data, actual)}, nil
+	}
+
+	// For GIFs this decodes only the first frame. Formats without a
+	// decoder were checked structurally by DecodeConfig.
+	var decoded image.Image
+	if actual.Decode != nil {
+		decoded, err = actual.Decode(data)
+		if err != nil {
+			return ImageInfo{}, uploadError(err)
+		}
+		if actual.StoreAs != "" {
+			// Converters may apply rotation, so trust the decoded size
+			bounds := decoded.Bounds()
+			config.Width, config.Height = bounds.Dx(), bounds.Dy()
+		}
+	}
+
+	return ImageInfo{MimeType: actual.MimeType, Width: config.Width, Height: config.Height, Frames: frames, Decoded: decoded}, nil
+}
+
+// uploadError passes through errors that have an ErrorMessages entry and
+// reports anything else as a corrupt image
+func uploadError(err error) error {
+	if _, ok := ErrorMessages[err.Error()]; ok {
+		return err
+	}
+	log.Printf("Error decoding upload: %v", err)
+	return errImageCorrupt
+}
+
+// renderUploadError renders the ErrorMessages entry for a validation error,
+// or a generic server error for anything else.
+func renderUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	if data, ok := ErrorMessages[err.Error()]; ok {
+		RenderError(w, r, err.Error(), data.StatusCode)
+		return
+	}
+	log.Printf("Error processing upload: %v", err)
+	RenderError(w, r, "server_error", http.StatusInternalServerError)
+}
@@ -22,6 +22,10 @@ func LikeHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check if the user is logged in
 	session, err := r.Cookie("session_id")
+	if err != nil && wantsHTML(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		// User is not logged in, return a custom JSON response
 		w.Header().Set("Content-Type", "application/json")
@@ -50,6 +54,21 @@ func LikeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	postID := r.FormValue("post_id")
+	postIDInt, err := strconv.Atoi(postID)
+	if err != nil {
+		http.Error(w, "Invalid post ID", http.StatusBadRequest)
+		return
+	}
+	if deleted, err := postDeleted(postIDInt); err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	} else if deleted {
+		http.Error(w, "This post was deleted", http.StatusGone)
+		return
+	}
 	isLike, err := strconv.ParseBool(r.FormValue("is_like"))
 	if err != nil {
 		http.Error(w, "Invalid like/dislike value", http.StatusBadRequest)
@@ -107,6 +126,12 @@ func LikeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Forms submitted without JavaScript go back to the post
+	if wantsHTML(r) {
+		http.Redirect(w, r, postURL(postIDInt), http.StatusSeeOther)
+		return
+	}
+
 	// Return the updated counts
 	response := LikeResponse{
 		Success:      true,
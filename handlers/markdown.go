@@ -0,0 +1,868 @@
+package handlers
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Posts and comments are written in a subset of CommonMark: paragraphs,
+// headings, block quotes, lists, thematic breaks, fenced and indented
+// code blocks, emphasis, code spans, links and autolinks. Raw HTML is
+// shown as text and images are rendered as links. Bare URLs are linked
+// as well.
+
+// headingOffset moves Markdown headings below the headings of the page,
+// so "#" is rendered as <h3>
+const headingOffset = 2
+
+// maxLinkScan bounds the search for the end of a link, and maxLinkWork
+// the bytes searched for links in a paragraph, which keeps text with many
+// unmatched brackets from taking quadratic time. Once a paragraph has used
+// up maxLinkWork its remaining brackets are shown as text.
+const (
+	maxLinkScan = 4096
+	maxLinkWork = 64 * maxLinkScan
+)
+
+// maxBlockDepth bounds the nesting of block quotes and lists. Anything
+// nested deeper is shown as text.
+const maxBlockDepth = 16
+
+var (
+	mdFence      = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})(.*)$")
+	mdBreak      = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdSetext     = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	mdListMarker = regexp.MustCompile(`^( {0,3})([-+*]|[0-9]{1,9}[.)])([ \t]+|$)`)
+	mdEntity     = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+	mdAutolink   = regexp.MustCompile(`^<([A-Za-z][A-Za-z0-9+.-]{1,31}:[^\s<>]*)>`)
+	mdEmailLink  = regexp.MustCompile(`^<([A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*)>`)
+	mdCodeClass  = regexp.MustCompile(`^language-[A-Za-z0-9_+#.-]+$`)
+)
+
+// RenderMarkdown renders Markdown source to sanitized HTML
+func RenderMarkdown(source string) template.HTML {
+	return sanitizeHTML(renderMarkdown(source))
+}
+
+// ContentHTML returns the content of the post rendered from Markdown
+func (p Post) ContentHTML() template.HTML {
+	return RenderMarkdown(p.Content)
+}
+
+// ContentHTML returns the content of the comment rendered from Markdown
+func (c Comment) ContentHTML() template.HTML {
+	return RenderMarkdown(c.Content)
+}
+
+// renderMarkdown converts Markdown source to HTML. Everything taken from
+// the source is escaped, but the result is still meant to be sanitized.
+func renderMarkdown(source string) string {
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	source = strings.ReplaceAll(source, "\r", "\n")
+	lines := strings.Split(source, "\n")
+	for i, line := range lines {
+		lines[i] = expandLeadingTabs(line)
+	}
+	var out strings.Builder
+	renderBlocks(&out, lines, false, 0)
+	return out.String()
+}
+
+// expandLeadingTabs replaces tabs in the indentation of a line with spaces,
+// with tab stops every four columns
+func expandLeadingTabs(line string) string {
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			b.WriteByte(' ')
+		case '\t':
+			b.WriteString(strings.Repeat(" ", 4-b.Len()%4))
+		default:
+			return b.String() + line[i:]
+		}
+	}
+	return b.String()
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// openFence returns the fence and info string of a line opening a fenced
+// code block
+func openFence(line string) (indent int, fence, info string, ok bool) {
+	m := mdFence.FindStringSubmatch(line)
+	if m == nil {
+		return 0, "", "", false
+	}
+	info = strings.TrimSpace(m[3])
+	if m[2][0] == '`' && strings.Contains(info, "`") {
+		return 0, "", "", false
+	}
+	return len(m[1]), m[2], info, true
+}
+
+// closesFence reports whether a line ends the code block opened by fence
+func closesFence(line, fence string) bool {
+	if indentOf(line) > 3 {
+		return false
+	}
+	t := strings.TrimSpace(line)
+	return len(t) >= len(fence) && strings.Trim(t, fence[:1]) == ""
+}
+
+// atxHeading returns the level and text of a "#" heading
+func atxHeading(line string) (int, string, bool) {
+	if indentOf(line) > 3 {
+		return 0, "", false
+	}
+	t := strings.TrimLeft(line, " ")
+	level := 0
+	for level < len(t) && t[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || (level < len(t) && t[level] != ' ' && t[level] != '\t') {
+		return 0, "", false
+	}
+	text := strings.TrimSpace(t[level:])
+	// Drop an optional closing sequence of #s
+	if trimmed := strings.TrimRight(text, "#"); trimmed == "" {
+		text = ""
+	} else if trimmed != text && (strings.HasSuffix(trimmed, " ") || strings.HasSuffix(trimmed, "\t")) {
+		text = strings.TrimSpace(trimmed)
+	}
+	return level, text, true
+}
+
+// quoteLine returns a line of a block quote without its marker
+func quoteLine(line string) (string, bool) {
+	if indentOf(line) > 3 {
+		return "", false
+	}
+	t := strings.TrimLeft(line, " ")
+	if !strings.HasPrefix(t, ">") {
+		return "", false
+	}
+	t = t[1:]
+	if strings.HasPrefix(t, " ") {
+		t = t[1:]
+	}
+	return t, true
+}
+
+// listItem is the first line of a list item
+type listItem struct {
+	ordered bool
+	marker  byte // Bullet character, or the delimiter after the number
+	start   int  // Number of an ordered item
+	offset  int  // Column the content of the item starts at
+	content string
+}
+
+// listItemStart parses the marker of a list item
+func listItemStart(line string) (listItem, bool) {
+	if mdBreak.MatchString(line) {
+		return listItem{}, false
+	}
+	m := mdListMarker.FindStringSubmatch(line)
+	if m == nil {
+		return listItem{}, false
+	}
+	item := listItem{marker: m[2][len(m[2])-1]}
+	if len(m[2]) > 1 || (m[2][0] >= '0' && m[2][0] <= '9') {
+		item.ordered = true
+		item.start, _ = strconv.Atoi(m[2][:len(m[2])-1])
+	}
+	rest := line[len(m[0]):]
+	switch spaces := len(m[3]); {
+	case rest == "" && strings.TrimSpace(m[3]) == "":
+		item.offset = len(m[1]) + len(m[2]) + 1
+	case spaces > 4:
+		// The content is an indented code block
+		item.offset = len(m[1]) + len(m[2]) + 1
+		rest = line[item.offset:]
+	default:
+		item.offset = len(m[0])
+	}
+	item.content = rest
+	return item, true
+}
+
+func isListItem(line string) bool {
+	_, ok := listItemStart(line)
+	return ok
+}
+
+// interruptsParagraph reports whether a line starts a block that ends a
+// paragraph running into it
+func interruptsParagraph(line string) bool {
+	if _, _, _, ok := openFence(line); ok {
+		return true
+	}
+	if _, _, ok := atxHeading(line); ok {
+		return true
+	}
+	if _, ok := quoteLine(line); ok {
+		return true
+	}
+	if mdBreak.MatchString(line) {
+		return true
+	}
+	item, ok := listItemStart(line)
+	return ok && !isBlank(item.content) && (!item.ordered || item.start == 1)
+}
+
+// renderBlocks renders a sequence of lines as block elements. In tight
+// lists paragraphs are written without <p> tags.
+func renderBlocks(out *strings.Builder, lines []string, tight bool, depth int) {
+	if depth > maxBlockDepth {
+		out.WriteString("<p>" + html.EscapeString(strings.TrimSpace(strings.Join(lines, "\n"))) + "</p>\n")
+		return
+	}
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if isBlank(line) {
+			i++
+			continue
+		}
+
+		if indent, fence, info, ok := openFence(line); ok {
+			i++
+			var code []string
+			for i < len(lines) && !closesFence(lines[i], fence) {
+				l := lines[i]
+				code = append(code, l[min(indent, indentOf(l)):])
+				i++
+			}
+			i++ // The closing fence, if any
+			language := ""
+			if fields := strings.Fields(info); len(fields) > 0 {
+				language = unescapeMarkdown(fields[0])
+			}
+			writeCodeBlock(out, code, language)
+			continue
+		}
+
+		if indentOf(line) >= 4 {
+			var code []string
+			for i < len(lines) && (isBlank(lines[i]) || indentOf(lines[i]) >= 4) {
+				code = append(code, lines[i][min(4, indentOf(lines[i])):])
+				i++
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			writeCodeBlock(out, code, "")
+			continue
+		}
+
+		if mdBreak.MatchString(line) {
+			out.WriteString("<hr>\n")
+			i++
+			continue
+		}
+
+		if level, text, ok := atxHeading(line); ok {
+			writeHeading(out, level, text)
+			i++
+			continue
+		}
+
+		if _, ok := quoteLine(line); ok {
+			var quoted []string
+			for i < len(lines) {
+				if q, ok := quoteLine(lines[i]); ok {
+					quoted = append(quoted, q)
+				} else if !isBlank(lines[i]) && len(quoted) > 0 && !isBlank(quoted[len(quoted)-1]) && !interruptsParagraph(lines[i]) {
+					quoted = append(quoted, lines[i]) // Lazy continuation
+				} else {
+					break
+				}
+				i++
+			}
+			out.WriteString("<blockquote>\n")
+			renderBlocks(out, quoted, false, depth+1)
+			out.WriteString("</blockquote>\n")
+			continue
+		}
+
+		if _, ok := listItemStart(line); ok {
+			i = renderList(out, lines, i, depth)
+			continue
+		}
+
+		// Anything else is a paragraph, which may turn out to be a heading
+		// underlined with = or -
+		var para []string
+		heading := 0
+		for i < len(lines) && !isBlank(lines[i]) {
+			if len(para) > 0 {
+				if m := mdSetext.FindStringSubmatch(lines[i]); m != nil {
+					heading = 2
+					if m[1][0] == '=' {
+						heading = 1
+					}
+					i++
+					break
+				}
+				if interruptsParagraph(lines[i]) {
+					break
+				}
+			}
+			para = append(para, strings.TrimLeft(lines[i], " "))
+			i++
+		}
+		text := strings.TrimRight(strings.Join(para, "\n"), " \t")
+		switch {
+		case heading > 0:
+			writeHeading(out, heading, text)
+		case tight:
+			out.WriteString(renderInline(text, true))
+			out.WriteString("\n")
+		default:
+			out.WriteString("<p>")
+			out.WriteString(renderInline(text, true))
+			out.WriteString("</p>\n")
+		}
+	}
+}
+
+// renderList renders the list starting at lines[i] and returns the index
+// of the first line after it
+func renderList(out *strings.Builder, lines []string, i, depth int) int {
+	first, _ := listItemStart(lines[i])
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		item, ok := listItemStart(lines[i])
+		if !ok || item.ordered != first.ordered || item.marker != first.marker {
+			break
+		}
+		body := []string{item.content}
+		i++
+		for i < len(lines) {
+			line := lines[i]
+			switch {
+			case isBlank(line):
+				body = append(body, "")
+			case indentOf(line) >= item.offset:
+				body = append(body, line[item.offset:])
+			case isListItem(line):
+				goto itemDone
+			case !isBlank(body[len(body)-1]) && !interruptsParagraph(line):
+				body = append(body, strings.TrimLeft(line, " ")) // Lazy continuation
+			default:
+				goto itemDone
+			}
+			i++
+		}
+	itemDone:
+		// Blank lines after the item separate it from the next one
+		trailing := 0
+		for len(body) > 1 && isBlank(body[len(body)-1]) {
+			body = body[:len(body)-1]
+			trailing++
+		}
+		if trailing > 0 && i < len(lines) {
+			if next, ok := listItemStart(lines[i]); ok && next.ordered == first.ordered && next.marker == first.marker {
+				loose = true
+			}
+		}
+		if hasInnerBlankLine(body) {
+			loose = true
+		}
+		items = append(items, body)
+	}
+
+	tag := "ul"
+	if first.ordered {
+		tag = "ol"
+	}
+	out.WriteString("<" + tag)
+	if first.ordered && first.start != 1 {
+		out.WriteString(` start="` + strconv.Itoa(first.start) + `"`)
+	}
+	out.WriteString(">\n")
+	for _, body := range items {
+		out.WriteString("<li>")
+		renderBlocks(out, body, !loose, depth+1)
+		out.WriteString("</li>\n")
+	}
+	out.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// hasInnerBlankLine reports whether blank lines separate blocks of a list
+// item, not counting those inside fenced code
+func hasInnerBlankLine(body []string) bool {
+	fence := ""
+	for i, line := range body {
+		if fence != "" {
+			if closesFence(line, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if _, f, _, ok := openFence(line); ok {
+			fence = f
+			continue
+		}
+		if isBlank(line) && i > 0 && i < len(body)-1 && indentOf(body[i+1]) < 4 {
+			return true
+		}
+	}
+	return false
+}
+
+func writeHeading(out *strings.Builder, level int, text string) {
+	tag := "h" + strconv.Itoa(min(level+headingOffset, 6))
+	out.WriteString("<" + tag + ">" + renderInline(text, true) + "</" + tag + ">\n")
+}
+
+// writeCodeBlock writes lines of code in a monospaced block, labelled with
+// the language named after the opening fence
+func writeCodeBlock(out *strings.Builder, code []string, language string) {
+	out.WriteString("<pre><code")
+	if language != "" {
+		out.WriteString(` class="language-` + html.EscapeString(language) + `"`)
+	}
+	out.WriteString(">")
+	for _, line := range code {
+		out.WriteString(html.EscapeString(line))
+		out.WriteString("\n")
+	}
+	out.WriteString("</code></pre>\n")
+}
+
+// inlineNode is a piece of a paragraph: text, finished markup, or a run of
+// * or _ that may turn into emphasis
+type inlineNode struct {
+	text     string // Literal text, escaped on output
+	markup   string // HTML written as is
+	delim    byte   // * or _ for delimiter runs
+	count    int    // Delimiters in the run not used for emphasis
+	length   int    // Length of the run as written
+	canOpen  bool
+	canClose bool
+	opens    []string // Tags opened after the run
+	closes   []string // Tags closed before the run
+}
+
+func isPunctuation(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// renderInline renders the inline content of a block. Links are not
+// nested, so the text of a link is rendered with links turned off.
+func renderInline(src string, links bool) string {
+	var nodes []inlineNode
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, inlineNode{text: text.String()})
+			text.Reset()
+		}
+	}
+	markup := func(s string) {
+		flush()
+		nodes = append(nodes, inlineNode{markup: s})
+	}
+	noCloser := map[int]bool{} // Lengths of backtick runs with no closing run left
+	linkWork := 0
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\\' && i+1 < len(src) && src[i+1] == '\n':
+			markup("<br>\n")
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(src) && src[i+1] < utf8.RuneSelf && isPunctuation(rune(src[i+1])):
+			text.WriteByte(src[i+1])
+			i += 2
+			continue
+
+		case c == '`':
+			n := 1
+			for i+n < len(src) && src[i+n] == '`' {
+				n++
+			}
+			if end := findBacktickRun(src, i+n, n, noCloser); end >= 0 {
+				code := strings.ReplaceAll(src[i+n:end], "\n", " ")
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+					code = code[1 : len(code)-1]
+				}
+				markup("<code>" + html.EscapeString(code) + "</code>")
+				i = end + n
+			} else {
+				text.WriteString(src[i : i+n])
+				i += n
+			}
+			continue
+
+		case c == '&':
+			if m := mdEntity.FindString(src[i:]); m != "" {
+				text.WriteString(html.UnescapeString(m))
+				i += len(m)
+				continue
+			}
+
+		case c == '<' && links:
+			if m := mdAutolink.FindStringSubmatch(src[i:]); m != nil {
+				if href, ok := safeURL(m[1]); ok {
+					markup(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(m[1]) + "</a>")
+					i += len(m[0])
+					continue
+				}
+			}
+			if m := mdEmailLink.FindStringSubmatch(src[i:]); m != nil {
+				markup(`<a href="mailto:` + html.EscapeString(m[1]) + `">` + html.EscapeString(m[1]) + "</a>")
+				i += len(m[0])
+				continue
+			}
+
+		case (c == '[' || (c == '!' && i+1 < len(src) && src[i+1] == '[')) && links && linkWork < maxLinkWork:
+			open := i
+			if c == '!' {
+				open++
+			}
+			label, dest, title, end, ok := parseInlineLink(src, open)
+			linkWork += end - open
+			if ok {
+				inner := renderInline(label, false)
+				if href, ok := safeURL(dest); ok {
+					a := `<a href="` + html.EscapeString(href) + `"`
+					if title != "" {
+						a += ` title="` + html.EscapeString(title) + `"`
+					}
+					markup(a + ">" + inner + "</a>")
+				} else {
+					markup(inner)
+				}
+				i = end
+				continue
+			}
+
+		case c == '\n':
+			// Two trailing spaces make a hard line break
+			s := text.String()
+			trimmed := strings.TrimRight(s, " ")
+			hard := len(s)-len(trimmed) >= 2
+			text.Reset()
+			text.WriteString(trimmed)
+			if hard {
+				markup("<br>\n")
+			} else {
+				text.WriteByte('\n')
+			}
+			i++
+			for i < len(src) && src[i] == ' ' {
+				i++
+			}
+			continue
+
+		case c == '*' || c == '_':
+			n := 1
+			for i+n < len(src) && src[i+n] == c {
+				n++
+			}
+			before, _ := utf8.DecodeLastRuneInString(src[:i])
+			after, _ := utf8.DecodeRuneInString(src[i+n:])
+			if i == 0 {
+				before = ' '
+			}
+			if i+n == len(src) {
+				after = ' '
+			}
+			left := !unicode.IsSpace(after) && (!isPunctuation(after) || unicode.IsSpace(before) || isPunctuation(before))
+			right := !unicode.IsSpace(before) && (!isPunctuation(before) || unicode.IsSpace(after) || isPunctuation(after))
+			node := inlineNode{delim: c, count: n, length: n, canOpen: left, canClose: right}
+			if c == '_' {
+				node.canOpen = left && (!right || isPunctuation(before))
+				node.canClose = right && (!left || isPunctuation(after))
+			}
+			flush()
+			nodes = append(nodes, node)
+			i += n
+			continue
+
+		case links && (c == 'h' || c == 'w'):
+			prev, _ := utf8.DecodeLastRuneInString(src[:i])
+			if i == 0 || !(unicode.IsLetter(prev) || unicode.IsDigit(prev)) {
+				if url := bareURL(src[i:]); url != "" {
+					href := url
+					if strings.HasPrefix(url, "www.") {
+						href = "http://" + url
+					}
+					if href, ok := safeURL(href); ok {
+						markup(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(url) + "</a>")
+						i += len(url)
+						continue
+					}
+				}
+			}
+		}
+
+		_, size := utf8.DecodeRuneInString(src[i:])
+		text.WriteString(src[i : i+size])
+		i += size
+	}
+	flush()
+
+	processEmphasis(nodes)
+	var out strings.Builder
+	for _, n := range nodes {
+		switch {
+		case n.delim != 0:
+			// Closers give up delimiters from the start of the run and
+			// openers from the end
+			out.WriteString(strings.Join(n.closes, ""))
+			out.WriteString(strings.Repeat(string(n.delim), n.count))
+			out.WriteString(strings.Join(n.opens, ""))
+		case n.markup != "":
+			out.WriteString(n.markup)
+		default:
+			out.WriteString(html.EscapeString(n.text))
+		}
+	}
+	return out.String()
+}
+
+// findBacktickRun returns the index of the next run of exactly n backticks
+// at or after from, or -1
+func findBacktickRun(src string, from, n int, noCloser map[int]bool) int {
+	if noCloser[n] {
+		return -1
+	}
+	for i := from; i < len(src); {
+		if src[i] != '`' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(src) && src[j] == '`' {
+			j++
+		}
+		if j-i == n {
+			return i
+		}
+		i = j
+	}
+	noCloser[n] = true
+	return -1
+}
+
+// parseInlineLink parses a link of the form [label](destination "title")
+// starting at the opening bracket. It returns the index after the link,
+// or how far it looked if there is no link.
+func parseInlineLink(src string, open int) (label, dest, title string, end int, ok bool) {
+	src = src[:min(len(src), open+maxLinkScan)]
+	depth := 0
+	close := -1
+	for j := open; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+		if depth == 0 {
+			close = j
+			break
+		}
+	}
+	if close < 0 {
+		return "", "", "", len(src), false
+	}
+	if close+1 >= len(src) || src[close+1] != '(' {
+		return "", "", "", close + 1, false
+	}
+	label = src[open+1 : close]
+
+	j := close + 2
+	skipSpace := func() {
+		for j < len(src) && (src[j] == ' ' || src[j] == '\n') {
+			j++
+		}
+	}
+	skipSpace()
+	if j < len(src) && src[j] == '<' {
+		k := strings.IndexAny(src[j+1:], ">\n<")
+		if k < 0 || src[j+1+k] != '>' {
+			return "", "", "", len(src), false
+		}
+		dest = src[j+1 : j+1+k]
+		j += k + 2
+	} else {
+		start, parens := j, 0
+		for j < len(src) && src[j] > ' ' {
+			if src[j] == '\\' && j+1 < len(src) {
+				j += 2
+				continue
+			}
+			if src[j] == '(' {
+				parens++
+			} else if src[j] == ')' {
+				if parens == 0 {
+					break
+				}
+				parens--
+			}
+			j++
+		}
+		dest = src[start:j]
+	}
+
+	spaced := j
+	skipSpace()
+	if j < len(src) && j > spaced && (src[j] == '"' || src[j] == '\'' || src[j] == '(') {
+		closer := src[j]
+		if closer == '(' {
+			closer = ')'
+		}
+		k := j + 1
+		for k < len(src) && src[k] != closer {
+			if src[k] == '\\' {
+				k++
+			}
+			k++
+		}
+		if k >= len(src) {
+			return "", "", "", len(src), false
+		}
+		title = unescapeMarkdown(src[j+1 : k])
+		j = k + 1
+		skipSpace()
+	}
+	if j >= len(src) || src[j] != ')' {
+		return "", "", "", j, false
+	}
+	return label, unescapeMarkdown(dest), title, j + 1, true
+}
+
+// unescapeMarkdown resolves backslash escapes and entities in a link
+// destination or title
+func unescapeMarkdown(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] < utf8.RuneSelf && isPunctuation(rune(s[i+1])) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return html.UnescapeString(b.String())
+}
+
+// bareURL returns the URL at the start of text, if it starts with one.
+// Trailing punctuation is left out, as are closing parentheses without an
+// opening one in the URL.
+func bareURL(text string) string {
+	var prefix string
+	head := strings.ToLower(text[:min(len(text), 8)])
+	for _, p := range []string{"https://", "http://", "www."} {
+		if strings.HasPrefix(head, p) {
+			prefix = p
+			break
+		}
+	}
+	if prefix == "" {
+		return ""
+	}
+	end := strings.IndexAny(text, " \t\n<")
+	if end < 0 {
+		end = len(text)
+	}
+	url := text[:end]
+	for {
+		trimmed := strings.TrimRight(url, "?!.,:*_~'\";")
+		if strings.HasSuffix(trimmed, ")") && strings.Count(trimmed, ")") > strings.Count(trimmed, "(") {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+		if trimmed == url {
+			break
+		}
+		url = trimmed
+	}
+	if len(url) <= len(prefix) || (prefix == "www." && !strings.Contains(url[len(prefix):], ".")) {
+		return ""
+	}
+	return url
+}
+
+// processEmphasis pairs * and _ delimiter runs into <em> and <strong>
+// following the CommonMark rules
+func processEmphasis(nodes []inlineNode) {
+	type bottomKey struct {
+		delim   byte
+		canOpen bool
+		mod     int
+	}
+	bottom := map[bottomKey]int{}
+	var openers []int // Delimiter runs that may still open emphasis
+
+	for i := range nodes {
+		closer := &nodes[i]
+		if closer.delim == 0 {
+			continue
+		}
+		if closer.canClose {
+			for closer.count > 0 {
+				key := bottomKey{closer.delim, closer.canOpen, closer.length % 3}
+				floor, seen := bottom[key]
+				if !seen {
+					floor = -1
+				}
+				found := -1
+				for s := len(openers) - 1; s >= 0 && openers[s] > floor; s-- {
+					opener := &nodes[openers[s]]
+					if opener.delim != closer.delim {
+						continue
+					}
+					// Runs that could both open and close only pair up if
+					// their lengths do not add up to a multiple of three
+					if (opener.canClose || closer.canOpen) && (opener.length+closer.length)%3 == 0 &&
+						!(opener.length%3 == 0 && closer.length%3 == 0) {
+						continue
+					}
+					found = s
+					break
+				}
+				if found < 0 {
+					bottom[key] = i
+					break
+				}
+
+				opener := &nodes[openers[found]]
+				use, tag := 1, "em"
+				if opener.count >= 2 && closer.count >= 2 {
+					use, tag = 2, "strong"
+				}
+				opener.count -= use
+				closer.count -= use
+				opener.opens = append([]string{"<" + tag + ">"}, opener.opens...)
+				closer.closes = append(closer.closes, "</"+tag+">")
+
+				// Runs between the pair can no longer match
+				openers = openers[:found+1]
+				if opener.count == 0 {
+					openers = openers[:found]
+				}
+			}
+		}
+		if closer.canOpen && closer.count > 0 {
+			openers = append(openers, i)
+		}
+	}
+}
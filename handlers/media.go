@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The file behind a media URL never changes, so files everyone may see are
+// cached for good. Files only served to their uploader and to moderators
+// depend on who asks, so only the browser keeps them, and only briefly.
+const (
+	publicMediaCacheControl  = "public, max-age=31536000, immutable"
+	privateMediaCacheControl = "private, max-age=300, must-revalidate"
+)
+
+// mediaURL returns the address an image or one of its renditions is served
+// from. The rendition is "" for the uploaded file, "w320" for a variant or
+// "poster" for the still frame of an animated GIF or video clip.
+func mediaURL(imageID int64, rendition string) string {
+	if rendition == "" {
+		return fmt.Sprintf("/media/%d", imageID)
+	}
+	return fmt.Sprintf("/media/%d/%s", imageID, rendition)
+}
+
+// imageIsPublic reports whether an image is attached to a post or comment
+// that everyone may see, or to an earlier version of such a post. Images
+// of deleted posts and comments are hidden with them.
+func imageIsPublic(imageID int64) (bool, error) {
+	var public bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM post_images pi JOIN posts p ON p.id = pi.post_id
+			WHERE pi.image_id = ? AND p.deleted_at IS NULL
+			UNION ALL
+			SELECT 1 FROM post_revision_images ri
+			JOIN post_revisions pr ON pr.id = ri.revision_id
+			JOIN posts p ON p.id = pr.post_id
+			WHERE ri.image_id = ? AND p.deleted_at IS NULL
+			UNION ALL
+			SELECT 1 FROM comments c JOIN posts p ON p.id = c.post_id
+			WHERE c.image_id = ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL
+		)`, imageID, imageID, imageID).Scan(&public)
+	return public, err
+}
+
+// MediaHandler serves uploaded images by ID under /media/{id}, with
+// /media/{id}/w{width} for resized variants and /media/{id}/poster for the
+// still frame of an animated GIF or video clip. Images that are not
+// attached to anything visible, such as those of deleted posts, and images
+// awaiting or refused by moderation are only served to their uploader and
+// to moderators. Responses carry a strong ETag and support Range and
+// conditional requests.
+func MediaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		RenderError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/media/"), "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 {
+		RenderError(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+
+	img, err := GetImage(id)
+	if err == sql.ErrNoRows {
+		RenderError(w, r, "Page not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching image %d: %v", id, err)
+		RenderError(w, r, "server_error", http.StatusInternalServerError)
+		return
+	}
+
+	public, err := imageIsPublic(id)
+	if err != nil {
+		log.Printf("Error checking image visibility: %v", err)
+		RenderError(w, r, "server_error", http.StatusInternalServerError)
+		return
+	}
+	public = public && img.Moderation == ImageApproved
+	if !public {
+		// Hidden images look the same as missing ones to everyone but their
+		// uploader and the moderators reviewing them
+		userID := GetUserIdFromSession(w, r)
+		if userID == "" || (userID != img.UserID && !isModerator(userID)) {
+			RenderError(w, r, "Page not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	key, mimeType := img.Path, img.MimeType
+	if len(parts) == 2 {
+		key = ""
+		if parts[1] == "poster" {
+			key, mimeType = img.PosterPath, "image/png"
+		}
+		for _, v := range img.Variants {
+			if parts[1] == fmt.Sprintf("w%d", v.Width) {
+				key = v.Path
+			}
+		}
+		if key == "" {
+			RenderError(w, r, "Page not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	content, err := blobStore.Get(key)
+	if errors.Is(err, ErrBlobNotFound) {
+		log.Printf("Image %d is missing its file %s", id, key)
+		RenderError(w, r, "Page not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error opening %s: %v", key, err)
+		RenderError(w, r, "server_error", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	// Range requests need to seek; files from remote stores are buffered
+	seeker, ok := content.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			log.Printf("Error reading %s: %v", key, err)
+			RenderError(w, r, "server_error", http.StatusInternalServerError)
+			return
+		}
+		seeker = bytes.NewReader(data)
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", mimeType)
+	header.Set("ETag", `"`+strings.TrimSuffix(path.Base(key), path.Ext(key))+`"`)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	if public {
+		header.Set("Cache-Control", publicMediaCacheControl)
+	} else {
+		header.Set("Cache-Control", privateMediaCacheControl)
+	}
+	http.ServeContent(w, r, "", img.CreatedAt, seeker)
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+)
+
+// strippedJPEGQuality is the quality used when re-encoding uploaded JPEGs
+const strippedJPEGQuality = 92
+
+// exifOrientationTag is the EXIF tag that records how the camera was held
+const exifOrientationTag = 0x0112
+
+// exifOrientation returns the EXIF Orientation (1-8) of a JPEG or PNG, or 1
+// when the image carries no orientation.
+func exifOrientation(data []byte, mimeType string) int {
+	var tiff []byte
+	switch mimeType {
+	case "image/jpeg":
+		tiff = jpegExif(data)
+	case "image/png":
+		tiff = pngExif(data)
+	}
+	if tiff == nil {
+		return 1
+	}
+	return tiffOrientation(tiff)
+}
+
+// jpegExif returns the TIFF structure inside a JPEG's Exif APP1 segment
+func jpegExif(data []byte) []byte {
+	pos := 2 // Skip SOI
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil
+		}
+		marker := data[pos+1]
+		if marker == 0xD8 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			pos += 2
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // Start of scan or end of image
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		pos += 2 + length
+	}
+	return nil
+}
+
+// pngExif returns the TIFF structure stored in a PNG's eXIf chunk
+func pngExif(data []byte) []byte {
+	pos := 8 // Skip the signature
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(data) {
+			return nil
+		}
+		if chunkType == "eXIf" {
+			return data[pos+8 : pos+8+length]
+		}
+		if chunkType == "IDAT" || chunkType == "IEND" {
+			return nil
+		}
+		pos += 12 + length
+	}
+	return nil
+}
+
+// tiffOrientation reads the Orientation tag from the first IFD of a TIFF structure
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		value := int(order.Uint16(tiff[entry+8:]))
+		if value < 1 || value > 8 {
+			return 1
+		}
+		return value
+	}
+	return 1
+}
+
+// applyOrientation transforms pixels so an image with the given EXIF
+// orientation displays upright without its metadata.
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	in := toRGBA(src)
+	w, h := in.Rect.Dx(), in.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 { // Orientations 5-8 swap width and height
+		dw, dh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // Rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // Mirrored along the top-left diagonal
+				dx, dy = y, x
+			case 6: // Rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // Mirrored along the top-right diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(out.Pix[dy*out.Stride+dx*4:dy*out.Stride+dx*4+4], in.Pix[y*in.Stride+x*4:y*in.Stride+x*4+4])
+		}
+	}
+	return out
+}
+
+// StripMetadata removes EXIF, GPS and other metadata from an upload. A JPEG
+// or PNG is re-encoded from its pixels, with the EXIF orientation applied
+// first so the image still displays the right way up. A WebP file loses
+// its EXIF and XMP chunks, an MP4 clip has its user data and metadata boxes
+// blanked and a WebM clip its tags, leaving the image and video data
+// untouched. Other formats are returned unchanged.
+func StripMetadata(data []byte, info ImageInfo) ([]byte, ImageInfo, error) {
+	if info.MimeType == "image/webp" {
+		// WebP cannot be re-encoded, but its metadata lives in separate chunks
+		stripped, err := stripWebPMetadata(data)
+		return stripped, info, err
+	}
+	if info.MimeType == "video/mp4" {
+		stripped, err := stripMP4Metadata(data)
+		return stripped, info, err
+	}
+	if info.MimeType == "video/webm" {
+		stripped, err := stripWebMMetadata(data)
+		return stripped, info, err
+	}
+	if info.Decoded == nil || (info.MimeType != "image/jpeg" && info.MimeType != "image/png") {
+		return data, info, nil
+	}
+
+	info = orientImage(data, info)
+
+	var buf bytes.Buffer
+	var err error
+	if info.MimeType == "image/jpeg" {
+		err = jpeg.Encode(&buf, info.Decoded, &jpeg.Options{Quality: strippedJPEGQuality})
+	} else {
+		err = png.Encode(&buf, info.Decoded)
+	}
+	if err != nil {
+		return nil, ImageInfo{}, err
+	}
+	return buf.Bytes(), info, nil
+}
+
+// orientImage applies the EXIF orientation of a JPEG or PNG to its decoded
+// pixels and dimensions, leaving the file itself alone. Variants are built
+// from these pixels, so they display upright even when the stored original
+// keeps its metadata.
+func orientImage(data []byte, info ImageInfo) ImageInfo {
+	if info.Decoded == nil || (info.MimeType != "image/jpeg" && info.MimeType != "image/png") {
+		return info
+	}
+	info.Decoded = applyOrientation(info.Decoded, exifOrientation(data, info.MimeType))
+	bounds := info.Decoded.Bounds()
+	info.Width = bounds.Dx()
+	info.Height = bounds.Dy()
+	return info
+}
+
+// keepsOriginalImage reports whether uploads in any of the given categories
+// should be stored exactly as uploaded, metadata included.
+func keepsOriginalImage(categories []string) bool {
+	for _, category := range categories {
+		for _, keep := range AppConfig.KeepMetadataCategories {
+			if category == keep {
+				return true
+			}
+		}
+	}
+	return false
+}
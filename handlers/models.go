@@ -16,12 +16,16 @@ type Post struct {
 	UserID         string
 	Title          string
 	Content        string
-	ImagePath      string // New field for image path
+	ImagePath      string      // New field for image path
+	Images         []PostImage // Gallery of images in display order
 	Categories     string
 	Username       string
 	CreatedAt      time.Time
 	CreatedAtHuman string
-	LikeCount      int // Number of likes
+	EditedAt       time.Time // Time of the last edit, zero if never edited
+	EditedAtHuman  string
+	DeletedAt      time.Time // Time the post was deleted, zero if it was not
+	LikeCount      int       // Number of likes
 	DislikeCount   int
 	Comments       []Comment // List of comments for this post
 }
@@ -39,6 +43,7 @@ type Comment struct {
 	PostID         int
 	UserID         string // Changed from int to string to match User.ID
 	Content        string
+	Image          *Image    // Optional image attached to the comment
 	CreatedAt      time.Time // Original time
 	CreatedAtHuman string    // Human-readable time
 	Username       string
@@ -48,6 +53,7 @@ type Comment struct {
 	LikeCount      int       // Number of likes
 	DislikeCount   int       // Number of dislikes
 	UserLiked      *bool     // Whether the current user liked this comment
+	Deleted        bool      // Deleted but kept as a tombstone for its replies
 }
 
 // Session represents a user session
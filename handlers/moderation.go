@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// isModerator reports whether a user may moderate the forum
+func isModerator(userID string) bool {
+	if userID == "" {
+		return false
+	}
+	role, err := GetUserRole(userID)
+	if err != nil {
+		log.Printf("Error fetching role of user %s: %v", userID, err)
+		return false
+	}
+	return role == RoleModerator || role == RoleAdmin
+}
+
+// requireModerator returns the ID of the logged in moderator, or renders
+// an error and returns "" for anyone else
+func requireModerator(w http.ResponseWriter, r *http.Request) string {
+	userID := GetUserIdFromSession(w, r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return ""
+	}
+	if !isModerator(userID) {
+		RenderError(w, r, "forbidden", http.StatusForbidden)
+		return ""
+	}
+	return userID
+}
+
+// BannedImagesHandler shows the banned image list to moderators and lets
+// them add or remove entries. An image is banned by its ID or /media URL,
+// or by pasting a perceptual hash directly.
+func BannedImagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requireModerator(w, r)
+	if userID == "" {
+		return
+	}
+
+	var formError string
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		switch r.FormValue("action") {
+		case "ban":
+			phash, problem := bannedHashFromForm(r)
+			if problem == "" {
+				if err := BanHash(phash, strings.TrimSpace(r.FormValue("reason")), userID); err != nil {
+					log.Printf("Error banning image hash: %v", err)
+					RenderError(w, r, "server_error", http.StatusInternalServerError)
+					return
+				}
+				http.Redirect(w, r, "/moderation/banned-images", http.StatusSeeOther)
+				return
+			}
+			formError = problem
+		case "unban":
+			id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+			if err != nil {
+				RenderError(w, r, "invalid_input", http.StatusBadRequest)
+				return
+			}
+			if err := UnbanHash(id); err != nil {
+				log.Printf("Error removing banned image hash: %v", err)
+				RenderError(w, r, "server_error", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/moderation/banned-images", http.StatusSeeOther)
+			return
+		default:
+			RenderError(w, r, "invalid_input", http.StatusBadRequest)
+			return
+		}
+	default:
+		RenderError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	banned, err := GetBannedHashes()
+	if err != nil {
+		log.Printf("Error fetching banned images: %v", err)
+		RenderError(w, r, "server_error", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/banned_images.html")
+	if err != nil {
+		log.Printf("Error parsing banned images template: %v", err)
+		RenderError(w, r, "Error loading page", http.StatusInternalServerError)
+		return
+	}
+	if formError != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	data := map[string]interface{}{
+		"Banned":   banned,
+		"Error":    formError,
+		"Distance": AppConfig.BannedHashDistance,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error executing banned images template: %v", err)
+	}
+}
+
+// bannedHashFromForm returns the hash to ban from the form, or a message
+// explaining why there is none
+func bannedHashFromForm(r *http.Request) (string, string) {
+	if phash := strings.ToLower(strings.TrimSpace(r.FormValue("phash"))); phash != "" {
+		if _, ok := parsePerceptualHash(phash); !ok {
+			return "", "A perceptual hash is 16 hexadecimal digits."
+		}
+		return phash, ""
+	}
+
+	// Accept "12", "/media/12" or a full media URL with a rendition
+	ref := strings.TrimSpace(r.FormValue("image"))
+	if u, err := url.Parse(ref); err == nil {
+		ref = u.Path
+	}
+	ref = strings.TrimPrefix(ref, "/media/")
+	id, err := strconv.ParseInt(strings.SplitN(ref, "/", 2)[0], 10, 64)
+	if err != nil {
+		return "", "Enter an image ID, an image URL or a perceptual hash."
+	}
+	img, err := GetImage(id)
+	if err == sql.ErrNoRows {
+		return "", "There is no image with that ID."
+	} else if err != nil {
+		log.Printf("Error fetching image %d: %v", id, err)
+		return "", "The image could not be loaded."
+	}
+	if img.PHash == "" {
+		return "", "That image has no perceptual hash, so it cannot be banned by its content."
+	}
+	return img.PHash, ""
+}
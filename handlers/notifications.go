@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Notification is a message to a user about something that happened to
+// their content, shown on their profile
+type Notification struct {
+	ID        int64
+	Message   string
+	Link      string // Page the notification is about, may be empty
+	CreatedAt time.Time
+	Read      bool
+}
+
+// CreatedAtHuman returns how long ago the notification was sent
+func (n Notification) CreatedAtHuman() string {
+	return TimeAgo(n.CreatedAt)
+}
+
+// maxNotifications is how many notifications the profile page shows
+const maxNotifications = 20
+
+// AddNotification sends a notification to a user
+func AddNotification(userID, message, link string) error {
+	_, err := db.Exec(
+		"INSERT INTO notifications (user_id, message, link, created_at) VALUES (?, ?, ?, ?)",
+		userID, message, link, time.Now(),
+	)
+	return err
+}
+
+// GetNotifications returns the latest notifications of a user, newest first
+func GetNotifications(userID string) ([]Notification, error) {
+	rows, err := db.Query(`
+		SELECT id, message, COALESCE(link, ''), created_at, read_at
+		FROM notifications WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC LIMIT ?`, userID, maxNotifications)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		var readAt sql.NullTime
+		if err := rows.Scan(&n.ID, &n.Message, &n.Link, &n.CreatedAt, &readAt); err != nil {
+			return nil, err
+		}
+		n.Read = readAt.Valid
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// UnreadNotificationCount returns how many notifications a user has not seen
+func UnreadNotificationCount(userID string) int {
+	if userID == "" {
+		return 0
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count); err != nil {
+		return 0
+	}
+	return count
+}
+
+// MarkNotificationsRead marks all notifications of a user as seen
+func MarkNotificationsRead(userID string) error {
+	_, err := db.Exec("UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL", time.Now(), userID)
+	return err
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math/bits"
+	"strconv"
+	"time"
+)
+
+// errImageBanned is returned for uploads that look like a banned image.
+// Its message is the key of its ErrorMessages entry.
+var errImageBanned = errors.New("image_banned")
+
+// errImageUnhashable is returned for uploads without a perceptual hash,
+// such as clips without a poster frame, while any image is banned, as
+// they cannot be checked. Its message is the key of its ErrorMessages entry.
+var errImageUnhashable = errors.New("image_unverifiable")
+
+// perceptualHash returns the difference hash (dHash) of an image as 16 hex
+// digits. The image is shrunk to 9x8 grey pixels and each bit records
+// whether a pixel is darker than its right neighbour, so re-encoding,
+// resizing or small edits barely change the hash. Returns "" without pixels.
+func perceptualHash(img image.Image) string {
+	if img == nil || img.Bounds().Empty() {
+		return ""
+	}
+	small := resizeImage(img, 9, 8)
+	luma := func(x, y int) int {
+		p := small.Pix[y*small.Stride+x*4:]
+		return 299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if luma(x, y) < luma(x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// parsePerceptualHash checks that s is a hash as made by perceptualHash
+func parsePerceptualHash(s string) (uint64, bool) {
+	if len(s) != 16 {
+		return 0, false
+	}
+	hash, err := strconv.ParseUint(s, 16, 64)
+	return hash, err == nil
+}
+
+// hashDistance returns the number of bits in which two perceptual hashes
+// differ, or -1 if either is not a valid hash
+func hashDistance(a, b string) int {
+	x, okA := parsePerceptualHash(a)
+	y, okB := parsePerceptualHash(b)
+	if !okA || !okB {
+		return -1
+	}
+	return bits.OnesCount64(x ^ y)
+}
+
+// similarHash reports whether two hashes are within the given distance
+func similarHash(a, b string, maxDistance int) bool {
+	d := hashDistance(a, b)
+	return d >= 0 && d <= maxDistance
+}
+
+// BannedHash is an entry of the banned image list
+type BannedHash struct {
+	ID        int64
+	PHash     string
+	Reason    string
+	BannedBy  string // Username of the moderator who added the entry
+	CreatedAt time.Time
+}
+
+// GetBannedHashes returns the banned image list, newest first
+func GetBannedHashes() ([]BannedHash, error) {
+	rows, err := db.Query(`
+		SELECT b.id, b.phash, COALESCE(b.reason, ''), COALESCE(u.username, ''), b.created_at
+		FROM banned_image_hashes b
+		LEFT JOIN users u ON u.id = b.banned_by
+		ORDER BY b.created_at DESC, b.id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var banned []BannedHash
+	for rows.Next() {
+		var b BannedHash
+		if err := rows.Scan(&b.ID, &b.PHash, &b.Reason, &b.BannedBy, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		banned = append(banned, b)
+	}
+	return banned, rows.Err()
+}
+
+// BanHash adds a perceptual hash to the banned image list
+func BanHash(phash, reason, moderatorID string) error {
+	if _, ok := parsePerceptualHash(phash); !ok {
+		return fmt.Errorf("invalid perceptual hash %q", phash)
+	}
+	_, err := db.Exec(
+		"INSERT INTO banned_image_hashes (phash, reason, banned_by, created_at) VALUES (?, ?, ?, ?)",
+		phash, reason, moderatorID, time.Now(),
+	)
+	return err
+}
+
+// UnbanHash removes an entry from the banned image list
+func UnbanHash(id int64) error {
+	_, err := db.Exec("DELETE FROM banned_image_hashes WHERE id = ?", id)
+	return err
+}
+
+// CheckBannedImage refuses images whose hash is within
+// AppConfig.BannedHashDistance of a banned one. Images without a hash
+// cannot be checked, so they are refused while the ban list is not empty.
+func CheckBannedImage(phash string) error {
+	if phash == "" {
+		var banned bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM banned_image_hashes)").Scan(&banned); err != nil {
+			return fmt.Errorf("loading banned images: %w", err)
+		}
+		if banned {
+			return errImageUnhashable
+		}
+		return nil
+	}
+	rows, err := db.Query("SELECT id, phash FROM banned_image_hashes")
+	if err != nil {
+		return fmt.Errorf("loading banned images: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var banned string
+		if err := rows.Scan(&id, &banned); err != nil {
+			return err
+		}
+		if similarHash(phash, banned, AppConfig.BannedHashDistance) {
+			log.Printf("Refused upload matching banned image #%d (hash %s, distance %d)", id, phash, hashDistance(phash, banned))
+			return errImageBanned
+		}
+	}
+	return rows.Err()
+}
+
+// findEarlierPost returns the oldest visible post before postID with an
+// approved image within AppConfig.DuplicateHashDistance of phash, or 0 if
+// there is none. Exact copies are found through the index on images.phash
+// and preferred. Near copies can only be found by comparing hashes one by
+// one, so only the AppConfig.DuplicateScanLimit most recently posted images
+// are compared and reposts of older pictures are left unlinked.
+func findEarlierPost(phash string, postID int) (int, error) {
+	if phash == "" || AppConfig.DuplicateHashDistance < 0 {
+		return 0, nil
+	}
+	const visible = `
+		FROM post_images pi
+		JOIN images i ON i.id = pi.image_id
+		JOIN posts p ON p.id = pi.post_id
+		WHERE pi.post_id < ? AND p.deleted_at IS NULL AND COALESCE(i.moderation, ?) = ?`
+
+	var earlier int
+	err := db.QueryRow("SELECT pi.post_id"+visible+" AND i.phash = ? ORDER BY pi.post_id LIMIT 1",
+		postID, ImageApproved, ImageApproved, phash).Scan(&earlier)
+	if err != sql.ErrNoRows {
+		return earlier, err
+	}
+
+	rows, err := db.Query("SELECT pi.post_id, i.phash"+visible+" AND COALESCE(i.phash, '') != '' ORDER BY pi.post_id DESC LIMIT ?",
+		postID, ImageApproved, ImageApproved, AppConfig.DuplicateScanLimit)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var post int
+		var other string
+		if err := rows.Scan(&post, &other); err != nil {
+			return 0, err
+		}
+		// Rows come newest first, so the last match is the oldest post
+		if similarHash(phash, other, AppConfig.DuplicateHashDistance) {
+			earlier = post
+		}
+	}
+	return earlier, rows.Err()
+}
+
+// BackfillPerceptualHashes computes the hash of images stored before
+// hashes were recorded and returns how many were updated. Images that
+// cannot be decoded are left without a hash.
+func BackfillPerceptualHashes() (int, error) {
+	rows, err := db.Query("SELECT id, path, COALESCE(mime_type, '') FROM images WHERE phash IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id            int64
+		key, mimeType string
+	}
+	var images []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.key, &p.mimeType); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		images = append(images, p)
+	}
+	rows.Close()
+
+	updated := 0
+	for _, p := range images {
+		phash := ""
+		format, ok := formatByMimeType(p.mimeType)
+		if ok && format.Decode != nil {
+			if data, err := readBlob(p.key); err != nil {
+				log.Printf("Error reading image %d: %v", p.id, err)
+			} else if decoded, err := format.Decode(data); err != nil {
+				log.Printf("Error decoding image %d: %v", p.id, err)
+			} else {
+				phash = perceptualHash(decoded)
+			}
+		}
+		// An empty hash marks the image as done so it is not retried
+		if _, err := db.Exec("UPDATE images SET phash = ? WHERE id = ?", phash, p.id); err != nil {
+			return updated, err
+		}
+		if phash != "" {
+			updated++
+		}
+	}
+	return updated, nil
+}
@@ -2,17 +2,24 @@ package handlers
 
 import (
 	"database/sql"
-	"io"
+	"fmt"
 	"log"
+	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
 	"strings"
 	"time"
 )
 
 const maxImageSize = 20 * 1024 * 1024 // 20 MB
 
+// postWarnings are notices shown on the home page after a post was
+// created, keyed by the value of the warning query parameter
+var postWarnings = map[string]string{
+	"missing_alt_text": "Your post was published, but some of its images have no alt text. Screen reader users will only hear the caption, if there is one.",
+	"images_pending":   "Your post was published. Its images will be shown once a moderator has reviewed them.",
+}
+
 func PostHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		RenderError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
@@ -51,51 +58,22 @@ func PostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Handle image upload
-	var imagePath string
-	if r.MultipartForm != nil {
-		file, header, err := r.FormFile("image")
-		if err == nil {
-			defer file.Close()
-
-			// Check file size
-			if header.Size > maxImageSize {
-				RenderError(w, r, "Image size exceeds 20 MB limit", http.StatusBadRequest)
-				return
-			}
-
-			// Validate image type
-			ext := strings.ToLower(filepath.Ext(header.Filename))
-			if ext != ".jpg" && ext != ".jpeg" && ext != ".png" && ext != ".gif" {
-				RenderError(w, r, "Invalid image type. Only JPEG, PNG, and GIF are allowed.", http.StatusBadRequest)
-				return
-			}
-
-			// Ensure the uploads directory exists
-			if err := os.MkdirAll("uploads", os.ModePerm); err != nil {
-				RenderError(w, r, "Error creating uploads directory", http.StatusInternalServerError)
-				return
-			}
-
-			// Save the image to the uploads directory
-			imagePath = "uploads/" + header.Filename
-			out, err := os.Create(imagePath)
-			if err != nil {
-				log.Printf("Error saving image: %v", err)
-				RenderError(w, r, "Error saving image", http.StatusInternalServerError)
-				return
-			}
-			defer out.Close()
-			if _, err := io.Copy(out, file); err != nil {
-				log.Printf("Error writing image to file: %v", err)
-				RenderError(w, r, "Error writing image to file", http.StatusInternalServerError)
-				return
-			}
-		}
+	images, missingAltText, err := readGalleryForm(r, userID, categories, 0)
+	if err != nil {
+		renderUploadError(w, r, err)
+		return
 	}
 
-	// Insert the new post into the database
-	result, err := db.Exec("INSERT INTO posts (user_id, title, content, image_path, created_at) VALUES (?, ?, ?, ?, ?)", userID, title, content, imagePath, time.Now())
+	// Insert the new post into the database, using up the upload tokens
+	// of its images in the same transaction
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error creating post: %v", err)
+		RenderError(w, r, "Error creating post", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO posts (user_id, title, content, image_path, created_at) VALUES (?, ?, ?, '', ?)", userID, title, content, time.Now())
 	if err != nil {
 		log.Printf("Error creating post: %v", err)
 		RenderError(w, r, "Error creating post", http.StatusInternalServerError)
@@ -110,9 +88,21 @@ func PostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := claimGalleryTokens(tx, images, userID); err != nil {
+		renderUploadError(w, r, err)
+		return
+	}
+
+	imagesPending, err := attachImages(tx, int(postID), images, userID, categories)
+	if err != nil {
+		log.Printf("Error attaching images: %v", err)
+		RenderError(w, r, "Error attaching images", http.StatusInternalServerError)
+		return
+	}
+
 	// Insert categories into the database
 	for _, category := range categories {
-		_, err = db.Exec("INSERT INTO post_categories (post_id, category) VALUES (?, ?)", postID, category)
+		_, err = tx.Exec("INSERT INTO post_categories (post_id, category) VALUES (?, ?)", postID, category)
 		if err != nil {
 			log.Printf("Error inserting category: %v", err)
 			RenderError(w, r, "Error inserting categories", http.StatusInternalServerError)
@@ -120,6 +110,127 @@ func PostHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Redirect to the posts page after successful creation
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error creating post: %v", err)
+		RenderError(w, r, "Error creating post", http.StatusInternalServerError)
+		return
+	}
+
+	// Redirect to the posts page after successful creation, warning the
+	// author if screen reader users will get no description of an image
+	// or if the images wait for a moderator
+	warnings := url.Values{}
+	if missingAltText {
+		warnings.Add("warning", "missing_alt_text")
+	}
+	if imagesPending {
+		warnings.Add("warning", "images_pending")
+	}
+	target := "/"
+	if len(warnings) > 0 {
+		target += "?" + warnings.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// readGalleryForm reads the image slots of a post form. Each slot has its
+// own file, caption and alt text field so the text stays matched to its
+// image. Images already sent to /upload are referred to by their token
+// instead of a file; the tokens are only used up by claimGalleryTokens
+// once the post is saved. A post can hold AppConfig.MaxImagesPerPost images,
+// kept of which are already attached. It also reports whether any of the
+// images lacks alt text.
+func readGalleryForm(r *http.Request, userID string, categories []string, kept int) ([]PostImage, bool, error) {
+	var images []PostImage
+	missingAltText := false
+	opts := UploadOptions{KeepOriginal: keepsOriginalImage(categories)}
+	for i := 0; i < AppConfig.MaxImagesPerPost; i++ {
+		token := r.FormValue(fmt.Sprintf("image_token_%d", i))
+		var file multipart.File
+		var header *multipart.FileHeader
+		if token == "" && r.MultipartForm != nil {
+			file, header, _ = r.FormFile(fmt.Sprintf("image_%d", i))
+		}
+		if token == "" && file == nil {
+			continue // Empty slot
+		}
+		if kept+len(images) >= AppConfig.MaxImagesPerPost {
+			if file != nil {
+				file.Close()
+			}
+			return nil, false, errTooManyImages
+		}
+
+		caption := strings.TrimSpace(r.FormValue(fmt.Sprintf("caption_%d", i)))
+		altText := strings.TrimSpace(r.FormValue(fmt.Sprintf("alt_%d", i)))
+		if len([]rune(caption)) > maxAltTextLength || len([]rune(altText)) > maxAltTextLength {
+			if file != nil {
+				file.Close()
+			}
+			return nil, false, errImageTextTooLong
+		}
+
+		var img Image
+		var err error
+		if token != "" {
+			img, err = lookupUploadToken(token, userID)
+		} else {
+			img, err = ProcessImageUpload(userID, header.Filename, file, opts)
+			file.Close()
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if altText == "" {
+			missingAltText = true
+		}
+		images = append(images, PostImage{
+			Image:    img,
+			Position: kept + len(images),
+			Caption:  caption,
+			AltText:  altText,
+			token:    token,
+		})
+	}
+	return images, missingAltText, nil
+}
+
+// claimGalleryTokens uses up the upload tokens of the images read by
+// readGalleryForm
+func claimGalleryTokens(tx *sql.Tx, images []PostImage, userID string) error {
+	for _, image := range images {
+		if image.token == "" {
+			continue
+		}
+		if err := claimUploadToken(tx, image.token, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachImages adds images to the gallery of a post within the transaction
+// saving it, pointing reposted pictures at the post they first appeared in.
+// Images in quarantined categories are held back until a moderator has
+// reviewed them, which is reported.
+func attachImages(tx *sql.Tx, postID int, images []PostImage, userID string, categories []string) (bool, error) {
+	var imagesPending bool
+	for _, image := range images {
+		duplicateOf, err := findEarlierPost(image.PHash, postID)
+		if err != nil {
+			log.Printf("Error looking for earlier posts of image %d: %v", image.ID, err)
+		}
+		_, err = tx.Exec("INSERT INTO post_images (post_id, image_id, position, caption, alt_text, duplicate_of) VALUES (?, ?, ?, ?, ?, ?)",
+			postID, image.ID, image.Position, image.Caption, image.AltText,
+			sql.NullInt64{Int64: int64(duplicateOf), Valid: duplicateOf != 0})
+		if err != nil {
+			return false, err
+		}
+		pending, err := quarantineImage(tx, image.ID, userID, categories)
+		if err != nil {
+			return false, fmt.Errorf("quarantining image %d: %w", image.ID, err)
+		}
+		imagesPending = imagesPending || pending
+	}
+	return imagesPending, nil
 }
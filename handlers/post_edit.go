@@ -0,0 +1,408 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// PostRevision is a version of a post that an edit replaced
+type PostRevision struct {
+	ID         int
+	PostID     int
+	Title      string
+	Content    string
+	Categories string
+	Images     []PostImage
+	EditedBy   string    // Username of whoever replaced this version
+	ReplacedAt time.Time // Time of the edit that replaced this version
+}
+
+// postEdit describes the changes one edit made, for the history page
+type postEdit struct {
+	EditedBy          string
+	EditedAt          time.Time
+	EditedAtHuman     string
+	Title             []diffPart
+	Content           []diffPart
+	AddedCategories   []string
+	RemovedCategories []string
+	AddedImages       []PostImage
+	RemovedImages     []PostImage
+	RelabeledImages   []PostImage // Kept images with a new caption or alt text
+}
+
+// categoryChoice is a category checkbox on the edit form
+type categoryChoice struct {
+	Name    string
+	Checked bool
+}
+
+// setEditedAt fills in when a post was last edited, if it ever was
+func setEditedAt(post *Post, editedAt sql.NullTime) {
+	if editedAt.Valid {
+		post.EditedAt = editedAt.Time
+		post.EditedAtHuman = TimeAgo(editedAt.Time)
+	}
+}
+
+// Edited reports whether the post was changed after it was created
+func (p Post) Edited() bool {
+	return !p.EditedAt.IsZero()
+}
+
+// HistoryURL returns the page listing the edits of the post
+func (p Post) HistoryURL() string {
+	return postURL(p.ID) + "/history"
+}
+
+// EditURL returns the page where the author edits the post
+func (p Post) EditURL() string {
+	return postURL(p.ID) + "/edit"
+}
+
+// splitCategories turns the comma separated categories of a post into a
+// sorted list
+func splitCategories(categories string) []string {
+	var list []string
+	for _, category := range strings.Split(categories, ",") {
+		if category != "" {
+			list = append(list, category)
+		}
+	}
+	slices.Sort(list)
+	return list
+}
+
+// sameGallery reports whether two galleries show the same images in the
+// same order with the same captions and alt text
+func sameGallery(a, b []PostImage) bool {
+	return slices.EqualFunc(a, b, func(x, y PostImage) bool {
+		return x.ID == y.ID && x.Caption == y.Caption && x.AltText == y.AltText
+	})
+}
+
+// GetPostRevisions returns the earlier versions of a post, oldest first
+func GetPostRevisions(postID int) ([]PostRevision, error) {
+	rows, err := db.Query(`
+		SELECT pr.id, pr.post_id, pr.title, pr.content, pr.categories, u.username, pr.created_at
+		FROM post_revisions pr
+		JOIN users u ON u.id = pr.edited_by
+		WHERE pr.post_id = ?
+		ORDER BY pr.id`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []PostRevision
+	for rows.Next() {
+		var rev PostRevision
+		if err := rows.Scan(&rev.ID, &rev.PostID, &rev.Title, &rev.Content, &rev.Categories, &rev.EditedBy, &rev.ReplacedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range revisions {
+		revisions[i].Images, err = getRevisionImages(revisions[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return revisions, nil
+}
+
+// getRevisionImages returns the gallery of an earlier version of a post
+func getRevisionImages(revisionID int) ([]PostImage, error) {
+	rows, err := db.Query(`
+		SELECT `+imageColumns+`, ri.position, COALESCE(ri.caption, ''), COALESCE(ri.alt_text, '')
+		FROM post_revision_images ri
+		JOIN images i ON ri.image_id = i.id
+		WHERE ri.revision_id = ?
+		ORDER BY ri.position`, revisionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []PostImage
+	for rows.Next() {
+		var pi PostImage
+		if err := rows.Scan(append(imageFields(&pi.Image), &pi.Position, &pi.Caption, &pi.AltText)...); err != nil {
+			return nil, err
+		}
+		images = append(images, pi)
+	}
+	return images, rows.Err()
+}
+
+// postHistory compares each version of a post with the one that replaced
+// it, newest edit first
+func postHistory(post Post) ([]postEdit, error) {
+	revisions, err := GetPostRevisions(post.ID)
+	if err != nil {
+		return nil, err
+	}
+	current := PostRevision{Title: post.Title, Content: post.Content, Categories: post.Categories, Images: post.Images}
+
+	var edits []postEdit
+	for i, older := range revisions {
+		newer := current
+		if i+1 < len(revisions) {
+			newer = revisions[i+1]
+		}
+		edit := postEdit{
+			EditedBy:      older.EditedBy,
+			EditedAt:      older.ReplacedAt,
+			EditedAtHuman: TimeAgo(older.ReplacedAt),
+			Title:         diffWords(older.Title, newer.Title),
+			Content:       diffWords(older.Content, newer.Content),
+		}
+
+		oldCategories, newCategories := splitCategories(older.Categories), splitCategories(newer.Categories)
+		for _, category := range newCategories {
+			if !slices.Contains(oldCategories, category) {
+				edit.AddedCategories = append(edit.AddedCategories, category)
+			}
+		}
+		for _, category := range oldCategories {
+			if !slices.Contains(newCategories, category) {
+				edit.RemovedCategories = append(edit.RemovedCategories, category)
+			}
+		}
+
+		for _, img := range newer.Images {
+			k := slices.IndexFunc(older.Images, func(o PostImage) bool { return o.ID == img.ID })
+			switch {
+			case k < 0:
+				edit.AddedImages = append(edit.AddedImages, img)
+			case older.Images[k].Caption != img.Caption || older.Images[k].AltText != img.AltText:
+				edit.RelabeledImages = append(edit.RelabeledImages, img)
+			}
+		}
+		for _, img := range older.Images {
+			if !slices.ContainsFunc(newer.Images, func(n PostImage) bool { return n.ID == img.ID }) {
+				edit.RemovedImages = append(edit.RemovedImages, img)
+			}
+		}
+		edits = append(edits, edit)
+	}
+	slices.Reverse(edits)
+	return edits, nil
+}
+
+// EditPostHandler lets the author of a post change its title, content,
+// categories and images under /posts/{id}/edit. The version being replaced
+// is kept in post_revisions.
+func EditPostHandler(w http.ResponseWriter, r *http.Request, post Post) {
+	userID := GetUserIdFromSession(w, r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if userID != post.UserID {
+		RenderError(w, r, "not_owner", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodGet {
+		renderEditForm(w, r, post, userID)
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+	content := strings.TrimSpace(r.FormValue("content"))
+	categories := r.Form["category"]
+	if title == "" || content == "" || len(categories) == 0 {
+		RenderError(w, r, "Title, content, and at least one category are required", http.StatusBadRequest)
+		return
+	}
+	for _, category := range categories {
+		if !isValidCategory(category) {
+			RenderError(w, r, "Invalid category selected", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Images already in the gallery are kept unless ticked for removal,
+	// and may have their caption and alt text changed
+	var kept []PostImage
+	for _, img := range post.Images {
+		if r.FormValue(fmt.Sprintf("remove_image_%d", img.ID)) != "" {
+			continue
+		}
+		img.Caption = strings.TrimSpace(r.FormValue(fmt.Sprintf("caption_image_%d", img.ID)))
+		img.AltText = strings.TrimSpace(r.FormValue(fmt.Sprintf("alt_image_%d", img.ID)))
+		if len([]rune(img.Caption)) > maxAltTextLength || len([]rune(img.AltText)) > maxAltTextLength {
+			RenderError(w, r, "image_text_too_long", http.StatusBadRequest)
+			return
+		}
+		img.Position = len(kept)
+		kept = append(kept, img)
+	}
+	added, _, err := readGalleryForm(r, userID, categories, len(kept))
+	if err != nil {
+		renderUploadError(w, r, err)
+		return
+	}
+
+	sortedCategories := slices.Sorted(slices.Values(categories))
+	sortedCategories = slices.Compact(sortedCategories)
+	if title == post.Title && content == post.Content && len(added) == 0 &&
+		slices.Equal(sortedCategories, splitCategories(post.Categories)) && sameGallery(kept, post.Images) {
+		http.Redirect(w, r, post.URL(), http.StatusSeeOther)
+		return
+	}
+
+	if err := savePostEdit(post, userID, title, content, sortedCategories, kept, added); err != nil {
+		if errors.Is(err, errUploadToken) {
+			renderUploadError(w, r, err)
+			return
+		}
+		log.Printf("Error editing post %d: %v", post.ID, err)
+		RenderError(w, r, "Error editing post", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, post.URL(), http.StatusSeeOther)
+}
+
+// savePostEdit stores the current version of a post as a revision and
+// replaces it with the edited title, content, categories and images. The
+// upload tokens of added images are used up in the same transaction, and
+// nothing is saved if any image cannot be attached or quarantined.
+func savePostEdit(post Post, userID, title, content string, categories []string, kept, added []PostImage) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.Exec("INSERT INTO post_revisions (post_id, title, content, categories, edited_by, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		post.ID, post.Title, post.Content, strings.Join(splitCategories(post.Categories), ","), userID, now)
+	if err != nil {
+		return err
+	}
+	revisionID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, img := range post.Images {
+		_, err := tx.Exec("INSERT INTO post_revision_images (revision_id, image_id, position, caption, alt_text) VALUES (?, ?, ?, ?, ?)",
+			revisionID, img.ID, img.Position, img.Caption, img.AltText)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE posts SET title = ?, content = ?, edited_at = ? WHERE id = ?", title, content, now, post.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM post_categories WHERE post_id = ?", post.ID); err != nil {
+		return err
+	}
+	for _, category := range categories {
+		if _, err := tx.Exec("INSERT INTO post_categories (post_id, category) VALUES (?, ?)", post.ID, category); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM post_images WHERE post_id = ?", post.ID); err != nil {
+		return err
+	}
+	for _, img := range kept {
+		_, err := tx.Exec("INSERT INTO post_images (post_id, image_id, position, caption, alt_text, duplicate_of) VALUES (?, ?, ?, ?, ?, ?)",
+			post.ID, img.ID, img.Position, img.Caption, img.AltText,
+			sql.NullInt64{Int64: int64(img.DuplicateOf), Valid: img.DuplicateOf != 0})
+		if err != nil {
+			return err
+		}
+	}
+	if err := claimGalleryTokens(tx, added, userID); err != nil {
+		return err
+	}
+
+	// Kept images were reviewed for the old categories; moving the post into
+	// a quarantined category holds them back like newly added ones
+	if !quarantinesCategories(splitCategories(post.Categories)) {
+		for _, img := range kept {
+			if _, err := quarantineImage(tx, img.ID, userID, categories); err != nil {
+				return fmt.Errorf("quarantining image %d: %w", img.ID, err)
+			}
+		}
+	}
+	if _, err := attachImages(tx, post.ID, added, userID, categories); err != nil {
+		return fmt.Errorf("attaching images: %w", err)
+	}
+	return tx.Commit()
+}
+
+// renderEditForm shows the edit form of a post, filled in with its
+// current version
+func renderEditForm(w http.ResponseWriter, r *http.Request, post Post, userID string) {
+	current := splitCategories(post.Categories)
+	var choices []categoryChoice
+	for _, category := range validCategories {
+		choices = append(choices, categoryChoice{Name: category, Checked: slices.Contains(current, category)})
+	}
+	var slots []int
+	for i := 0; i < AppConfig.MaxImagesPerPost-len(post.Images); i++ {
+		slots = append(slots, i)
+	}
+
+	tmpl, err := template.ParseFiles("templates/edit_post.html")
+	if err != nil {
+		log.Printf("Error parsing edit template: %v", err)
+		RenderError(w, r, "Error loading page", http.StatusInternalServerError)
+		return
+	}
+	err = tmpl.Execute(w, map[string]interface{}{
+		"Post":                post,
+		"Categories":          choices,
+		"ImageSlots":          slots,
+		"ImageAccept":         imageAccept(),
+		"IsLoggedIn":          true,
+		"IsModerator":         isModerator(userID),
+		"UnreadNotifications": UnreadNotificationCount(userID),
+	})
+	if err != nil {
+		log.Printf("Error executing edit template: %v", err)
+	}
+}
+
+// PostHistoryHandler shows what each edit of a post changed under
+// /posts/{id}/history
+func PostHistoryHandler(w http.ResponseWriter, r *http.Request, post Post) {
+	edits, err := postHistory(post)
+	if err != nil {
+		log.Printf("Error fetching history of post %d: %v", post.ID, err)
+		RenderError(w, r, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	userID := GetUserIdFromSession(w, r)
+	tmpl, err := template.ParseFiles("templates/post_history.html")
+	if err != nil {
+		log.Printf("Error parsing history template: %v", err)
+		RenderError(w, r, "Error loading page", http.StatusInternalServerError)
+		return
+	}
+	err = tmpl.Execute(w, map[string]interface{}{
+		"Post":                post,
+		"Edits":               edits,
+		"IsLoggedIn":          userID != "",
+		"IsModerator":         isModerator(userID),
+		"UnreadNotifications": UnreadNotificationCount(userID),
+	})
+	if err != nil {
+		log.Printf("Error executing history template: %v", err)
+	}
+}
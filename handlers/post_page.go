@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// postURL returns the permalink of a post
+func postURL(postID int) string {
+	return fmt.Sprintf("/posts/%d", postID)
+}
+
+// URL returns the permalink of the post
+func (p Post) URL() string {
+	return postURL(p.ID)
+}
+
+// wantsHTML reports whether a request comes from a plain form submission
+// rather than from a script expecting JSON
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// PostPageHandler shows a single post under /posts/{id}, with its full
+// images and every comment. It also routes /posts/{id}/edit,
+// /posts/{id}/history and /posts/{id}/delete. Deleted posts answer 410
+// Gone, except to moderators viewing them.
+func PostPageHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/posts/"), "/")
+	if _, err := strconv.Atoi(parts[0]); err != nil || len(parts) > 2 {
+		RenderError(w, r, "post_not_found", http.StatusNotFound)
+		return
+	}
+	var action string
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	allowed := []string{http.MethodGet, http.MethodHead}
+	switch action {
+	case "", "history":
+	case "edit":
+		allowed = []string{http.MethodGet, http.MethodPost}
+	case "delete":
+		allowed = []string{http.MethodPost}
+	default:
+		RenderError(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+	if !slices.Contains(allowed, r.Method) {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		RenderError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := parts[0]
+	post, err := GetPostByID(id)
+	if err == sql.ErrNoRows {
+		RenderError(w, r, "post_not_found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching post %s: %v", id, err)
+		RenderError(w, r, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	userID := GetUserIdFromSession(w, r)
+	if post.Deleted() && (action == "edit" || action == "delete" || !isModerator(userID)) {
+		RenderError(w, r, "post_deleted", http.StatusGone)
+		return
+	}
+
+	switch action {
+	case "edit":
+		EditPostHandler(w, r, post)
+		return
+	case "delete":
+		DeletePostHandler(w, r, post)
+		return
+	case "history":
+		PostHistoryHandler(w, r, post)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/post.html")
+	if err != nil {
+		log.Printf("Error parsing post template: %v", err)
+		RenderError(w, r, "Error loading page", http.StatusInternalServerError)
+		return
+	}
+	err = tmpl.Execute(w, map[string]interface{}{
+		"Post":                post,
+		"IsLoggedIn":          userID != "",
+		"IsAuthor":            userID != "" && userID == post.UserID,
+		"IsModerator":         isModerator(userID),
+		"UserID":              userID,
+		"UnreadNotifications": UnreadNotificationCount(userID),
+		"ImageAccept":         imageAccept(),
+	})
+	if err != nil {
+		log.Printf("Error executing post template: %v", err)
+	}
+}
@@ -22,6 +22,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 			p.content, 
 			p.image_path,
 			GROUP_CONCAT(DISTINCT pc.category) as categories, 
+			p.user_id,
 			u.username, 
 			p.created_at,
 			(SELECT COUNT(*) FROM likes WHERE post_id = p.id AND is_like = 1) as like_count,
@@ -29,7 +30,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		FROM posts p 
 		JOIN users u ON p.user_id = u.id 
 		LEFT JOIN post_categories pc ON p.id = pc.post_id 
-		WHERE p.user_id = ?
+		WHERE p.user_id = ? AND p.deleted_at IS NULL
 		GROUP BY p.id 
 		ORDER BY p.created_at DESC`, userID)
 	if err != nil {
@@ -50,6 +51,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 			&post.Content,
 			&post.ImagePath,
 			&categories,
+			&post.UserID,
 			&post.Username,
 			&createdAt,
 			&post.LikeCount,
@@ -65,6 +67,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		post.CreatedAtHuman = TimeAgo(createdAt)
 
 		post.Categories = categories
+		loadPostImages(&post)
 		userPosts = append(userPosts, post)
 	}
 
@@ -76,6 +79,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 			p.content,
 			p.image_path, 
 			GROUP_CONCAT(DISTINCT pc.category) as categories, 
+			p.user_id,
 			u.username, 
 			p.created_at,
 			(SELECT COUNT(*) FROM likes WHERE post_id = p.id AND is_like = 1) as like_count,
@@ -84,7 +88,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		JOIN users u ON p.user_id = u.id 
 		LEFT JOIN post_categories pc ON p.id = pc.post_id 
 		JOIN likes l ON p.id = l.post_id
-		WHERE l.user_id = ? AND l.is_like = 1
+		WHERE l.user_id = ? AND l.is_like = 1 AND p.deleted_at IS NULL
 		GROUP BY p.id 
 		ORDER BY p.created_at DESC`, userID)
 	if err != nil {
@@ -105,6 +109,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 			&post.Content,
 			&post.ImagePath,
 			&categories,
+			&post.UserID,
 			&post.Username,
 			&createdAt,
 			&post.LikeCount,
@@ -120,6 +125,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		post.CreatedAtHuman = TimeAgo(createdAt)
 
 		post.Categories = categories
+		loadPostImages(&post)
 		userLikedPosts = append(userLikedPosts, post)
 	}
 
@@ -133,11 +139,28 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Get how much of the upload quota has been used
+	usage, err := GetUploadUsage(userID)
+	if err != nil {
+		log.Printf("Error fetching upload usage: %v", err)
+	}
+
+	// Show the latest notifications; having seen them, they are read
+	notifications, err := GetNotifications(userID)
+	if err != nil {
+		log.Printf("Error fetching notifications: %v", err)
+	} else if err := MarkNotificationsRead(userID); err != nil {
+		log.Printf("Error marking notifications read: %v", err)
+	}
+
 	data := map[string]interface{}{
-		"Username":     username,
-		"Email":        email,
-		"CreatedPosts": userPosts,
-		"LikedPosts":   userLikedPosts,
+		"Username":      username,
+		"AvatarURL":     avatarURL(userID, 128),
+		"Email":         email,
+		"CreatedPosts":  userPosts,
+		"LikedPosts":    userLikedPosts,
+		"Usage":         usage,
+		"Notifications": notifications,
 	}
 
 	tmpl, err := template.ParseFiles("templates/profile.html")
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Moderation states of an image. Images are approved unless they were
+// attached in a quarantined category, see AppConfig.QuarantineCategories.
+const (
+	ImageApproved = "approved"
+	ImagePending  = "pending"
+	ImageRejected = "rejected"
+)
+
+// Pending reports whether the image is waiting for a moderator
+func (img Image) Pending() bool {
+	return img.Moderation == ImagePending
+}
+
+// Rejected reports whether a moderator has refused the image
+func (img Image) Rejected() bool {
+	return img.Moderation == ImageRejected
+}
+
+// quarantinesCategories reports whether images posted in any of the given
+// categories wait for a moderator before they are shown
+func quarantinesCategories(categories []string) bool {
+	for _, quarantined := range AppConfig.QuarantineCategories {
+		if quarantined == "*" {
+			return true
+		}
+		for _, category := range categories {
+			if category == quarantined {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// quarantineImage holds back an image just attached in the given
+// categories until a moderator has reviewed it. Images of moderators are
+// never held back. Reports whether the image was quarantined.
+func quarantineImage(tx *sql.Tx, imageID int64, userID string, categories []string) (bool, error) {
+	if !quarantinesCategories(categories) || isModerator(userID) {
+		return false, nil
+	}
+	_, err := tx.Exec("UPDATE images SET moderation = ? WHERE id = ?", ImagePending, imageID)
+	return err == nil, err
+}
+
+// PendingImage is a quarantined image along with where it was posted
+type PendingImage struct {
+	Image
+	Username  string // Author of the image
+	PostID    int
+	PostTitle string
+	CommentID int // Comment the image is attached to, 0 for post images
+}
+
+// GetPendingImages returns the images waiting for review, oldest first
+func GetPendingImages() ([]PendingImage, error) {
+	rows, err := db.Query(`
+		SELECT `+imageColumns+`, COALESCE(u.username, ''), p.id, p.title, 0
+		FROM images i
+		JOIN post_images pi ON pi.image_id = i.id
+		JOIN posts p ON p.id = pi.post_id
+		LEFT JOIN users u ON u.id = i.user_id
+		WHERE i.moderation = ?
+		UNION ALL
+		SELECT `+imageColumns+`, COALESCE(u.username, ''), p.id, p.title, c.id
+		FROM images i
+		JOIN comments c ON c.image_id = i.id
+		JOIN posts p ON p.id = c.post_id
+		LEFT JOIN users u ON u.id = i.user_id
+		WHERE i.moderation = ?
+		ORDER BY 1`, ImagePending, ImagePending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []PendingImage
+	for rows.Next() {
+		var p PendingImage
+		if err := rows.Scan(append(imageFields(&p.Image), &p.Username, &p.PostID, &p.PostTitle, &p.CommentID)...); err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	return pending, rows.Err()
+}
+
+// ReviewImage approves or rejects a pending image and notifies its author
+// of the decision. Returns sql.ErrNoRows if the image is not pending.
+func ReviewImage(imageID int64, approve bool, moderatorID, reason string) error {
+	decision := ImageRejected
+	if approve {
+		decision = ImageApproved
+	}
+	result, err := db.Exec(
+		"UPDATE images SET moderation = ?, reviewed_by = ?, reviewed_at = ? WHERE id = ? AND moderation = ?",
+		decision, moderatorID, time.Now(), imageID, ImagePending,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	// Tell the author where the image was posted and what was decided
+	var authorID, title string
+	var postID int
+	err = db.QueryRow(`
+		SELECT i.user_id, p.id, p.title FROM images i
+		JOIN post_images pi ON pi.image_id = i.id
+		JOIN posts p ON p.id = pi.post_id
+		WHERE i.id = ?
+		UNION ALL
+		SELECT i.user_id, p.id, p.title FROM images i
+		JOIN comments c ON c.image_id = i.id
+		JOIN posts p ON p.id = c.post_id
+		WHERE i.id = ?
+		LIMIT 1`, imageID, imageID).Scan(&authorID, &postID, &title)
+	if err == sql.ErrNoRows {
+		return nil // No longer attached to anything
+	} else if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Your image in %q was approved and is now visible.", title)
+	if !approve {
+		message = fmt.Sprintf("Your image in %q was rejected by a moderator.", title)
+		if reason != "" {
+			message += " Reason: " + reason
+		}
+	}
+	return AddNotification(authorID, message, postURL(postID))
+}
+
+// ImageReviewHandler shows moderators the images waiting for review and
+// records their decisions
+func ImageReviewHandler(w http.ResponseWriter, r *http.Request) {
+	moderatorID := requireModerator(w, r)
+	if moderatorID == "" {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		imageID, err := strconv.ParseInt(r.FormValue("image_id"), 10, 64)
+		action := r.FormValue("action")
+		if err != nil || (action != "approve" && action != "reject") {
+			RenderError(w, r, "invalid_input", http.StatusBadRequest)
+			return
+		}
+		reason := strings.TrimSpace(r.FormValue("reason"))
+		err = ReviewImage(imageID, action == "approve", moderatorID, reason)
+		if err != nil && err != sql.ErrNoRows {
+			// An image someone else already reviewed is simply gone from the queue
+			log.Printf("Error reviewing image %d: %v", imageID, err)
+			RenderError(w, r, "server_error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/moderation/images", http.StatusSeeOther)
+		return
+	default:
+		RenderError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pending, err := GetPendingImages()
+	if err != nil {
+		log.Printf("Error fetching pending images: %v", err)
+		RenderError(w, r, "server_error", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/moderation_images.html")
+	if err != nil {
+		log.Printf("Error parsing image review template: %v", err)
+		RenderError(w, r, "Error loading page", http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, map[string]interface{}{"Pending": pending}); err != nil {
+		log.Printf("Error executing image review template: %v", err)
+	}
+}
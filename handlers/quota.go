@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Roles a user can have. New accounts are ordinary users.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var (
+	errQuotaFileSize = errors.New("quota_file_too_large")
+	errQuotaDaily    = errors.New("quota_daily_uploads")
+	errQuotaStorage  = errors.New("quota_storage_full")
+)
+
+// UploadQuota limits how much a role may upload. Zero means no limit.
+type UploadQuota struct {
+	TotalBytes  int // Bytes of images a user may have stored
+	PerDay      int // Uploads allowed in any 24 hours
+	MaxFileSize int // Largest single upload, in bytes
+}
+
+// UploadUsage is how much of their quota a user has used
+type UploadUsage struct {
+	Role       string
+	Quota      UploadQuota
+	TotalBytes int64 // Bytes of all images the user has stored
+	Today      int   // Uploads in the last 24 hours
+}
+
+// GetUserRole returns the role of a user
+func GetUserRole(userID string) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT COALESCE(role, ?) FROM users WHERE id = ?", RoleUser, userID).Scan(&role)
+	return role, err
+}
+
+// SetUserRole changes the role of the user with the given email
+func SetUserRole(email, role string) error {
+	switch role {
+	case RoleUser, RoleModerator, RoleAdmin:
+	default:
+		return fmt.Errorf("unknown role %q", role)
+	}
+	result, err := db.Exec("UPDATE users SET role = ? WHERE email = ?", role, email)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no user with email %q", email)
+	}
+	return nil
+}
+
+// quotaForRole returns the quota configured for a role, falling back to
+// the quota of ordinary users for roles without one
+func quotaForRole(role string) UploadQuota {
+	if quota, ok := AppConfig.UploadQuotas[role]; ok {
+		return quota
+	}
+	return AppConfig.UploadQuotas[RoleUser]
+}
+
+// GetUploadUsage adds up the images a user has uploaded
+func GetUploadUsage(userID string) (UploadUsage, error) {
+	return uploadUsage(db, userID)
+}
+
+// uploadUsage adds up the images a user has uploaded, as seen by q. Anyone
+// without an account, such as anonymous posters, gets the quota of
+// ordinary users.
+func uploadUsage(q queryRower, userID string) (UploadUsage, error) {
+	var role string
+	err := q.QueryRow("SELECT COALESCE(role, ?) FROM users WHERE id = ?", RoleUser, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		role = RoleUser
+	} else if err != nil {
+		return UploadUsage{}, err
+	}
+	usage := UploadUsage{Role: role, Quota: quotaForRole(role)}
+	err = q.QueryRow(`
+		SELECT COALESCE(SUM(size), 0), COALESCE(SUM(created_at >= ?), 0)
+		FROM images WHERE user_id = ?`,
+		time.Now().Add(-24*time.Hour), userID,
+	).Scan(&usage.TotalBytes, &usage.Today)
+	return usage, err
+}
+
+// queryRower is a database or transaction that usage can be read from
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// CheckUploadQuota returns an error if storing size more bytes would take
+// the user over any limit of their role. StoreImage checks again when it
+// records the image, this check only turns uploads away early.
+func CheckUploadQuota(userID string, size int64) error {
+	usage, err := GetUploadUsage(userID)
+	if err != nil {
+		return fmt.Errorf("checking upload quota: %w", err)
+	}
+	return usage.check(size)
+}
+
+// check returns an error if storing size more bytes would go over a limit
+func (u UploadUsage) check(size int64) error {
+	quota := u.Quota
+	if quota.MaxFileSize > 0 && size > int64(quota.MaxFileSize) {
+		return errQuotaFileSize
+	}
+	if quota.PerDay > 0 && u.Today >= quota.PerDay {
+		return errQuotaDaily
+	}
+	if quota.TotalBytes > 0 && u.TotalBytes+size > int64(quota.TotalBytes) {
+		return errQuotaStorage
+	}
+	return nil
+}
+
+// StoragePercent is the share of the storage quota in use, for progress bars
+func (u UploadUsage) StoragePercent() int {
+	if u.Quota.TotalBytes <= 0 {
+		return 0
+	}
+	percent := int(u.TotalBytes * 100 / int64(u.Quota.TotalBytes))
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
+
+// formatBytes renders a size such as 1536 as "1.5 KB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Used, Limit and MaxFile format the usage for the profile page
+func (u UploadUsage) Used() string  { return formatBytes(u.TotalBytes) }
+func (u UploadUsage) Limit() string { return formatBytes(int64(u.Quota.TotalBytes)) }
+func (u UploadUsage) MaxFile() string {
+	if u.Quota.MaxFileSize <= 0 || u.Quota.MaxFileSize > maxImageSize {
+		return formatBytes(maxImageSize)
+	}
+	return formatBytes(int64(u.Quota.MaxFileSize))
+}
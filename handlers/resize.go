@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"strings"
+)
+
+// variantWidths are the widths generated for responsive images. Widths at
+// or above the original width are skipped.
+var variantWidths = []int{320, 800, 1600}
+
+// variantJPEGQuality is the quality used when encoding JPEG variants
+const variantJPEGQuality = 85
+
+// ImageVariant is a resized copy of an uploaded image
+type ImageVariant struct {
+	ID      int64
+	ImageID int64
+	Width   int
+	Height  int
+	Path    string // Key of the file in the blob store
+}
+
+// URL returns the address the variant is served from
+func (v ImageVariant) URL() string {
+	return mediaURL(v.ImageID, fmt.Sprintf("w%d", v.Width))
+}
+
+// toRGBA converts any image to RGBA so the resizer can work on raw pixels
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// resizeImage scales src to the given size by averaging the source pixels
+// that fall into each destination pixel (a box filter). It is meant for
+// downscaling; every destination pixel covers at least one source pixel.
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	in := toRGBA(src)
+	sw, sh := in.Rect.Dx(), in.Rect.Dy()
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for dy := 0; dy < height; dy++ {
+		y0 := dy * sh / height
+		y1 := (dy + 1) * sh / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < width; dx++ {
+			x0 := dx * sw / width
+			x1 := (dx + 1) * sw / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				row := in.Pix[y*in.Stride+x0*4 : y*in.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					b += uint64(row[i+2])
+					a += uint64(row[i+3])
+					n++
+				}
+			}
+
+			o := dy*out.Stride + dx*4
+			out.Pix[o] = uint8(r / n)
+			out.Pix[o+1] = uint8(g / n)
+			out.Pix[o+2] = uint8(b / n)
+			out.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return out
+}
+
+// encodeImage encodes pixels in the given format
+func encodeImage(img image.Image, mimeType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch mimeType {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: variantJPEGQuality})
+	case "image/png":
+		err = png.Encode(&buf, img)
+	default:
+		return nil, fmt.Errorf("cannot encode %q", mimeType)
+	}
+	return buf.Bytes(), err
+}
+
+// createVariants generates, stores and records the resized copies of an
+// image. GIFs are left alone so their animation is preserved, and WebP
+// images because there is no encoder for them.
+func createVariants(img *Image, decoded image.Image) error {
+	if decoded == nil || img.MimeType == "image/gif" || img.MimeType == "image/webp" || img.IsVideo() {
+		return nil
+	}
+
+	format, ok := formatByMimeType(img.MimeType)
+	if !ok {
+		return fmt.Errorf("unsupported image type %q", img.MimeType)
+	}
+	ext := format.Extensions[0]
+	for _, width := range variantWidths {
+		if width >= img.Width {
+			break
+		}
+		height := img.Height * width / img.Width
+		if height < 1 {
+			height = 1
+		}
+
+		if err := storeVariant(img, decoded, width, height, ext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeVariant resizes decoded to the given size, stores it next to the
+// image's file and records it in image_variants
+func storeVariant(img *Image, decoded image.Image, width, height int, ext string) error {
+	data, err := encodeImage(resizeImage(decoded, width, height), img.MimeType)
+	if err != nil {
+		return fmt.Errorf("encoding %dpx variant: %w", width, err)
+	}
+
+	variant := ImageVariant{
+		ImageID: img.ID,
+		Width:   width,
+		Height:  height,
+		Path:    contentPath(img.Hash, fmt.Sprintf("_w%d%s", width, ext)),
+	}
+	if err := putContent(variant.Path, data, img.MimeType); err != nil {
+		return err
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO image_variants (image_id, width, height, path) VALUES (?, ?, ?, ?)",
+		variant.ImageID, variant.Width, variant.Height, variant.Path,
+	)
+	if err != nil {
+		return fmt.Errorf("recording %dpx variant: %w", width, err)
+	}
+	variant.ID, _ = result.LastInsertId()
+	img.Variants = append(img.Variants, variant)
+	return nil
+}
+
+// SrcSet returns the srcset attribute value listing the image and its variants
+func (img Image) SrcSet() string {
+	candidates := make([]string, 0, len(img.Variants)+1)
+	for _, v := range img.Variants {
+		candidates = append(candidates, fmt.Sprintf("%s %dw", v.URL(), v.Width))
+	}
+	if img.Width > 0 {
+		candidates = append(candidates, fmt.Sprintf("%s %dw", img.DisplayURL(), img.Width))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// GetImageVariants returns the resized copies of an image, smallest first
+func GetImageVariants(imageID int64) ([]ImageVariant, error) {
+	rows, err := db.Query(
+		"SELECT id, image_id, width, height, path FROM image_variants WHERE image_id = ? ORDER BY width",
+		imageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []ImageVariant
+	for rows.Next() {
+		var v ImageVariant
+		if err := rows.Scan(&v.ID, &v.ImageID, &v.Width, &v.Height, &v.Path); err != nil {
+			return nil, err
+		}
+		variants = append(variants, v)
+	}
+	return variants, rows.Err()
+}
@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Errors of the resumable upload protocol. Their messages are the keys of
+// their ErrorMessages entries.
+var (
+	errUploadNotFound        = errors.New("upload_not_found")
+	errUploadOffsetMismatch  = errors.New("upload_offset_mismatch")
+	errUploadInProgress      = errors.New("upload_in_progress")
+	errUploadIncomplete      = errors.New("upload_incomplete")
+	errTooManyPendingUploads = errors.New("upload_too_many_pending")
+)
+
+// maxPendingUploads is how many unfinished resumable uploads a user may
+// have at once, which bounds the disk space partial files can take
+const maxPendingUploads = 5
+
+// resumableLocks holds a *sync.Mutex per upload ID so that the chunks of
+// one upload are written one at a time
+var resumableLocks sync.Map
+
+// ResumableUpload is an upload sent in chunks that has not been completed
+type ResumableUpload struct {
+	ID       string
+	UserID   string
+	Filename string
+	Size     int64 // Total length of the file
+	Offset   int64 // Bytes received so far
+}
+
+// ResumableUploadResponse is the JSON answer describing a resumable upload
+type ResumableUploadResponse struct {
+	Success bool   `json:"success"`
+	ID      string `json:"id"`
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size"`
+}
+
+// partialUploadPath returns where the received bytes of an upload are kept
+func partialUploadPath(id string) string {
+	return filepath.Join(AppConfig.PartialUploadsDir, id+".part")
+}
+
+// getResumableUpload returns an unexpired upload of the user. Its offset
+// is the length of the partial file, so bytes that arrived before a
+// connection dropped are kept.
+func getResumableUpload(id, userID string) (ResumableUpload, error) {
+	upload := ResumableUpload{ID: id, UserID: userID}
+	err := db.QueryRow(
+		"SELECT filename, size FROM resumable_uploads WHERE id = ? AND user_id = ? AND updated_at > ?",
+		id, userID, time.Now().Add(-AppConfig.ResumableUploadTTL),
+	).Scan(&upload.Filename, &upload.Size)
+	if err == sql.ErrNoRows {
+		return upload, errUploadNotFound
+	} else if err != nil {
+		return upload, err
+	}
+
+	info, err := os.Stat(partialUploadPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return upload, errUploadNotFound
+	} else if err != nil {
+		return upload, err
+	}
+	upload.Offset = info.Size()
+	return upload, nil
+}
+
+// removeResumableUpload deletes an upload and its partial file
+func removeResumableUpload(id string) error {
+	if err := os.Remove(partialUploadPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	resumableLocks.Delete(id)
+	_, err := db.Exec("DELETE FROM resumable_uploads WHERE id = ?", id)
+	return err
+}
+
+// lockResumableUpload takes the lock of an upload without waiting. It
+// reports false if another request holds it.
+func lockResumableUpload(id string) (unlock func(), ok bool) {
+	value, _ := resumableLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+// ResumableUploadHandler lets large images be sent in chunks, so a dropped
+// connection only costs the chunk in flight:
+//
+//	POST   /upload/resumable       starts an upload of the given filename and size
+//	HEAD   /upload/resumable/{id}  returns the current offset in Upload-Offset
+//	PATCH  /upload/resumable/{id}  appends the body at the offset in Upload-Offset
+//	POST   /upload/resumable/{id}  completes the upload like /upload does
+//	DELETE /upload/resumable/{id}  cancels the upload
+//
+// GET on an upload returns its state as JSON. Received bytes are kept in
+// AppConfig.PartialUploadsDir and are checked by the usual image pipeline
+// once the upload is completed, which answers with an upload token.
+func ResumableUploadHandler(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserIdFromSession(w, r)
+	if userID == "" {
+		writeUploadError(w, "", errors.New("unauthorized"))
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/upload/resumable"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		startResumableUpload(w, r, userID)
+		return
+	case id == "" || strings.Contains(id, "/"):
+		writeUploadError(w, userID, errUploadNotFound)
+		return
+	}
+
+	upload, err := getResumableUpload(id, userID)
+	if err != nil {
+		writeUploadError(w, userID, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		w.Header().Set("Cache-Control", "no-store")
+		writeResumableUpload(w, http.StatusOK, upload)
+	case http.MethodPatch:
+		appendResumableChunk(w, r, upload)
+	case http.MethodPost:
+		completeResumableUpload(w, r, upload)
+	case http.MethodDelete:
+		unlock, ok := lockResumableUpload(id)
+		if !ok {
+			writeUploadError(w, userID, errUploadInProgress)
+			return
+		}
+		defer unlock()
+		if err := removeResumableUpload(id); err != nil {
+			writeUploadError(w, userID, fmt.Errorf("cancelling upload: %w", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PATCH, POST, DELETE")
+		writeUploadResponse(w, http.StatusMethodNotAllowed, UploadResponse{Error: "method_not_allowed", Message: "Method not allowed"})
+	}
+}
+
+// startResumableUpload creates an empty upload for the filename and size
+// in the form. Limits are checked up front so nobody sends 20 MB only to
+// find out the file was never going to be accepted.
+func startResumableUpload(w http.ResponseWriter, r *http.Request, userID string) {
+	filename := r.FormValue("filename")
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 {
+		writeUploadError(w, userID, errImageEmpty)
+		return
+	}
+	if size > maxImageSize {
+		writeUploadError(w, userID, errImageTooLarge)
+		return
+	}
+	if err := CheckUploadQuota(userID, size); err != nil {
+		writeUploadError(w, userID, err)
+		return
+	}
+
+	var pending int
+	err = db.QueryRow(
+		"SELECT COUNT(*) FROM resumable_uploads WHERE user_id = ? AND updated_at > ?",
+		userID, time.Now().Add(-AppConfig.ResumableUploadTTL),
+	).Scan(&pending)
+	if err != nil {
+		writeUploadError(w, userID, fmt.Errorf("counting pending uploads: %w", err))
+		return
+	}
+	if pending >= maxPendingUploads {
+		writeUploadError(w, userID, errTooManyPendingUploads)
+		return
+	}
+
+	upload := ResumableUpload{ID: uuid.New().String(), UserID: userID, Filename: filename, Size: size}
+	if err := os.MkdirAll(AppConfig.PartialUploadsDir, 0o755); err != nil {
+		writeUploadError(w, userID, fmt.Errorf("creating partial uploads directory: %w", err))
+		return
+	}
+	if err := os.WriteFile(partialUploadPath(upload.ID), nil, 0o644); err != nil {
+		writeUploadError(w, userID, fmt.Errorf("creating partial upload: %w", err))
+		return
+	}
+	now := time.Now()
+	_, err = db.Exec(
+		"INSERT INTO resumable_uploads (id, user_id, filename, size, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		upload.ID, userID, filename, size, now, now,
+	)
+	if err != nil {
+		os.Remove(partialUploadPath(upload.ID))
+		writeUploadError(w, userID, fmt.Errorf("recording resumable upload: %w", err))
+		return
+	}
+
+	w.Header().Set("Location", "/upload/resumable/"+upload.ID)
+	writeResumableUpload(w, http.StatusCreated, upload)
+}
+
+// appendResumableChunk writes the request body to the end of the partial
+// file. The client states where the chunk starts, so a chunk repeated
+// after a lost response is refused instead of being written twice.
+func appendResumableChunk(w http.ResponseWriter, r *http.Request, upload ResumableUpload) {
+	unlock, ok := lockResumableUpload(upload.ID)
+	if !ok {
+		writeUploadError(w, upload.UserID, errUploadInProgress)
+		return
+	}
+	defer unlock()
+
+	// Read the offset again now that no other chunk can be in flight
+	upload, err := getResumableUpload(upload.ID, upload.UserID)
+	if err != nil {
+		writeUploadError(w, upload.UserID, err)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		writeUploadError(w, upload.UserID, errUploadOffsetMismatch)
+		return
+	}
+
+	file, err := os.OpenFile(partialUploadPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		writeUploadError(w, upload.UserID, fmt.Errorf("opening partial upload: %w", err))
+		return
+	}
+	written, copyErr := io.Copy(file, io.LimitReader(r.Body, upload.Size-upload.Offset))
+	if err := file.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	upload.Offset += written
+
+	// Whatever arrived is kept, even if the connection dropped midway
+	if _, err := db.Exec("UPDATE resumable_uploads SET updated_at = ? WHERE id = ?", time.Now(), upload.ID); err != nil {
+		log.Printf("Error updating resumable upload %s: %v", upload.ID, err)
+	}
+	if copyErr != nil {
+		writeUploadError(w, upload.UserID, fmt.Errorf("chunk of upload %s ended after %d bytes: %w", upload.ID, written, copyErr))
+		return
+	}
+
+	// Bytes past the announced size are not part of the file
+	if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		writeUploadError(w, upload.UserID, errImageTooLarge)
+		return
+	}
+	writeResumableUpload(w, http.StatusOK, upload)
+}
+
+// completeResumableUpload runs a fully received file through the image
+// pipeline and answers like UploadHandler. The partial file is kept if
+// processing fails for a reason other than the image itself, so the
+// completion can be retried.
+func completeResumableUpload(w http.ResponseWriter, r *http.Request, upload ResumableUpload) {
+	unlock, ok := lockResumableUpload(upload.ID)
+	if !ok {
+		writeUploadError(w, upload.UserID, errUploadInProgress)
+		return
+	}
+	defer unlock()
+
+	upload, err := getResumableUpload(upload.ID, upload.UserID)
+	if err != nil {
+		writeUploadError(w, upload.UserID, err)
+		return
+	}
+	if upload.Offset != upload.Size {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		writeUploadError(w, upload.UserID, errUploadIncomplete)
+		return
+	}
+
+	file, err := os.Open(partialUploadPath(upload.ID))
+	if err != nil {
+		writeUploadError(w, upload.UserID, fmt.Errorf("opening partial upload: %w", err))
+		return
+	}
+	img, err := ProcessImageUpload(upload.UserID, upload.Filename, file, uploadOptions(r))
+	file.Close()
+	if err != nil {
+		if _, rejected := ErrorMessages[err.Error()]; rejected {
+			if err := removeResumableUpload(upload.ID); err != nil {
+				log.Printf("Error removing rejected upload %s: %v", upload.ID, err)
+			}
+		}
+		writeUploadError(w, upload.UserID, err)
+		return
+	}
+
+	if err := removeResumableUpload(upload.ID); err != nil {
+		log.Printf("Error removing completed upload %s: %v", upload.ID, err)
+	}
+	issueUploadToken(w, upload.UserID, img)
+}
+
+// writeResumableUpload answers with the state of an upload, in headers
+// for HEAD requests and as JSON otherwise
+func writeResumableUpload(w http.ResponseWriter, status int, upload ResumableUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	writeUploadResponse(w, status, ResumableUploadResponse{
+		Success: true,
+		ID:      upload.ID,
+		Offset:  upload.Offset,
+		Size:    upload.Size,
+	})
+}
+
+// expireResumableUploads removes uploads that received no chunk within
+// AppConfig.ResumableUploadTTL and returns how many there were
+func expireResumableUploads(dryRun bool) (int64, error) {
+	rows, err := db.Query("SELECT id FROM resumable_uploads WHERE updated_at <= ?", time.Now().Add(-AppConfig.ResumableUploadTTL))
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if !dryRun {
+		for _, id := range ids {
+			if err := removeResumableUpload(id); err != nil {
+				return 0, fmt.Errorf("removing expired upload %s: %w", id, err)
+			}
+		}
+	}
+	return int64(len(ids)), nil
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// allowedTags lists the elements kept by sanitizeHTML and the attributes
+// each may carry. Other elements are dropped but their text is kept.
+var allowedTags = map[string][]string{
+	"p": nil, "br": nil, "hr": nil,
+	"strong": nil, "em": nil,
+	"code": {"class"}, "pre": nil,
+	"blockquote": nil,
+	"ul":         nil, "ol": {"start"}, "li": nil,
+	"a":  {"href", "title"},
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+}
+
+// droppedTags are elements removed together with everything inside them
+var droppedTags = []string{
+	"script", "style", "iframe", "object", "embed", "textarea", "title",
+	"noscript", "template", "svg", "math", "select",
+}
+
+var (
+	tagName    = regexp.MustCompile(`^</?([A-Za-z][A-Za-z0-9]*)`)
+	tagAttr    = regexp.MustCompile(`^[\s/]*([^\s"'>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]*)))?`)
+	digitsOnly = regexp.MustCompile(`^[0-9]{1,9}$`)
+)
+
+// safeURL checks a link target, which must be relative or use http, https
+// or mailto
+func safeURL(raw string) (string, bool) {
+	u := strings.TrimSpace(raw)
+	for _, r := range u {
+		if r < 0x20 || r == 0x7f {
+			return "", false
+		}
+	}
+	if i := strings.IndexAny(u, ":/?#"); i >= 0 && u[i] == ':' {
+		switch strings.ToLower(u[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "", false
+		}
+	}
+	return u, true
+}
+
+// sanitizeHTML keeps only the allowed elements and attributes of an HTML
+// fragment and escapes all text, so the result is safe to put in a page.
+// Links are marked nofollow since they come from users.
+func sanitizeHTML(fragment string) template.HTML {
+	var out strings.Builder
+	var open []string
+	for i := 0; i < len(fragment); {
+		lt := strings.IndexByte(fragment[i:], '<')
+		if lt < 0 {
+			out.WriteString(html.EscapeString(html.UnescapeString(fragment[i:])))
+			break
+		}
+		out.WriteString(html.EscapeString(html.UnescapeString(fragment[i : i+lt])))
+		i += lt
+
+		if strings.HasPrefix(fragment[i:], "<!--") {
+			end := strings.Index(fragment[i+4:], "-->")
+			if end < 0 {
+				break
+			}
+			i += 4 + end + 3
+			continue
+		}
+		m := tagName.FindStringSubmatch(fragment[i:])
+		if m == nil {
+			out.WriteString("&lt;")
+			i++
+			continue
+		}
+		gt := strings.IndexByte(fragment[i:], '>')
+		if gt < 0 {
+			break
+		}
+		name := strings.ToLower(m[1])
+		closing := fragment[i+1] == '/'
+		attrs := fragment[i+len(m[0]) : i+gt]
+		i += gt + 1
+
+		if slices.Contains(droppedTags, name) {
+			if !closing {
+				end := strings.Index(strings.ToLower(fragment[i:]), "</"+name)
+				if end < 0 {
+					break
+				}
+				i += end
+			}
+			continue
+		}
+		allowed, ok := allowedTags[name]
+		if !ok {
+			continue
+		}
+
+		if closing {
+			// Close the innermost open element of that name, along with
+			// any elements left open inside it
+			if n := lastIndex(open, name); n >= 0 {
+				for len(open) > n {
+					out.WriteString("</" + open[len(open)-1] + ">")
+					open = open[:len(open)-1]
+				}
+			}
+			continue
+		}
+		if name == "a" && slices.Contains(open, "a") {
+			continue
+		}
+
+		out.WriteString("<" + name)
+		for rest := attrs; ; {
+			a := tagAttr.FindStringSubmatch(rest)
+			if a == nil {
+				break
+			}
+			rest = rest[len(a[0]):]
+			key := strings.ToLower(a[1])
+			value := html.UnescapeString(a[2] + a[3] + a[4])
+			if !slices.Contains(allowed, key) || !safeAttr(name, key, value) {
+				continue
+			}
+			if key == "href" {
+				value, _ = safeURL(value)
+			}
+			out.WriteString(" " + key + `="` + html.EscapeString(value) + `"`)
+		}
+		if name == "a" {
+			out.WriteString(` rel="nofollow noopener ugc"`)
+		}
+		out.WriteString(">")
+		if name != "br" && name != "hr" {
+			open = append(open, name)
+		}
+	}
+	for len(open) > 0 {
+		out.WriteString("</" + open[len(open)-1] + ">")
+		open = open[:len(open)-1]
+	}
+	return template.HTML(out.String())
+}
+
+// safeAttr checks the value of an allowed attribute
+func safeAttr(tag, key, value string) bool {
+	switch key {
+	case "href":
+		_, ok := safeURL(value)
+		return ok
+	case "class":
+		return tag == "code" && mdCodeClass.MatchString(value)
+	case "start":
+		return digitsOnly.MatchString(value)
+	}
+	return true
+}
+
+func lastIndex(names []string, name string) int {
+	for i := len(names) - 1; i >= 0; i-- {
+		if names[i] == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Image represents an uploaded image. Files are stored under their
+// SHA-256 content hash, so identical uploads share a single file.
+type Image struct {
+	ID           int64
+	UserID       string // User who uploaded the image
+	Hash         string // Hex-encoded SHA-256 of the file content
+	Path         string // Key of the file in the blob store
+	OriginalName string // File name as sent by the client, never used on disk
+	MimeType     string
+	Size         int64
+	Width        int
+	Height       int
+	Frames       int    // Number of frames, more than one for animated GIFs
+	PosterPath   string // Key of the static first frame of an animated GIF
+	PHash        string // Perceptual hash of the pixels, empty if they could not be decoded
+	BlurHash     string // Blurred placeholder shown while the image loads, empty if it could not be decoded
+	Moderation   string // ImageApproved, or ImagePending or ImageRejected when quarantined
+	CreatedAt    time.Time
+	Variants     []ImageVariant // Resized copies, smallest first
+}
+
+// imageColumns lists the images columns read by imageFields. Queries must
+// alias the images table as i.
+const imageColumns = `i.id, COALESCE(i.user_id, ''), i.hash, i.path, COALESCE(i.original_name, ''),
+	COALESCE(i.mime_type, ''), COALESCE(i.size, 0), COALESCE(i.width, 0), COALESCE(i.height, 0),
+	COALESCE(i.frames, 1), COALESCE(i.poster_path, ''), COALESCE(i.phash, ''),
+	COALESCE(i.blurhash, ''), COALESCE(i.moderation, 'approved'), i.created_at`
+
+// imageFields returns the scan destinations matching imageColumns
+func imageFields(img *Image) []interface{} {
+	return []interface{}{
+		&img.ID, &img.UserID, &img.Hash, &img.Path, &img.OriginalName,
+		&img.MimeType, &img.Size, &img.Width, &img.Height,
+		&img.Frames, &img.PosterPath, &img.PHash, &img.BlurHash, &img.Moderation, &img.CreatedAt,
+	}
+}
+
+// GetImage returns a stored image along with its variants
+func GetImage(id int64) (Image, error) {
+	var img Image
+	err := db.QueryRow("SELECT "+imageColumns+" FROM images i WHERE i.id = ?", id).Scan(imageFields(&img)...)
+	if err != nil {
+		return Image{}, err
+	}
+	img.Variants, err = GetImageVariants(img.ID)
+	return img, err
+}
+
+// URL returns the address the image is served from
+func (img Image) URL() string {
+	return mediaURL(img.ID, "")
+}
+
+// contentPath returns the sharded storage path for a content hash,
+// e.g. "ab/cd/abcdef...jpg", so no single directory grows too large.
+func contentPath(hash, ext string) string {
+	return path.Join(hash[:2], hash[2:4], hash+ext)
+}
+
+// putContent stores data under its content-addressed key unless the
+// store already holds that content.
+func putContent(key string, data []byte, mimeType string) error {
+	if _, err := blobStore.Stat(key); err == nil {
+		return nil // Identical content is already stored
+	} else if !errors.Is(err, ErrBlobNotFound) {
+		return err
+	}
+	return blobStore.Put(key, bytes.NewReader(data), int64(len(data)), mimeType)
+}
+
+// recordImage inserts an image row once the upload quota of its owner
+// allows it. The row is written before the quota is checked, so the
+// transaction holds the write lock and concurrent uploads cannot all pass
+// the check on the same usage.
+func recordImage(img Image) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO images (user_id, hash, path, original_name, mime_type, size, width, height, frames, phash, blurhash, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		img.UserID, img.Hash, img.Path, img.OriginalName, img.MimeType, img.Size, img.Width, img.Height, img.Frames, img.PHash, img.BlurHash, img.CreatedAt,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("recording image: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("retrieving image ID: %w", err)
+	}
+
+	usage, err := uploadUsage(tx, img.UserID)
+	if err != nil {
+		return 0, fmt.Errorf("checking upload quota: %w", err)
+	}
+	// Leave out the image being recorded
+	usage.TotalBytes -= img.Size
+	usage.Today--
+	if err := usage.check(img.Size); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// StoreImage saves the image content under its hash, records the upload
+// in the images table and generates its resized variants, or the poster
+// frame of an animated GIF.
+func StoreImage(userID, originalName string, info ImageInfo, data []byte) (Image, error) {
+	format, ok := formatByMimeType(info.MimeType)
+	if !ok {
+		return Image{}, fmt.Errorf("unsupported image type %q", info.MimeType)
+	}
+	ext := format.Extensions[0]
+
+	sum := sha256.Sum256(data)
+	img := Image{
+		UserID:       userID,
+		Hash:         hex.EncodeToString(sum[:]),
+		OriginalName: filepath.Base(originalName),
+		MimeType:     info.MimeType,
+		Size:         int64(len(data)),
+		Width:        info.Width,
+		Height:       info.Height,
+		Frames:       info.Frames,
+		PHash:        info.PHash,
+		BlurHash:     blurHash(info.Decoded),
+		Moderation:   ImageApproved,
+		CreatedAt:    time.Now(),
+	}
+	if img.PHash == "" {
+		img.PHash = perceptualHash(info.Decoded)
+	}
+	img.Path = contentPath(img.Hash, ext)
+
+	if err := putContent(img.Path, data, img.MimeType); err != nil {
+		return Image{}, err
+	}
+
+	id, err := recordImage(img)
+	if err != nil {
+		return Image{}, err
+	}
+	img.ID = id
+
+	if err := createVariants(&img, info.Decoded); err != nil {
+		return Image{}, fmt.Errorf("creating image variants: %w", err)
+	}
+	if err := createPoster(&img, info.Decoded); err != nil {
+		return Image{}, fmt.Errorf("creating GIF poster: %w", err)
+	}
+	return img, nil
+}
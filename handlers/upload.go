@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadOptions control how an uploaded image is processed
+type UploadOptions struct {
+	KeepOriginal bool // Store the file exactly as uploaded, metadata included
+}
+
+// ProcessImageUpload runs an uploaded file through the image pipeline:
+// quota checks, malware scanning, content validation, transcoding or metadata removal, storage and variant generation.
+// Validation failures are returned as errors whose message is the key of
+// an ErrorMessages entry, so they can be passed to renderUploadError.
+func ProcessImageUpload(userID, filename string, r io.Reader, opts UploadOptions) (Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImageSize+1))
+	if err != nil {
+		return Image{}, fmt.Errorf("reading upload: %w", err)
+	}
+
+	// Enforce the limits of the user's role before doing any work
+	if err := CheckUploadQuota(userID, int64(len(data))); err != nil {
+		return Image{}, err
+	}
+
+	// Every file is checked for malware, whatever it turns out to be
+	if err := ScanUpload(userID, filename, data); err != nil {
+		return Image{}, err
+	}
+
+	// Check the image by its content, not its name
+	info, err := ValidateImage(data, filename)
+	if err != nil {
+		return Image{}, err
+	}
+
+	switch {
+	case needsTranscoding(info.MimeType):
+		// Convert formats browsers cannot show; the result has no metadata
+		data, info, err = TranscodeImage(data, info)
+		if err != nil {
+			return Image{}, fmt.Errorf("transcoding image: %w", err)
+		}
+	case !opts.KeepOriginal:
+		// Remove EXIF and other metadata unless asked to keep the original
+		data, info, err = StripMetadata(data, info)
+		if err != nil {
+			return Image{}, fmt.Errorf("re-encoding image: %w", err)
+		}
+	default:
+		// The original keeps its EXIF orientation, but the variants are
+		// made from the pixels and need it applied
+		info = orientImage(data, info)
+	}
+
+	// Refuse pictures moderators have banned, however they were re-encoded
+	info.PHash = perceptualHash(info.Decoded)
+	if err := CheckBannedImage(info.PHash); err != nil {
+		return Image{}, err
+	}
+
+	// Save the image under its content hash
+	return StoreImage(userID, filename, info, data)
+}
+
+// errUploadToken is returned when a form refers to an upload that does not
+// exist, has expired or belongs to someone else. Its message is the key of
+// its ErrorMessages entry.
+var errUploadToken = errors.New("upload_token_invalid")
+
+// UploadResponse is the JSON answer of UploadHandler
+type UploadResponse struct {
+	Success bool   `json:"success"`
+	Token   string `json:"token,omitempty"` // Sent back with the post or comment form
+	URL     string `json:"url,omitempty"`   // Preview of the uploaded image
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Error   string `json:"error,omitempty"`   // ErrorMessages key of a failed upload
+	Message string `json:"message,omitempty"` // Human-readable explanation of Error
+}
+
+// UploadHandler accepts a single image ahead of the form it belongs to.
+// The image goes through the usual pipeline and is answered with a token
+// that the post or comment form submits in place of the file. Tokens that
+// are never used expire after AppConfig.UploadTokenTTL.
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeUploadResponse(w, http.StatusMethodNotAllowed, UploadResponse{Error: "method_not_allowed", Message: "Method not allowed"})
+		return
+	}
+
+	userID := GetUserIdFromSession(w, r)
+	if userID == "" {
+		writeUploadError(w, "", errors.New("unauthorized"))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+1<<20)
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeUploadError(w, userID, errImageTooLarge)
+		} else {
+			writeUploadError(w, userID, errImageEmpty)
+		}
+		return
+	}
+	defer file.Close()
+
+	img, err := ProcessImageUpload(userID, header.Filename, file, uploadOptions(r))
+	if err != nil {
+		writeUploadError(w, userID, err)
+		return
+	}
+	issueUploadToken(w, userID, img)
+}
+
+// uploadOptions returns the options for an image uploaded ahead of its form.
+// Post forms send the categories picked so far and comment forms the post
+// they belong to, so metadata rules still apply.
+func uploadOptions(r *http.Request) UploadOptions {
+	categories := r.Form["category"]
+	if postID, err := strconv.Atoi(r.FormValue("post_id")); err == nil {
+		categories = postCategories(postID)
+	}
+	return UploadOptions{KeepOriginal: keepsOriginalImage(categories)}
+}
+
+// issueUploadToken records a token for a processed upload and answers with
+// it and a preview of the image
+func issueUploadToken(w http.ResponseWriter, userID string, img Image) {
+	token := uuid.New().String()
+	now := time.Now()
+	_, err := db.Exec(
+		"INSERT INTO upload_tokens (token, image_id, user_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		token, img.ID, userID, now, now.Add(AppConfig.UploadTokenTTL),
+	)
+	if err != nil {
+		writeUploadError(w, userID, fmt.Errorf("recording upload token: %w", err))
+		return
+	}
+
+	writeUploadResponse(w, http.StatusCreated, UploadResponse{
+		Success: true,
+		Token:   token,
+		URL:     img.DisplayURL(),
+		Width:   img.Width,
+		Height:  img.Height,
+	})
+}
+
+// writeUploadError answers with the ErrorMessages entry named by err, as
+// shown to userID, or logs err and reports a server error if it is not a
+// known key
+func writeUploadError(w http.ResponseWriter, userID string, err error) {
+	key := err.Error()
+	data, ok := errorMessage(key, userID)
+	if !ok {
+		log.Printf("Error processing upload: %v", err)
+		key = "server_error"
+		data = ErrorMessages[key]
+	}
+	writeUploadResponse(w, data.StatusCode, UploadResponse{Error: key, Message: data.ErrorMessage})
+}
+
+func writeUploadResponse(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// lookupUploadToken returns the image uploaded under a token without
+// using the token up. The token is claimed by claimUploadToken when the
+// post or comment it is attached to is saved.
+func lookupUploadToken(token, userID string) (Image, error) {
+	var imageID int64
+	err := db.QueryRow(
+		"SELECT image_id FROM upload_tokens WHERE token = ? AND user_id = ? AND expires_at > ?",
+		token, userID, time.Now(),
+	).Scan(&imageID)
+	if err == sql.ErrNoRows {
+		return Image{}, errUploadToken
+	} else if err != nil {
+		return Image{}, err
+	}
+	return GetImage(imageID)
+}
+
+// claimUploadToken uses a token up within the transaction saving the post
+// or comment it is attached to, so an upload can only be attached once
+// even when two forms refer to it at the same time
+func claimUploadToken(tx *sql.Tx, token, userID string) error {
+	result, err := tx.Exec("DELETE FROM upload_tokens WHERE token = ? AND user_id = ? AND expires_at > ?",
+		token, userID, time.Now())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		return errUploadToken
+	}
+	return nil
+}
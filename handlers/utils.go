@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
@@ -69,12 +70,177 @@ var (
 			ErrorMessage: "Post not found",
 			HelpMessage:  "The post you're looking for might have been deleted or never existed.",
 		},
+		"post_deleted": {
+			StatusCode:   http.StatusGone,
+			ErrorMessage: "Post deleted",
+			HelpMessage:  "This post was deleted by its author or a moderator.",
+		},
 		"comment_not_found": {
 			StatusCode:   http.StatusNotFound,
 			ErrorMessage: "Comment not found",
 			HelpMessage:  "The comment you're looking for might have been deleted or never existed.",
 		},
 
+		// Upload errors
+		"image_empty": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "The uploaded image is empty",
+			HelpMessage:  "The file you selected contains no data. Please choose another image.",
+		},
+		"image_too_large": {
+			StatusCode:   http.StatusRequestEntityTooLarge,
+			ErrorMessage: "Image size exceeds the upload limit",
+			HelpMessage:  "Please compress the image or choose a smaller file.",
+		},
+		"image_invalid_type": {
+			StatusCode:   http.StatusUnsupportedMediaType,
+			ErrorMessage: "Invalid image type",
+			HelpMessage:  "Only JPEG, PNG, GIF, WebP and HEIC images and MP4 and WebM clips are allowed.",
+		},
+		"image_type_mismatch": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "Image content does not match its file type",
+			HelpMessage:  "The file's extension does not match its actual format. Please save it with the correct extension and try again.",
+		},
+		"image_corrupt": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "The image could not be read",
+			HelpMessage:  "The file appears to be damaged or is not a valid image. Please try exporting it again.",
+		},
+		"image_dimensions_too_large": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "Image dimensions are too large",
+			HelpMessage:  "Please resize the image to a smaller resolution and try again.",
+		},
+
+		"image_heic_unsupported": {
+			StatusCode:   http.StatusUnsupportedMediaType,
+			ErrorMessage: "HEIC photos cannot be converted on this server",
+			HelpMessage:  "Please export the photo as JPEG and try again. On an iPhone, Settings > Camera > Formats > Most Compatible takes photos as JPEG.",
+		},
+		"image_webp_animated": {
+			StatusCode:   http.StatusUnsupportedMediaType,
+			ErrorMessage: "Animated WebP images are not supported",
+			HelpMessage:  "Please upload the animation as a GIF instead.",
+		},
+		"image_banned": {
+			StatusCode:   http.StatusForbidden,
+			ErrorMessage: "This image is not allowed",
+			HelpMessage:  "The image matches one that moderators have banned from the forum.",
+		},
+		"image_unverifiable": {
+			StatusCode:   http.StatusUnprocessableEntity,
+			ErrorMessage: "This file could not be checked",
+			HelpMessage:  "Clips without a preview frame cannot be compared with banned images. Please upload it in another format.",
+		},
+		"video_unsupported_codec": {
+			StatusCode:   http.StatusUnsupportedMediaType,
+			ErrorMessage: "This clip cannot be played in browsers",
+			HelpMessage:  "Clips must be H.264, VP8, VP9 or AV1 video with AAC, Opus or Vorbis audio. Please export the clip again with one of these codecs.",
+		},
+		"video_too_long": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "The clip is too long",
+			HelpMessage:  "Please trim the clip and try again.",
+		},
+		"video_too_large": {
+			StatusCode:   http.StatusRequestEntityTooLarge,
+			ErrorMessage: "The clip is too large",
+			HelpMessage:  "Please export the clip at a lower resolution or bitrate and try again.",
+		},
+		"video_corrupt": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "The clip could not be read",
+			HelpMessage:  "The file appears to be damaged or incomplete. Please try exporting it again.",
+		},
+		"upload_infected": {
+			StatusCode:   http.StatusUnprocessableEntity,
+			ErrorMessage: "This file was flagged as malware",
+			HelpMessage:  "The virus scanner found something harmful in the file, so it was not stored.",
+		},
+		"upload_scan_unavailable": {
+			StatusCode:   http.StatusServiceUnavailable,
+			ErrorMessage: "Uploads cannot be checked right now",
+			HelpMessage:  "Files are scanned for malware before they are stored and the scanner is unavailable. Please try again in a few minutes.",
+		},
+		"avatar_invalid_type": {
+			StatusCode:   http.StatusUnsupportedMediaType,
+			ErrorMessage: "This image cannot be used as an avatar",
+			HelpMessage:  "Avatars must be JPEG, PNG, GIF or HEIC pictures. Please convert the image and try again.",
+		},
+		"image_text_too_long": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "Image description is too long",
+			HelpMessage:  "Alt text and captions can be at most 1000 characters. Please shorten them and try again.",
+		},
+		"post_too_many_images": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "Too many images",
+			HelpMessage:  "A post has room for a limited number of images. Please remove one before adding another.",
+		},
+		"upload_token_invalid": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "The uploaded image has expired",
+			HelpMessage:  "Images uploaded ahead of a post can only be attached for a limited time. Please add the image again.",
+		},
+		"upload_not_found": {
+			StatusCode:   http.StatusNotFound,
+			ErrorMessage: "Upload not found",
+			HelpMessage:  "Unfinished uploads are discarded after a while. Please start the upload again.",
+		},
+		"upload_offset_mismatch": {
+			StatusCode:   http.StatusConflict,
+			ErrorMessage: "The chunk does not continue the upload",
+			HelpMessage:  "Ask for the current offset of the upload and send the rest of the file from there.",
+		},
+		"upload_in_progress": {
+			StatusCode:   http.StatusConflict,
+			ErrorMessage: "Another chunk of this upload is still being received",
+			HelpMessage:  "Wait a moment and ask for the current offset before sending the next chunk.",
+		},
+		"upload_incomplete": {
+			StatusCode:   http.StatusConflict,
+			ErrorMessage: "The upload is not complete yet",
+			HelpMessage:  "Send the rest of the file before completing the upload.",
+		},
+		"upload_too_many_pending": {
+			StatusCode:   http.StatusTooManyRequests,
+			ErrorMessage: "Too many unfinished uploads",
+			HelpMessage:  "Finish or cancel some of your uploads before starting another one.",
+		},
+		"gif_too_many_frames": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "The animated GIF has too many frames",
+			HelpMessage:  "Please shorten the animation or lower its frame rate and try again.",
+		},
+		"gif_too_many_pixels": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "The animated GIF is too large",
+			HelpMessage:  "Its frames add up to more pixels than we can show. Please make it smaller or shorter.",
+		},
+		"gif_too_long": {
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "The animated GIF is too long",
+			HelpMessage:  "Please trim the animation to a shorter loop and try again.",
+		},
+
+		// Quota errors
+		"quota_file_too_large": {
+			StatusCode:   http.StatusRequestEntityTooLarge,
+			ErrorMessage: "Image size exceeds the upload limit",
+			HelpMessage:  "Your profile page shows the largest file you can upload. Please choose a smaller image.",
+		},
+		"quota_daily_uploads": {
+			StatusCode:   http.StatusTooManyRequests,
+			ErrorMessage: "Daily upload limit reached",
+			HelpMessage:  "You have uploaded as many images as your account allows in 24 hours. Please try again later.",
+		},
+		"quota_storage_full": {
+			StatusCode:   http.StatusRequestEntityTooLarge,
+			ErrorMessage: "Your image storage is full",
+			HelpMessage:  "You have used all the storage your account allows. Your profile page shows your usage.",
+		},
+
 		// Server errors
 		"database_error": {
 			StatusCode:   http.StatusInternalServerError,
@@ -101,6 +267,23 @@ var (
 	}
 )
 
+// errorMessage returns the ErrorMessages entry for key as shown to a user.
+// Messages about the file size name the largest file the user may upload,
+// which depends on their role.
+func errorMessage(key, userID string) (ErrorData, bool) {
+	data, ok := ErrorMessages[key]
+	if ok && (key == errImageTooLarge.Error() || key == errQuotaFileSize.Error()) {
+		limit := formatBytes(maxImageSize)
+		if usage, err := GetUploadUsage(userID); err != nil {
+			log.Printf("Error fetching upload limit of user %s: %v", userID, err)
+		} else {
+			limit = usage.MaxFile()
+		}
+		data.ErrorMessage = fmt.Sprintf("Image size exceeds the %s limit", limit)
+	}
+	return data, ok
+}
+
 // RenderErrorFunc is the type for rendering error responses
 type RenderErrorFunc func(w http.ResponseWriter, r *http.Request, errorKey string, statusCode int)
 
@@ -111,7 +294,7 @@ func renderError(w http.ResponseWriter, r *http.Request, errorKey string, status
 	isLoggedIn := userID != ""
 
 	// Get error data from the map, or use default if not found
-	errorData, exists := ErrorMessages[errorKey]
+	errorData, exists := errorMessage(errorKey, userID)
 	if !exists {
 		errorData = ErrorData{
 			StatusCode:   statusCode,
@@ -0,0 +1,657 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Video validation errors. Each message is the key of its ErrorMessages entry.
+var (
+	errVideoCodec    = errors.New("video_unsupported_codec")
+	errVideoTooLong  = errors.New("video_too_long")
+	errVideoTooLarge = errors.New("video_too_large")
+	errVideoCorrupt  = errors.New("video_corrupt")
+)
+
+// videoPosterTimeout bounds how long the poster command may run
+const videoPosterTimeout = 30 * time.Second
+
+// videoInfo is what the container of a clip says about it
+type videoInfo struct {
+	Width    int
+	Height   int
+	Duration time.Duration
+	HasVideo bool
+	Codecs   []string // Codec of every audio and video track, e.g. "avc1" or "V_VP9"
+}
+
+// playableCodecs are the codecs browsers can play: MP4 sample entry types
+// and WebM codec IDs
+var playableCodecs = map[string]bool{
+	"avc1": true, "avc3": true, "vp09": true, "av01": true, "mp4a": true, "Opus": true,
+	"V_VP8": true, "V_VP9": true, "V_AV1": true, "A_VORBIS": true, "A_OPUS": true,
+}
+
+// isVideoType reports whether a MIME type is one of the video formats
+func isVideoType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "video/")
+}
+
+// IsVideo reports whether the upload is a video clip rather than an image
+func (img Image) IsVideo() bool {
+	return isVideoType(img.MimeType)
+}
+
+// PosterURL is the address of the still frame shown before a clip plays,
+// or "" if none could be extracted
+func (img Image) PosterURL() string {
+	if img.PosterPath == "" {
+		return ""
+	}
+	return mediaURL(img.ID, "poster")
+}
+
+// videoConfig returns a DecodeConfig function reading the dimensions of a
+// clip from its container
+func videoConfig(probe func([]byte) (videoInfo, error)) func([]byte) (image.Config, error) {
+	return func(data []byte) (image.Config, error) {
+		info, err := probe(data)
+		if err != nil {
+			return image.Config{}, err
+		}
+		return image.Config{Width: info.Width, Height: info.Height}, nil
+	}
+}
+
+// validateVideo checks that a clip is small and short enough and that
+// browsers can play all of its tracks
+func validateVideo(data []byte, format imageFormat) error {
+	if len(data) > AppConfig.MaxVideoSize {
+		return errVideoTooLarge
+	}
+	info, err := format.Probe(data)
+	if err != nil {
+		return err
+	}
+	if !info.HasVideo {
+		return errVideoCodec
+	}
+	for _, codec := range info.Codecs {
+		if !playableCodecs[codec] {
+			log.Printf("Refused clip with codec %q", codec)
+			return errVideoCodec
+		}
+	}
+	if info.Duration <= 0 {
+		return errVideoCorrupt
+	}
+	if info.Duration > AppConfig.MaxVideoDuration {
+		return errVideoTooLong
+	}
+	return nil
+}
+
+// videoPoster returns the first frame of a clip as extracted by
+// FORUM_VIDEO_POSTER_COMMAND, or nil without a command or if it fails.
+// MP4 files cannot be read from a pipe, so the command gets the path of
+// the clip in place of a "{}" argument, or as its last argument, and
+// writes a PNG or JPEG to standard output.
+func videoPoster(data []byte, format imageFormat) image.Image {
+	args := strings.Fields(AppConfig.VideoPosterCommand)
+	if len(args) == 0 {
+		return nil
+	}
+
+	file, err := os.CreateTemp("", "clip-*"+format.Extensions[0])
+	if err != nil {
+		log.Printf("Error creating temporary clip: %v", err)
+		return nil
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Error writing temporary clip: %v", err)
+		return nil
+	}
+
+	replaced := false
+	for i, arg := range args {
+		if arg == "{}" {
+			args[i] = file.Name()
+			replaced = true
+		}
+	}
+	if !replaced {
+		args = append(args, file.Name())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), videoPosterTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("Error extracting poster frame: %v: %s", err, strings.TrimSpace(stderr.String()))
+		return nil
+	}
+
+	// The frame is checked like any other upload
+	config, kind, err := image.DecodeConfig(bytes.NewReader(stdout.Bytes()))
+	if err != nil || (kind != "png" && kind != "jpeg") ||
+		config.Width > AppConfig.MaxImageWidth || config.Height > AppConfig.MaxImageHeight ||
+		config.Width*config.Height > AppConfig.MaxImagePixels {
+		log.Printf("Ignoring unusable poster frame (%s, %v)", kind, err)
+		return nil
+	}
+	poster, _, err := image.Decode(bytes.NewReader(stdout.Bytes()))
+	if err != nil {
+		log.Printf("Error decoding poster frame: %v", err)
+		return nil
+	}
+	return poster
+}
+
+// mp4Brands are the ftyp brands of MP4 files browsers play. HEIC images
+// share the container but use their own brands.
+var mp4Brands = []string{"isom", "iso2", "iso3", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "M4V ", "dash", "av01"}
+
+// isMP4 reports whether data starts with the ftyp box of an MP4 file
+func isMP4(data []byte) bool {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	size := min(int(binary.BigEndian.Uint32(data[0:4])), len(data))
+	// The major brand, a minor version, then the compatible brands
+	for i := 8; i+4 <= size; i += 4 {
+		if i != 12 && slices.Contains(mp4Brands, string(data[i:i+4])) {
+			return true
+		}
+	}
+	return false
+}
+
+// isoPath returns the content of the first box found by following a path
+// of nested box types, such as "mdia/minf/stbl"
+func isoPath(data []byte, path string) ([]byte, bool) {
+	for _, want := range strings.Split(path, "/") {
+		var found []byte
+		isoBoxes(data, func(boxType string, content []byte) error {
+			if found == nil && boxType == want {
+				found = content
+			}
+			return nil
+		})
+		if found == nil {
+			return nil, false
+		}
+		data = found
+	}
+	return data, true
+}
+
+// probeMP4 reads the duration and tracks from the movie box of an MP4 file
+func probeMP4(data []byte) (videoInfo, error) {
+	var info videoInfo
+	moov, ok := isoPath(data, "moov")
+	if !ok {
+		return info, errVideoCorrupt
+	}
+
+	// The duration is counted in units of the movie timescale. Fragmented
+	// files may leave it out and state it in the movie extends header.
+	mvhd, ok := isoPath(moov, "mvhd")
+	if !ok || len(mvhd) < 20 {
+		return info, errVideoCorrupt
+	}
+	var timescale, duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return info, errVideoCorrupt
+		}
+		timescale, duration = uint64(binary.BigEndian.Uint32(mvhd[20:24])), binary.BigEndian.Uint64(mvhd[24:32])
+	} else {
+		timescale, duration = uint64(binary.BigEndian.Uint32(mvhd[12:16])), uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+	if mehd, ok := isoPath(moov, "mvex/mehd"); ok && duration == 0 {
+		if len(mehd) >= 12 && mehd[0] == 1 {
+			duration = binary.BigEndian.Uint64(mehd[4:12])
+		} else if len(mehd) >= 8 {
+			duration = uint64(binary.BigEndian.Uint32(mehd[4:8]))
+		}
+	}
+	if timescale > 0 {
+		info.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+	}
+
+	err := isoBoxes(moov, func(boxType string, trak []byte) error {
+		if boxType != "trak" {
+			return nil
+		}
+		hdlr, ok := isoPath(trak, "mdia/hdlr")
+		if !ok || len(hdlr) < 12 {
+			return errVideoCorrupt
+		}
+		handler := string(hdlr[8:12])
+		if handler != "vide" && handler != "soun" {
+			return nil // Subtitles, timecodes and the like are not played
+		}
+
+		// The codec is the type of the first sample entry, after the
+		// version, flags and entry count
+		stsd, ok := isoPath(trak, "mdia/minf/stbl/stsd")
+		if !ok || len(stsd) < 16 {
+			return errVideoCorrupt
+		}
+		codec, entry := string(stsd[12:16]), stsd[16:]
+		info.Codecs = append(info.Codecs, codec)
+		if handler != "vide" || info.HasVideo {
+			return nil
+		}
+		info.HasVideo = true
+
+		// The track header ends with the display size in 16.16 fixed
+		// point; the sample entry has the coded size
+		if tkhd, ok := isoPath(trak, "tkhd"); ok && len(tkhd) >= 8 {
+			info.Width = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]) >> 16)
+			info.Height = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]) >> 16)
+		}
+		if (info.Width == 0 || info.Height == 0) && len(entry) >= 28 {
+			info.Width = int(binary.BigEndian.Uint16(entry[24:26]))
+			info.Height = int(binary.BigEndian.Uint16(entry[26:28]))
+		}
+		return nil
+	})
+	return info, err
+}
+
+// stripMP4Metadata blanks the user data and metadata boxes of an MP4 file,
+// where phones record the location and device of a clip. They are turned
+// into zeroed free space, so no offsets within the file change.
+func stripMP4Metadata(data []byte) ([]byte, error) {
+	stripped := bytes.Clone(data)
+	var walk func(boxType string, content []byte) error
+	walk = func(boxType string, content []byte) error {
+		switch boxType {
+		case "udta", "meta":
+			// The content shares the backing array, so its capacity tells
+			// where the box starts. Boxes with a 64-bit size have it
+			// between the type and the content.
+			at := cap(stripped) - cap(content) - 4
+			if string(stripped[at:at+4]) != boxType {
+				at -= 8
+			}
+			copy(stripped[at:], "free")
+			clear(content)
+		case "moov", "trak":
+			return isoBoxes(content, walk)
+		}
+		return nil
+	}
+	if err := isoBoxes(stripped, walk); err != nil {
+		return nil, err
+	}
+	return stripped, nil
+}
+
+// EBML element IDs of the WebM elements that are read
+const (
+	ebmlHeaderID      = 0x1A45DFA3
+	ebmlDocTypeID     = 0x4282
+	webmSegmentID     = 0x18538067
+	webmInfoID        = 0x1549A966
+	webmTimescaleID   = 0x2AD7B1
+	webmDurationID    = 0x4489
+	webmTracksID      = 0x1654AE6B
+	webmTrackEntryID  = 0xAE
+	webmTrackTypeID   = 0x83
+	webmCodecID       = 0x86
+	webmVideoID       = 0xE0
+	webmPixelWidthID  = 0xB0
+	webmPixelHeightID = 0xBA
+	webmClusterID     = 0x1F43B675
+	webmTimestampID   = 0xE7
+	webmSimpleBlockID = 0xA3
+	webmBlockGroupID  = 0xA0
+	webmBlockID       = 0xA1
+	webmTagsID        = 0x1254C367
+	ebmlVoidID        = 0xEC
+)
+
+// webmTopLevelIDs are the children of a segment. A cluster of unknown size
+// ends where one of them begins.
+var webmTopLevelIDs = map[uint64]bool{
+	0x114D9B74: true, webmInfoID: true, webmTracksID: true, 0x1C53BB6B: true,
+	webmClusterID: true, 0x1043A770: true, webmTagsID: true, 0x1941A469: true,
+}
+
+// ebmlElement is an element of an EBML document such as a WebM file
+type ebmlElement struct {
+	ID          uint64
+	Data        []byte
+	UnknownSize bool // Streamed elements may not state their size
+}
+
+// readVint reads a variable length integer. IDs keep their length marker,
+// sizes do not.
+func readVint(data []byte, keepMarker bool) (uint64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for data[0]&(0x80>>(length-1)) == 0 {
+		length++
+	}
+	if length > len(data) {
+		return 0, 0
+	}
+	value := uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+// readEBMLElement reads the element at the start of data and returns it
+// along with its length. Elements of unknown size extend to the end of data.
+func readEBMLElement(data []byte) (ebmlElement, int, error) {
+	id, idLen := readVint(data, true)
+	if idLen == 0 || idLen > 4 {
+		return ebmlElement{}, 0, errVideoCorrupt
+	}
+	size, sizeLen := readVint(data[idLen:], false)
+	if sizeLen == 0 {
+		return ebmlElement{}, 0, errVideoCorrupt
+	}
+	start := idLen + sizeLen
+	el := ebmlElement{ID: id}
+	if size == 1<<(7*sizeLen)-1 {
+		el.UnknownSize = true
+		size = uint64(len(data) - start)
+	}
+	if size > uint64(len(data)-start) {
+		return ebmlElement{}, 0, errVideoCorrupt
+	}
+	el.Data = data[start : start+int(size)]
+	return el, start + int(size), nil
+}
+
+// ebmlChildren reads the elements data is made of
+func ebmlChildren(data []byte) ([]ebmlElement, error) {
+	var children []ebmlElement
+	for len(data) > 0 {
+		el, n, err := readEBMLElement(data)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, el)
+		data = data[n:]
+	}
+	return children, nil
+}
+
+// ebmlUint decodes an unsigned integer element
+func ebmlUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// ebmlFloat decodes a float element, which is 4 or 8 bytes long
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+// isWebM reports whether data starts with the EBML header of a WebM file
+func isWebM(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+		return false
+	}
+	header, _, err := readEBMLElement(data)
+	if err != nil {
+		return false
+	}
+	children, err := ebmlChildren(header.Data)
+	if err != nil {
+		return false
+	}
+	for _, child := range children {
+		if child.ID == ebmlDocTypeID {
+			return string(child.Data) == "webm"
+		}
+	}
+	return false
+}
+
+// probeWebM reads the segment information, tracks and clusters of a WebM
+// file. Recordings made in browsers often state no duration, so it is also
+// worked out from the timestamps of the clusters, and the longer one counts.
+func probeWebM(data []byte) (videoInfo, error) {
+	var info videoInfo
+	_, n, err := readEBMLElement(data)
+	if err != nil {
+		return info, err
+	}
+	segment, _, err := readEBMLElement(data[n:])
+	if err != nil || segment.ID != webmSegmentID {
+		return info, errVideoCorrupt
+	}
+
+	timescale := uint64(time.Millisecond) // Default length of a tick in nanoseconds
+	var statedTicks float64
+	var lastTick int64
+
+	body := segment.Data
+	for len(body) > 0 {
+		el, n, err := readEBMLElement(body)
+		if err != nil {
+			return info, err
+		}
+		switch el.ID {
+		case webmInfoID:
+			children, err := ebmlChildren(el.Data)
+			if err != nil {
+				return info, err
+			}
+			for _, child := range children {
+				switch child.ID {
+				case webmTimescaleID:
+					timescale = ebmlUint(child.Data)
+				case webmDurationID:
+					statedTicks = ebmlFloat(child.Data)
+				}
+			}
+		case webmTracksID:
+			if err := readWebMTracks(el.Data, &info); err != nil {
+				return info, err
+			}
+		case webmClusterID:
+			end, consumed, err := webmClusterEnd(el.Data)
+			if err != nil {
+				return info, err
+			}
+			lastTick = max(lastTick, end)
+			if el.UnknownSize {
+				n -= len(el.Data) - consumed
+			}
+		}
+		body = body[n:]
+	}
+
+	ticks := max(statedTicks, float64(lastTick))
+	info.Duration = time.Duration(ticks * float64(timescale))
+	return info, nil
+}
+
+// readWebMTracks records the codecs and video size of the track entries
+func readWebMTracks(data []byte, info *videoInfo) error {
+	tracks, err := ebmlChildren(data)
+	if err != nil {
+		return err
+	}
+	for _, track := range tracks {
+		if track.ID != webmTrackEntryID {
+			continue
+		}
+		fields, err := ebmlChildren(track.Data)
+		if err != nil {
+			return err
+		}
+		var trackType uint64
+		var codec string
+		var video []byte
+		for _, field := range fields {
+			switch field.ID {
+			case webmTrackTypeID:
+				trackType = ebmlUint(field.Data)
+			case webmCodecID:
+				codec = strings.TrimRight(string(field.Data), "\x00")
+			case webmVideoID:
+				video = field.Data
+			}
+		}
+		if trackType != 1 && trackType != 2 {
+			continue // Subtitles and the like are not played
+		}
+		info.Codecs = append(info.Codecs, codec)
+		if trackType == 1 && !info.HasVideo {
+			info.HasVideo = true
+			settings, err := ebmlChildren(video)
+			if err != nil {
+				return err
+			}
+			for _, setting := range settings {
+				switch setting.ID {
+				case webmPixelWidthID:
+					info.Width = int(ebmlUint(setting.Data))
+				case webmPixelHeightID:
+					info.Height = int(ebmlUint(setting.Data))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// webmClusterEnd returns the tick of the last block in a cluster and how
+// many bytes of data belong to it. A cluster of unknown size ends where the
+// next top-level element begins.
+func webmClusterEnd(data []byte) (int64, int, error) {
+	var clusterTick, lastBlock int64
+	consumed := 0
+	for consumed < len(data) {
+		el, n, err := readEBMLElement(data[consumed:])
+		if err != nil {
+			return 0, 0, err
+		}
+		if webmTopLevelIDs[el.ID] {
+			break
+		}
+		switch el.ID {
+		case webmTimestampID:
+			clusterTick = int64(ebmlUint(el.Data))
+		case webmSimpleBlockID:
+			lastBlock = max(lastBlock, webmBlockTick(el.Data))
+		case webmBlockGroupID:
+			children, err := ebmlChildren(el.Data)
+			if err != nil {
+				return 0, 0, err
+			}
+			for _, child := range children {
+				if child.ID == webmBlockID {
+					lastBlock = max(lastBlock, webmBlockTick(child.Data))
+				}
+			}
+		}
+		consumed += n
+	}
+	return clusterTick + lastBlock, consumed, nil
+}
+
+// stripWebMMetadata turns the tags of a WebM file, where recorders note
+// details such as the location, device or software of a clip, into void
+// elements of the same size, so no positions within the file change.
+func stripWebMMetadata(data []byte) ([]byte, error) {
+	stripped := bytes.Clone(data)
+	_, n, err := readEBMLElement(stripped)
+	if err != nil {
+		return nil, err
+	}
+	segment, _, err := readEBMLElement(stripped[n:])
+	if err != nil || segment.ID != webmSegmentID {
+		return nil, errVideoCorrupt
+	}
+
+	body := segment.Data
+	for len(body) > 0 {
+		el, n, err := readEBMLElement(body)
+		if err != nil {
+			return nil, err
+		}
+		switch el.ID {
+		case webmTagsID:
+			if el.UnknownSize {
+				return nil, errVideoCorrupt
+			}
+			voidEBMLElement(body[:n])
+		case webmClusterID:
+			if el.UnknownSize {
+				_, consumed, err := webmClusterEnd(el.Data)
+				if err != nil {
+					return nil, err
+				}
+				n -= len(el.Data) - consumed
+			}
+		}
+		body = body[n:]
+	}
+	return stripped, nil
+}
+
+// voidEBMLElement overwrites a whole element, header included, with a
+// zeroed Void element of the same length
+func voidEBMLElement(el []byte) {
+	sizeLen := min(8, len(el)-1)
+	size := len(el) - 1 - sizeLen
+	clear(el)
+	el[0] = ebmlVoidID
+	for i := sizeLen; i > 0; i-- {
+		el[i] = byte(size)
+		size >>= 8
+	}
+	el[1] |= 0x80 >> (sizeLen - 1)
+}
+
+// webmBlockTick returns the timestamp of a block relative to its cluster
+func webmBlockTick(data []byte) int64 {
+	_, n := readVint(data, false) // Track number
+	if n == 0 || len(data) < n+2 {
+		return 0
+	}
+	return int64(int16(binary.BigEndian.Uint16(data[n:])))
+}
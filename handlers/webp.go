@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+
+	"golang.org/x/image/webp"
+)
+
+// errWebPAnimated rejects animated WebP files, which the WebP decoder
+// cannot read to give them a still poster. Its message is an ErrorMessages key.
+var errWebPAnimated = errors.New("image_webp_animated")
+
+// VP8X header flags
+const (
+	webpFlagAnimation = 0x02
+	webpFlagXMP       = 0x04
+	webpFlagEXIF      = 0x08
+)
+
+// webpChunk is one chunk of a WebP file's RIFF container
+type webpChunk struct {
+	FourCC string
+	Data   []byte
+}
+
+// isWebP reports whether data starts with a WebP RIFF header
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// webpChunks splits a WebP file into its chunks
+func webpChunks(data []byte) ([]webpChunk, error) {
+	if !isWebP(data) {
+		return nil, errImageCorrupt
+	}
+	size := int(binary.LittleEndian.Uint32(data[4:8]))
+	if size < 4 || size+8 > len(data) {
+		return nil, errImageCorrupt
+	}
+	body := data[12 : size+8]
+
+	var chunks []webpChunk
+	for len(body) > 0 {
+		if len(body) < 8 {
+			return nil, errImageCorrupt
+		}
+		n := int(binary.LittleEndian.Uint32(body[4:8]))
+		if n > len(body)-8 {
+			return nil, errImageCorrupt
+		}
+		chunks = append(chunks, webpChunk{FourCC: string(body[0:4]), Data: body[8 : 8+n]})
+		n += n & 1 // Chunks are padded to an even size
+		if 8+n > len(body) {
+			n = len(body) - 8
+		}
+		body = body[8+n:]
+	}
+	return chunks, nil
+}
+
+// webpConfig reads the dimensions of a WebP file from its headers. WebP
+// cannot be decoded with the standard library, so this also checks that
+// the file is structurally sound.
+func webpConfig(data []byte) (image.Config, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	var width, height int
+	hasBitstream := false
+	for i, chunk := range chunks {
+		d := chunk.Data
+		switch chunk.FourCC {
+		case "VP8X":
+			if i != 0 || len(d) < 10 {
+				return image.Config{}, errImageCorrupt
+			}
+			if d[0]&webpFlagAnimation != 0 {
+				return image.Config{}, errWebPAnimated
+			}
+			width = 1 + (int(d[4]) | int(d[5])<<8 | int(d[6])<<16)
+			height = 1 + (int(d[7]) | int(d[8])<<8 | int(d[9])<<16)
+		case "VP8 ":
+			// Lossy: a frame tag followed by the start code and dimensions
+			if len(d) < 10 || d[3] != 0x9d || d[4] != 0x01 || d[5] != 0x2a {
+				return image.Config{}, errImageCorrupt
+			}
+			if width == 0 {
+				width = int(binary.LittleEndian.Uint16(d[6:8]) & 0x3fff)
+				height = int(binary.LittleEndian.Uint16(d[8:10]) & 0x3fff)
+			}
+			hasBitstream = true
+		case "VP8L":
+			// Lossless: a signature byte followed by 14-bit dimensions
+			if len(d) < 5 || d[0] != 0x2f {
+				return image.Config{}, errImageCorrupt
+			}
+			if width == 0 {
+				bits := binary.LittleEndian.Uint32(d[1:5])
+				width = int(bits&0x3fff) + 1
+				height = int(bits>>14&0x3fff) + 1
+			}
+			hasBitstream = true
+		case "ANIM", "ANMF":
+			return image.Config{}, errWebPAnimated
+		}
+	}
+	if !hasBitstream || width == 0 || height == 0 {
+		return image.Config{}, errImageCorrupt
+	}
+	return image.Config{ColorModel: color.RGBAModel, Width: width, Height: height}, nil
+}
+
+// decodeWebP decodes a still WebP image, which has no encoder, so its
+// pixels are only used for hashing, previews and avatars
+func decodeWebP(data []byte) (image.Image, error) {
+	return webp.Decode(bytes.NewReader(data))
+}
+
+// stripWebPMetadata removes the EXIF and XMP chunks of a WebP file,
+// leaving the image data untouched
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	for _, chunk := range chunks {
+		if chunk.FourCC == "EXIF" || chunk.FourCC == "XMP " {
+			continue
+		}
+		chunkData := chunk.Data
+		if chunk.FourCC == "VP8X" {
+			chunkData = append([]byte(nil), chunkData...)
+			chunkData[0] &^= webpFlagEXIF | webpFlagXMP
+		}
+		body.WriteString(chunk.FourCC)
+		binary.Write(&body, binary.LittleEndian, uint32(len(chunkData)))
+		body.Write(chunkData)
+		if len(chunkData)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(body.Len()+4))
+	out.WriteString("WEBP")
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
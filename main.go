@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,20 +11,69 @@ import (
 )
 
 func main() {
+	// Load configuration overrides from the environment
+	handlers.LoadConfig()
+	handlers.InitStorage()
+
 	args := os.Args
+	if len(args) > 1 && args[1] == "gc" {
+		runGC(args[2:])
+		return
+	}
+	if len(args) == 2 && args[1] == "phash" {
+		handlers.InitDB()
+		n, err := handlers.BackfillPerceptualHashes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("hashed %d images\n", n)
+		return
+	}
+	if len(args) == 2 && args[1] == "blurhash" {
+		handlers.InitDB()
+		n, err := handlers.BackfillPlaceholders()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("computed placeholders for %d images\n", n)
+		return
+	}
+	if len(args) == 4 && args[1] == "role" {
+		handlers.InitDB()
+		if err := handlers.SetUserRole(args[2], args[3]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if len(args) != 1 {
-		fmt.Println("usage: go run .")
+		fmt.Println("usage: go run . [gc [-dry-run] [-grace 24h] | phash | blurhash | role <email> user|moderator|admin]")
 		return
 	}
+
 	// Serve static files from the "static" directory
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads"))))
+	// Serve uploaded images by ID, checking who may see them
+	http.HandleFunc("/media/", handlers.MediaHandler)
+	// Large images can be uploaded in chunks and resumed after a dropped connection
+	http.HandleFunc("/upload/resumable", handlers.ResumableUploadHandler)
+	http.HandleFunc("/upload/resumable/", handlers.ResumableUploadHandler)
+	// Avatars, falling back to an identicon for users without one
+	http.HandleFunc("/avatar/", handlers.AvatarHandler)
+	// Permalink pages of single posts
+	http.HandleFunc("/posts/", handlers.PostPageHandler)
+	// Moderator tools
+	http.HandleFunc("/moderation/images", handlers.ImageReviewHandler)
+	http.HandleFunc("/moderation/banned-images", handlers.BannedImagesHandler)
+	http.HandleFunc("/moderation/deleted", handlers.DeletedContentHandler)
 
 	http.HandleFunc("/", handler)
 
 	// Initialize the database
 	handlers.InitDB()
 
+	// Remove orphaned uploads in the background
+	handlers.StartUploadSweeper()
+
 	// Start the server
 	log.Println("Server is running on http://localhost:8081")
 	err := http.ListenAndServe(":8081", nil)
@@ -32,6 +82,30 @@ func main() {
 	}
 }
 
+// runGC removes orphaned uploads once and prints what was found
+func runGC(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report orphans without removing them")
+	grace := flags.Duration("grace", handlers.AppConfig.GCGracePeriod, "only remove uploads older than this")
+	flags.Parse(args)
+
+	handlers.InitDB()
+	report, err := handlers.CollectGarbage(handlers.GCOptions{DryRun: *dryRun, GracePeriod: *grace})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, f := range report.OrphanedFiles {
+		fmt.Printf("orphaned file    %s (%d bytes)\n", f.Key, f.Size)
+	}
+	for _, id := range report.OrphanedRows {
+		fmt.Printf("orphaned image   #%d\n", id)
+	}
+	for _, m := range report.MissingFiles {
+		fmt.Printf("missing file     %s (%s #%d)\n", m.Key, m.Table, m.ID)
+	}
+	fmt.Println(report)
+}
+
 func handler(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/":
@@ -44,16 +118,22 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		handlers.LikeHandler(w, r)
 	case "/filter":
 		handlers.FilterHandler(w, r)
+	case "/upload":
+		handlers.UploadHandler(w, r)
 	case "/post":
 		handlers.PostHandler(w, r)
 	case "/comment":
 		handlers.CommentHandler(w, r)
 	case "/comment/like":
 		handlers.CommentLikeHandler(w, r)
+	case "/comment/delete":
+		handlers.CommentDeleteHandler(w, r)
 	case "/logout":
 		handlers.LogoutHandler(w, r)
 	case "/profile":
 		handlers.ProfileHandler(w, r)
+	case "/profile/settings":
+		handlers.ProfileSettingsHandler(w, r)
 	default:
 		handlers.RenderError(w, r, "Page not found", http.StatusNotFound)
 	}
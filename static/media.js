@@ -0,0 +1,121 @@
+// Animated GIFs are shown as a still first frame. Clicking the frame (or
+// pressing Enter on it) plays the animation, and doing so again stops it.
+// Readers who prefer reduced motion only ever see the still frame.
+(function () {
+    const reduceMotion = window.matchMedia('(prefers-reduced-motion: reduce)');
+
+    function toggleAnimation(img) {
+        if (reduceMotion.matches) return;
+
+        if (img.dataset.poster) {
+            // Playing: go back to the still frame
+            img.srcset = img.dataset.posterSrcset;
+            img.src = img.dataset.poster;
+            delete img.dataset.poster;
+            img.classList.remove('playing');
+            img.title = 'Play animation';
+        } else {
+            img.dataset.poster = img.src;
+            img.dataset.posterSrcset = img.srcset;
+            img.removeAttribute('srcset');
+            img.src = img.dataset.animation;
+            img.classList.add('playing');
+            img.title = 'Stop animation';
+        }
+    }
+
+    document.addEventListener('click', function (event) {
+        const img = event.target.closest('img[data-animation]');
+        if (img) toggleAnimation(img);
+    });
+
+    document.addEventListener('keydown', function (event) {
+        if (event.key !== 'Enter' && event.key !== ' ') return;
+        const img = event.target.closest('img[data-animation]');
+        if (img) {
+            event.preventDefault();
+            toggleAnimation(img);
+        }
+    });
+})();
+
+// Images with a data-blurhash attribute show a blurred preview of
+// themselves until they have loaded. The BlurHash is decoded into a small
+// canvas that is stretched behind the image (https://blurha.sh).
+(function () {
+    const chars = '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~';
+    const size = 32;
+
+    function decode83(str) {
+        let value = 0;
+        for (const c of str) value = value * 83 + chars.indexOf(c);
+        return value;
+    }
+
+    function toLinear(v) {
+        v /= 255;
+        return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4);
+    }
+
+    function toSRGB(v) {
+        v = Math.max(0, Math.min(1, v));
+        return Math.round(v <= 0.0031308 ? v * 12.92 * 255 : (1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255);
+    }
+
+    function signPow(v, exp) {
+        return Math.sign(v) * Math.pow(Math.abs(v), exp);
+    }
+
+    function decode(hash) {
+        const sizeFlag = decode83(hash[0]);
+        const numX = (sizeFlag % 9) + 1;
+        const numY = Math.floor(sizeFlag / 9) + 1;
+        if (hash.length !== 4 + 2 * numX * numY) return null;
+
+        const maxValue = (decode83(hash[1]) + 1) / 166;
+        const dc = decode83(hash.substring(2, 6));
+        const colors = [[toLinear(dc >> 16), toLinear((dc >> 8) & 255), toLinear(dc & 255)]];
+        for (let i = 1; i < numX * numY; i++) {
+            const ac = decode83(hash.substring(4 + i * 2, 6 + i * 2));
+            colors.push([Math.floor(ac / 361), Math.floor(ac / 19) % 19, ac % 19]
+                .map(q => signPow((q - 9) / 9, 2) * maxValue));
+        }
+
+        const pixels = new ImageData(size, size);
+        for (let y = 0; y < size; y++) {
+            for (let x = 0; x < size; x++) {
+                let r = 0, g = 0, b = 0;
+                for (let j = 0; j < numY; j++) {
+                    for (let i = 0; i < numX; i++) {
+                        const basis = Math.cos(Math.PI * x * i / size) * Math.cos(Math.PI * y * j / size);
+                        const color = colors[i + j * numX];
+                        r += color[0] * basis;
+                        g += color[1] * basis;
+                        b += color[2] * basis;
+                    }
+                }
+                const o = 4 * (x + y * size);
+                pixels.data[o] = toSRGB(r);
+                pixels.data[o + 1] = toSRGB(g);
+                pixels.data[o + 2] = toSRGB(b);
+                pixels.data[o + 3] = 255;
+            }
+        }
+        const canvas = document.createElement('canvas');
+        canvas.width = canvas.height = size;
+        canvas.getContext('2d').putImageData(pixels, 0, 0);
+        return canvas.toDataURL();
+    }
+
+    document.querySelectorAll('img[data-blurhash]').forEach(function (img) {
+        if (img.complete && img.naturalWidth) return;
+        const preview = decode(img.dataset.blurhash);
+        if (!preview) return;
+        img.style.backgroundImage = 'url(' + preview + ')';
+        img.classList.add('blurhash');
+        img.addEventListener('load', function () {
+            img.style.backgroundImage = '';
+            img.classList.remove('blurhash');
+        }, { once: true });
+    });
+})();
@@ -0,0 +1,151 @@
+// Reactions and comment forms of posts, shared by the feed and post pages
+let isProcessing = false; // Debounce flag
+
+function toggleLike(postId, isLike) {
+    if (isProcessing) return; // Prevent multiple rapid clicks
+    isProcessing = true;
+
+    fetch('/like', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/x-www-form-urlencoded',
+        },
+        body: `post_id=${postId}&is_like=${isLike}`
+    })
+        .then(response => {
+            if (response.status === 401) {
+                // User is not logged in, redirect to login page
+                window.location.href = '/login';
+                return;
+            }
+            return response.json();
+        })
+        .then(data => {
+            if (data && data.success) {
+                // Update the like and dislike counts
+                const likeCountElement = document.querySelector(`.like-button[data-post-id="${postId}"] .like-count`);
+                const dislikeCountElement = document.querySelector(`.dislike-button[data-post-id="${postId}"] .dislike-count`);
+
+                likeCountElement.textContent = data.like_count;
+                dislikeCountElement.textContent = data.dislike_count;
+
+                // Update button styles
+                const likeButton = document.querySelector(`.like-button[data-post-id="${postId}"]`);
+                const dislikeButton = document.querySelector(`.dislike-button[data-post-id="${postId}"]`);
+
+                if (isLike) {
+                    likeButton.classList.toggle('active');
+                    dislikeButton.classList.remove('active');
+                } else {
+                    dislikeButton.classList.toggle('active');
+                    likeButton.classList.remove('active');
+                }
+            } else if (data && data.success) {
+                console.error('Error:', data.error);
+                alert(data.error); // Optional: Show the error message
+            }
+        })
+        .catch(error => {
+            console.error('Error:', error);
+            alert('An error occurred. Please try again.');
+        })
+        .finally(() => {
+            isProcessing = false; // Reset debounce flag
+        });
+}
+
+function toggleCommentLike(commentId, isLike) {
+    if (isProcessing) return; // Prevent multiple rapid clicks
+    isProcessing = true;
+
+    fetch('/comment/like', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/x-www-form-urlencoded',
+        },
+        body: `comment_id=${commentId}&is_like=${isLike}`
+    })
+        .then(response => {
+            if (!response.ok) {
+                return response.text().then(text => {
+                    throw new Error(text);
+                });
+            }
+            return response.json();
+        })
+        .then(data => {
+            // Find the clicked button directly using the data-comment-id attribute
+            const clickedButton = document.querySelector(`button[data-comment-id="${commentId}"][class*="-button"]`);
+            if (!clickedButton) return;
+
+            // Find the parent comment container
+            const comment = clickedButton.closest('.comment');
+            if (!comment) return;
+
+            // Find the like/dislike buttons within this comment
+            const likeButton = comment.querySelector('.like-button[data-comment-id="' + commentId + '"]');
+            const dislikeButton = comment.querySelector('.dislike-button[data-comment-id="' + commentId + '"]');
+
+            if (!likeButton || !dislikeButton) return;
+
+            const likeCountElement = likeButton.querySelector('.like-count');
+            const dislikeCountElement = dislikeButton.querySelector('.dislike-count');
+
+            // Update the counts
+            if (likeCountElement) likeCountElement.textContent = data.likeCount;
+            if (dislikeCountElement) dislikeCountElement.textContent = data.dislikeCount;
+
+            // Update button styles based on userLiked
+            if (data.userLiked === true) {
+                likeButton.classList.add('active');
+                dislikeButton.classList.remove('active');
+            } else if (data.userLiked === false) {
+                dislikeButton.classList.add('active');
+                likeButton.classList.remove('active');
+            } else {
+                // If userLiked is null, remove both active states
+                likeButton.classList.remove('active');
+                dislikeButton.classList.remove('active');
+            }
+        })
+        .catch(error => {
+            console.error('Error:', error);
+            alert(error.message || 'An error occurred. Please try again.');
+        })
+        .finally(() => {
+            isProcessing = false; // Reset debounce flag
+        });
+}
+
+function toggleReplyForm(commentId) {
+    const replyForm = document.getElementById(`reply-form-${commentId}`);
+    if (replyForm.style.display === 'none') {
+        replyForm.style.display = 'block';
+    } else {
+        replyForm.style.display = 'none';
+    }
+}
+
+// Function to validate the comment form
+function validateCommentForm(event, form) {
+    // Get the textarea element
+    const textarea = form.querySelector('textarea[name="content"]');
+
+    // Check if the textarea is empty or contains only whitespace
+    if (!textarea.value.trim()) {
+        // Prevent form submission
+        event.preventDefault();
+
+        // Alert the user
+        alert("Comment cannot be empty. Please write something before submitting.");
+
+        // Focus on the textarea so the user can continue typing
+        textarea.focus();
+
+        // Return false to prevent form submission
+        return false;
+    }
+
+    // If the textarea is not empty, allow form submission
+    return true;
+}
@@ -0,0 +1,228 @@
+// Images are uploaded as soon as they are picked, dropped or pasted, so the
+// post or comment form only has to send back the token /upload answers
+// with. If the upload cannot reach the server the file stays in the form
+// and is sent with it as before.
+//
+// Large files are sent in chunks through /upload/resumable. When the
+// connection drops, the upload carries on from the last byte the server
+// received, even after the page is reloaded.
+(function () {
+    const chunkSize = 1 << 20;
+    const resumableThreshold = 4 << 20;
+    const maxRetries = 20;
+
+    function wait(ms) {
+        return new Promise(resolve => setTimeout(resolve, ms));
+    }
+
+    // serverOffset asks how much of an upload has arrived, or returns
+    // null if the server no longer knows it
+    function serverOffset(url) {
+        return fetch(url, { method: 'HEAD' }).then(response => {
+            if (!response.ok) return null;
+            return Number(response.headers.get('Upload-Offset'));
+        });
+    }
+
+    function uploadResumable(file, fields, onProgress) {
+        const key = 'resumable-upload:' + [file.name, file.size, file.lastModified].join(':');
+        let url = localStorage.getItem(key);
+        let offset = 0;
+        let retries = 0;
+
+        function begin() {
+            const resume = url ? serverOffset(url) : Promise.resolve(null);
+            return resume.then(known => {
+                if (known !== null) {
+                    offset = known;
+                    return null;
+                }
+                const body = new FormData();
+                body.append('filename', file.name);
+                body.append('size', file.size);
+                return fetch('/upload/resumable', { method: 'POST', body: body })
+                    .then(response => response.json())
+                    .then(data => {
+                        if (!data.success) return data;
+                        url = '/upload/resumable/' + data.id;
+                        localStorage.setItem(key, url);
+                        return null;
+                    });
+            });
+        }
+
+        function sendChunks() {
+            if (offset >= file.size) return complete();
+            onProgress(offset / file.size);
+            return fetch(url, {
+                method: 'PATCH',
+                headers: { 'Upload-Offset': String(offset) },
+                body: file.slice(offset, offset + chunkSize),
+            }).then(response => {
+                if (response.ok) {
+                    retries = 0;
+                    offset = Number(response.headers.get('Upload-Offset'));
+                    return sendChunks();
+                }
+                if (response.status === 409) {
+                    // Out of step with the server: pick up from its offset
+                    return retry();
+                }
+                localStorage.removeItem(key);
+                return response.json();
+            }, retry);
+        }
+
+        function retry() {
+            if (++retries > maxRetries) {
+                return Promise.reject(new Error('upload interrupted'));
+            }
+            return wait(Math.min(1000 * retries, 30000))
+                .then(() => serverOffset(url))
+                .then(known => {
+                    if (known === null) {
+                        localStorage.removeItem(key);
+                        return Promise.reject(new Error('upload expired'));
+                    }
+                    offset = known;
+                    return sendChunks();
+                }, retry);
+        }
+
+        function complete() {
+            return fetch(url, { method: 'POST', body: fields })
+                .then(response => response.json())
+                .then(data => {
+                    localStorage.removeItem(key);
+                    return data;
+                });
+        }
+
+        return begin().then(failed => failed || sendChunks());
+    }
+
+    function fieldParts(field) {
+        return {
+            file: field.querySelector('input[type="file"]'),
+            token: field.querySelector('input[name^="image_token"]'),
+            preview: field.querySelector('.upload-preview'),
+            status: field.querySelector('.upload-status'),
+        };
+    }
+
+    function showStatus(parts, message, isError) {
+        parts.status.textContent = message;
+        parts.status.classList.toggle('error', isError);
+    }
+
+    function upload(field, file) {
+        const parts = fieldParts(field);
+        const form = field.closest('form');
+
+        const fields = new FormData();
+        form.querySelectorAll('input[name="category"]:checked').forEach(input => {
+            fields.append('category', input.value);
+        });
+        const postID = form.querySelector('input[name="post_id"]');
+        if (postID) fields.append('post_id', postID.value);
+
+        parts.token.value = '';
+        parts.preview.hidden = true;
+        field.dataset.uploading = 'true';
+        showStatus(parts, 'Uploading…', false);
+
+        let sent;
+        if (file.size > resumableThreshold) {
+            sent = uploadResumable(file, fields, progress => {
+                showStatus(parts, 'Uploading… ' + Math.round(progress * 100) + '%', false);
+            });
+        } else {
+            fields.append('image', file);
+            sent = fetch('/upload', { method: 'POST', body: fields }).then(response => response.json());
+        }
+
+        sent
+            .then(data => {
+                // The upload has been handled either way, so the form must
+                // not send the file again
+                parts.file.value = '';
+                if (!data.success) {
+                    showStatus(parts, data.message || 'Upload failed', true);
+                    return;
+                }
+                parts.token.value = data.token;
+                // The preview is an <img>, which cannot show clips
+                if (!file.type.startsWith('video/')) {
+                    parts.preview.src = data.url;
+                    parts.preview.hidden = false;
+                }
+                showStatus(parts, 'Uploaded', false);
+            })
+            .catch(() => {
+                if (parts.file.files.length > 0) {
+                    showStatus(parts, 'The image will be sent with the form', false);
+                } else {
+                    // Dropped and pasted files cannot be put into the input
+                    showStatus(parts, 'Upload failed, please try again', true);
+                }
+            })
+            .finally(() => {
+                delete field.dataset.uploading;
+            });
+    }
+
+    function imageFromList(files) {
+        return Array.from(files || []).find(file => file.type.startsWith('image/') || file.type.startsWith('video/'));
+    }
+
+    document.addEventListener('change', function (event) {
+        const input = event.target;
+        if (input.type !== 'file') return;
+        const field = input.closest('.upload-field');
+        if (field && input.files.length > 0) upload(field, input.files[0]);
+    });
+
+    document.addEventListener('dragover', function (event) {
+        const field = event.target.closest && event.target.closest('.upload-field');
+        if (!field) return;
+        event.preventDefault();
+        field.classList.add('dragging');
+    });
+
+    document.addEventListener('dragleave', function (event) {
+        const field = event.target.closest && event.target.closest('.upload-field');
+        if (field) field.classList.remove('dragging');
+    });
+
+    document.addEventListener('drop', function (event) {
+        const field = event.target.closest && event.target.closest('.upload-field');
+        if (!field) return;
+        event.preventDefault();
+        field.classList.remove('dragging');
+        const file = imageFromList(event.dataTransfer.files);
+        if (file) upload(field, file);
+    });
+
+    // Pasting an image into a form fills its first empty image field
+    document.addEventListener('paste', function (event) {
+        const form = event.target.closest && event.target.closest('form');
+        if (!form) return;
+        const file = imageFromList(event.clipboardData && event.clipboardData.files);
+        if (!file) return;
+        const field = Array.from(form.querySelectorAll('.upload-field')).find(field => {
+            const parts = fieldParts(field);
+            return parts.token.value === '' && parts.file.files.length === 0 && !field.dataset.uploading;
+        });
+        if (!field) return;
+        event.preventDefault();
+        upload(field, file);
+    });
+
+    // Hold the form back until its uploads have finished
+    document.addEventListener('submit', function (event) {
+        if (event.target.querySelector('.upload-field[data-uploading]')) {
+            event.preventDefault();
+            alert('Please wait for the images to finish uploading.');
+        }
+    }, true);
+})();